@@ -0,0 +1,130 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveaudit"
+)
+
+const description = `
+This command audits the content of Go distribution archives (.tar.gz or .zip)
+before they're published. Pass archives as non-flag arguments.
+
+Each archive is checked against a policy:
+
+  - Entry paths are relative and don't contain "..".
+  - Directories and files have the permissions distpack uses.
+  - No entry has the setuid, setgid, or sticky bit.
+  - There is no VERSION.cache file.
+  - There are no compiled test binaries or executables in testdata dirs.
+  - There are no go.mod or go.sum files other than the std, cmd, and misc modules'.
+  - Files in bin and pkg/tool are executables for the archive's GOOS/GOARCH.
+
+GOOS/GOARCH is detected from the archive name, such as
+"go1.23.1-1234.linux-armv6l.tar.gz", unless -goos and -goarch are set.
+
+A JSON report listing the violations in each archive is written to stdout or the
+-o file. Exits with a nonzero code if any archive has a violation.
+`
+
+func main() {
+	goos := flag.String("goos", "", "The GOOS of the archives. Detected from the archive name if not set.")
+	goarch := flag.String("goarch", "", "The GOARCH of the archives. Detected from the archive name if not set.")
+	out := flag.String("o", "", "Write the JSON report to this file rather than stdout.")
+	help := flag.Bool("h", false, "Print this help message.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n", description)
+	}
+
+	flag.Parse()
+	if *help {
+		flag.Usage()
+		return
+	}
+	if flag.NArg() == 0 {
+		flag.Usage()
+		log.Fatal("No archives specified.")
+	}
+	if (*goos == "") != (*goarch == "") {
+		log.Fatal("Specify both -goos and -goarch, or neither.")
+	}
+
+	reports := make([]*archiveaudit.Report, 0, flag.NArg())
+	var failed int
+	for _, a := range flag.Args() {
+		targetOS, targetArch := *goos, *goarch
+		if targetOS == "" {
+			targetOS, targetArch = platformFromName(filepath.Base(a))
+			if targetOS == "" {
+				log.Printf("Unable to detect GOOS/GOARCH from name of %v; not checking executable formats.\n", a)
+			}
+		}
+		r, err := archiveaudit.Audit(a, archiveaudit.DefaultPolicy(targetOS, targetArch))
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, v := range r.Violations {
+			log.Printf("%v: %v: [%v] %v\n", a, v.Entry, v.Rule, v.Message)
+		}
+		if !r.Passed() {
+			failed++
+		}
+		reports = append(reports, r)
+	}
+
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+	if *out != "" {
+		err = os.WriteFile(*out, data, 0o666)
+	} else {
+		_, err = os.Stdout.Write(data)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if failed > 0 {
+		log.Fatalf("%v of %v archives failed the audit.\n", failed, len(reports))
+	}
+}
+
+// platformFromName detects the GOOS and GOARCH of an archive from a name like
+// "go1.23.1-1234.linux-armv6l.tar.gz". Returns empty strings if the name doesn't include them,
+// e.g. for a source archive.
+func platformFromName(name string) (goos, goarch string) {
+	base, ok := strings.CutSuffix(name, ".tar.gz")
+	if !ok {
+		if base, ok = strings.CutSuffix(name, ".zip"); !ok {
+			return "", ""
+		}
+	}
+	i := strings.LastIndexByte(base, '.')
+	if i < 0 {
+		return "", ""
+	}
+	goos, goarch, ok = strings.Cut(base[i+1:], "-")
+	if !ok {
+		return "", ""
+	}
+	// Undo the upstream branding of GOARCH=arm.
+	if goarch == "armv6l" {
+		goarch = "arm"
+	}
+	return goos, goarch
+}
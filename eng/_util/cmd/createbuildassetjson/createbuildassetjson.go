@@ -5,17 +5,33 @@
 package main
 
 import (
+	"encoding/json"
+	"flag"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/microsoft/go-infra/buildmodel"
+	"github.com/microsoft/go/_util/internal/checksum"
+	"github.com/microsoft/go/_util/internal/sbom"
 )
 
 const description = `
 This command creates a build asset JSON file for a given Go build, where all assets are in a flat
 directory on disk. Downstream repos (in particular Go Docker) can use this summary file to point at
 new builds of Go automatically.
+
+With -sbom-o, it also creates an SBOM asset JSON file that lists the SBOMs in -sbom-dir (files
+named after an archive plus ".spdx.json").
 `
 
+var (
+	sbomDir            = flag.String("sbom-dir", "", "Directory that contains the SBOMs to list in the -sbom-o file. Usually the same as -artifacts-dir.")
+	sbomOutput         = flag.String("sbom-o", "", "Write an SBOM asset JSON file to this path. If not set, SBOMs aren't listed.")
+	sbomDestinationURL = flag.String("sbom-destination-url", "", "URL of the dir the SBOMs are published to, if known. Usually the same as -destination-url.")
+)
+
 func main() {
 	f := buildmodel.BindBuildAssetJSONFlags()
 
@@ -24,6 +40,66 @@ func main() {
 	if err := buildmodel.GenerateBuildAssetJSON(f); err != nil {
 		panic(err)
 	}
+	if *sbomOutput != "" {
+		if err := writeSBOMAssets(*sbomOutput, *sbomDir, *sbomDestinationURL); err != nil {
+			panic(err)
+		}
+	}
 
 	fmt.Println("\nSuccess.")
 }
+
+// sbomAssets is the content of the SBOM asset JSON file.
+type sbomAssets struct {
+	SBOMs []*sbomAsset `json:"sboms"`
+}
+
+// sbomAsset refers to the SBOM of an archive.
+type sbomAsset struct {
+	// Archive is the file name of the archive the SBOM describes.
+	Archive string `json:"archive"`
+	// Name is the file name of the SBOM.
+	Name string `json:"name"`
+	// URL is where the SBOM is published, if the destination URL is known.
+	URL    string `json:"url,omitempty"`
+	SHA256 string `json:"sha256"`
+}
+
+// writeSBOMAssets writes a JSON file to output that lists the SBOMs found in dir. If
+// destinationURL isn't empty, each SBOM's URL is in that dir.
+func writeSBOMAssets(output, dir, destinationURL string) error {
+	if dir == "" {
+		return fmt.Errorf("-sbom-o requires -sbom-dir")
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+sbom.FileSuffix))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		fmt.Println("No SBOMs found in SBOM dir.")
+	}
+
+	assets := &sbomAssets{SBOMs: []*sbomAsset{}}
+	for _, p := range paths {
+		name := filepath.Base(p)
+		sum, err := checksum.FileSHA256(p)
+		if err != nil {
+			return err
+		}
+		a := &sbomAsset{
+			Archive: strings.TrimSuffix(name, sbom.FileSuffix),
+			Name:    name,
+			SHA256:  sum,
+		}
+		if destinationURL != "" {
+			a.URL = strings.TrimSuffix(destinationURL, "/") + "/" + name
+		}
+		fmt.Printf("Adding SBOM %v\n", name)
+		assets.SBOMs = append(assets.SBOMs, a)
+	}
+	data, err := json.MarshalIndent(assets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(output, append(data, '\n'), 0o666)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/microsoft/go/_util/internal/archivediff"
+)
+
+const description = `
+This command compares two Go distribution archives (.tar.gz or .zip) and
+reports the entries that were added, removed, or modified, including mode,
+modification time, and link target changes. For Go binaries whose content
+changed, it also reports the Go build IDs and the differences in the build
+information printed by "go version -m".
+
+Example: Compare two releases of the same patch version:
+
+  eng/run.ps1 diff-archive -ignoremtime go1.23.1-1.linux-amd64.tar.gz go1.23.1-2.linux-amd64.tar.gz
+`
+
+func main() {
+	jsonOut := flag.Bool("json", false, "Print the diff as JSON rather than a human-readable summary.")
+	out := flag.String("o", "", "Write the diff to this file rather than stdout.")
+	ignoreModTime := flag.Bool("ignoremtime", false, "Ignore modification time changes.")
+	exitCode := flag.Bool("exitcode", false, "Exit with code 1 if the archives differ.")
+	help := flag.Bool("h", false, "Print this help message.")
+
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: diff-archive [flags] <old archive> <new archive>\n")
+		flag.PrintDefaults()
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n", description)
+	}
+
+	flag.Parse()
+	if *help {
+		flag.Usage()
+		return
+	}
+	if flag.NArg() != 2 {
+		flag.Usage()
+		log.Fatal("Expected two archives.")
+	}
+
+	d, err := archivediff.Compare(flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *ignoreModTime {
+		d.IgnoreModTime()
+	}
+
+	var b bytes.Buffer
+	if *jsonOut {
+		enc := json.NewEncoder(&b)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(d); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		d.Print(&b)
+	}
+	if *out != "" {
+		err = os.WriteFile(*out, b.Bytes(), 0o666)
+	} else {
+		_, err = os.Stdout.Write(b.Bytes())
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *exitCode && !d.Empty() {
+		os.Exit(1)
+	}
+}
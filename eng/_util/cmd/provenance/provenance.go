@@ -0,0 +1,96 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/microsoft/go/_util/internal/provenance"
+)
+
+const description = `
+This command works with the in-toto SLSA provenance statements (.intoto.json)
+that "build" and "sign" write next to each archive. The statements are
+unsigned: signing them is a separate step.
+
+Subcommands:
+
+  verify [-dir <dir>] [-root <dir>] <statement>...
+
+    Checks that each statement is a SLSA provenance statement and that the
+    SHA256 digest of each subject matches the file with the same name in -dir
+    (by default, the statement's dir). If -root is set, also checks that the
+    digest of each patch file the build used matches the file in the repository
+    at -root.
+
+Example: Verify the statements of signed archives:
+
+  eng/run.ps1 provenance verify eng/signing/signed/*.intoto.json
+`
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: provenance <subcommand> [flags] [args]\n")
+		fmt.Fprintf(flag.CommandLine.Output(), "%s\n", description)
+	}
+	help := flag.Bool("h", false, "Print this help message.")
+	flag.Parse()
+	if *help || flag.NArg() == 0 {
+		flag.Usage()
+		return
+	}
+
+	switch sub, args := flag.Arg(0), flag.Args()[1:]; sub {
+	case "verify":
+		if err := verify(args); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		flag.Usage()
+		log.Fatalf("Unknown subcommand %q.", sub)
+	}
+}
+
+func verify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory containing the subjects of the statements. Defaults to the dir of each statement.")
+	root := fs.String("root", "", "If set, also verify the patch files the build used against the repository at this path.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return fmt.Errorf("no statements specified")
+	}
+
+	var failed int
+	for _, path := range fs.Args() {
+		s, err := provenance.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		subjectDir := *dir
+		if subjectDir == "" {
+			subjectDir = filepath.Dir(path)
+		}
+		err = provenance.Verify(s, subjectDir)
+		if err == nil && *root != "" {
+			err = provenance.VerifyDependencies(s, *root)
+		}
+		if err != nil {
+			failed++
+			fmt.Fprintf(os.Stderr, "FAIL %v:\n%v\n", path, err)
+			continue
+		}
+		fmt.Printf("OK %v\n", path)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%v of %v statements failed verification", failed, fs.NArg())
+	}
+	return nil
+}
@@ -15,6 +15,7 @@ import (
 
 	"github.com/microsoft/go-infra/json2junit"
 	"github.com/microsoft/go/_util/buildutil"
+	"github.com/microsoft/go/_util/gobuild"
 )
 
 const description = `
@@ -44,6 +45,13 @@ func main() {
 	var build = flag.Bool("build", false, "Run the build.")
 	var test = flag.Bool("test", false, "Run the tests.")
 
+	var testSelection gobuild.TestSelection
+	flag.StringVar(&testSelection.Run, "run", "", "Run only the dist tests matching this regular expression. Only supported by the devscript config.")
+	flag.StringVar(&testSelection.ExcludeFile, "testexclude", "", "Skip the dist tests listed in this file. Only supported by the devscript config.")
+	flag.IntVar(&testSelection.Shard, "shard", 0, "Run only the dist tests in this zero-based shard. Only supported by the devscript config.")
+	flag.IntVar(&testSelection.ShardCount, "shards", 0, "Split the dist tests into this many shards. Only supported by the devscript config.")
+	var testRetries = flag.Int("testretries", 0, "Rerun failed dist test units up to this many times. Units that pass on a retry are recorded as flaky in the JUnit file.")
+
 	var help = flag.Bool("h", false, "Print this help message.")
 
 	flag.Usage = func() {
@@ -109,16 +117,21 @@ func main() {
 		log.Fatal(err)
 	}
 
-	buildCmdline := []string{"pwsh", "eng/run.ps1", "build"}
-
-	// run.ps1 compiles Go code, so we can't use the experiment yet. We must pass the experiment
-	// setting to the build command as an arg, so it can set it for the actual Go toolset build.
+	// Build Go in-process using the same implementation as the "build" command. Set GOEXPERIMENT
+	// in our own environment rather than passing it to the build: the tests run later need it,
+	// too, and this way it's only appended once.
 	if *experiment != "" {
-		buildCmdline = append(buildCmdline, "-experiment", *experiment)
+		buildutil.AppendExperimentEnv(*experiment)
 	}
 
 	if *build {
-		runOrPanic(buildCmdline...)
+		if err := runBuild(&gobuild.Options{
+			// CI agents start from a clean state, so a cache would never be hit.
+			NoCache:         true,
+			MaxMakeAttempts: buildutil.MaxMakeRetryAttemptsOrExit(),
+		}); err != nil {
+			panic(err)
+		}
 	} else {
 		fmt.Println("Skipping build: '-build' not passed.")
 	}
@@ -133,20 +146,20 @@ func main() {
 		// "devscript" is specific to the Microsoft infrastructure. It means the builder should
 		// validate the run.ps1 script with "build" tool works to build and test Go. It runs a
 		// subset of the "test" builder's tests, but it uses the dev workflow.
-		testCmdline := append(buildCmdline, "-skipbuild", "-test")
-		if *junitOutFile != "" {
-			testCmdline = append(testCmdline, "-junitout", *junitOutFile)
-		}
-		if err := run(testCmdline...); err != nil {
+		if err := runBuild(&gobuild.Options{
+			SkipBuild:     true,
+			Test:          true,
+			JUnitOutFile:  *junitOutFile,
+			TestSelection: testSelection,
+			TestRetries:   *testRetries,
+		}); err != nil {
 			log.Fatal(err)
 		}
 
 	default:
 		// Most builder configurations use "bin/go tool dist test" directly, which is the default.
-
-		// Set GOEXPERIMENT in the environment now that we're using the just-built version of Go.
-		if *experiment != "" {
-			buildutil.AppendExperimentEnv(*experiment)
+		if testSelection != (gobuild.TestSelection{}) {
+			log.Fatalf("Test selection flags are only supported by the devscript config, not %q.\n", config)
 		}
 
 		if *fipsMode {
@@ -201,6 +214,16 @@ func main() {
 
 		if *dryRun {
 			fmt.Printf("---- Dry run. Would have run test command: %v\n", cmdline)
+		} else if *testRetries > 0 {
+			run := gobuild.DistTestRun{
+				CommandLine:  cmdline,
+				GoBin:        "go/bin/go",
+				JUnitOutFile: *junitOutFile,
+				Retries:      *testRetries,
+			}
+			if err := run.Run(); err != nil {
+				log.Fatal(err)
+			}
 		} else {
 			f, err := os.Create(*junitOutFile)
 			if err != nil {
@@ -246,23 +269,12 @@ func envAppend(key, value string) {
 	env(key, value)
 }
 
-func run(cmdline ...string) error {
-	c := exec.Command(cmdline[0], cmdline[1:]...)
-	c.Stdout = os.Stdout
-	c.Stderr = os.Stderr
-
+// runBuild runs the Go build with the given options, or prints them if this is a dry run.
+func runBuild(o *gobuild.Options) error {
 	if *dryRun {
-		fmt.Printf("---- Dry run. Would have run command: %v\n", c.Args)
+		fmt.Printf("---- Dry run. Would have built with options: %+v\n", *o)
 		return nil
 	}
-
-	fmt.Printf("---- Running command: %v\n", c.Args)
-	return c.Run()
-}
-
-// runOrPanic runs a command, sending stdout/stderr to our streams, and panics if it doesn't succeed.
-func runOrPanic(cmdline ...string) {
-	if err := run(cmdline...); err != nil {
-		panic(err)
-	}
+	_, err := gobuild.Build(o)
+	return err
 }
@@ -7,6 +7,7 @@ package main
 import (
 	"archive/tar"
 	"archive/zip"
+	"bytes"
 	"cmp"
 	"context"
 	"fmt"
@@ -14,7 +15,9 @@ import (
 	"log"
 	"os"
 	"path/filepath"
-	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+	"github.com/microsoft/go/_util/internal/checksum"
 )
 
 type archiveType int
@@ -24,8 +27,20 @@ const (
 	zipArchive archiveType = iota
 	// tarGzArchive is a macOS or Linux tar.gz archive.
 	tarGzArchive
+	// debArchive is a Debian package of a Linux archive.
+	debArchive
+	// rpmArchive is an RPM package of a Linux archive.
+	rpmArchive
+	// msiArchive is a Windows Installer package of a Windows archive.
+	msiArchive
 )
 
+// isPackage returns true if a is a Debian, RPM, or Windows Installer package. A package is signed
+// as a whole, rather than by signing entries inside it.
+func (a *archive) isPackage() bool {
+	return a.archiveType == debArchive || a.archiveType == rpmArchive || a.archiveType == msiArchive
+}
+
 type archive struct {
 	path string
 	name string
@@ -42,18 +57,38 @@ type archive struct {
 	// notarizedPath is a repacked archive that has also had the notarization ticket attached.
 	// Assigned upon completion.
 	notarizedPath string
+
+	// plan is the signing policy applied to the entries of a zip archive. See planEntries.
+	plan *entryPlan
+
+	// state is the progress of this archive, saved to the state file after each step.
+	state archiveState
+
+	// logger writes to logBuf rather than directly to the log, so the output for each archive
+	// stays together even when archives are processed concurrently. See flushLog.
+	logger *log.Logger
+	logBuf bytes.Buffer
 }
 
-func newArchive(p string) (*archive, error) {
+// identifyArchive returns an archive describing the file at p, based on its name. It doesn't
+// read the file or prepare to sign it: see newArchive.
+func identifyArchive(p string) (*archive, error) {
 	name := filepath.Base(p)
 	a := archive{
 		path: p,
 		name: name,
 	}
+	a.logger = log.New(&a.logBuf, log.Prefix(), log.Flags())
 	if matchOrPanic("go*.zip", name) {
 		a.archiveType = zipArchive
 	} else if matchOrPanic("go*.tar.gz", name) {
 		a.archiveType = tarGzArchive
+	} else if matchOrPanic("go*.deb", name) {
+		a.archiveType = debArchive
+	} else if matchOrPanic("go*.rpm", name) {
+		a.archiveType = rpmArchive
+	} else if matchOrPanic("go*.msi", name) {
+		a.archiveType = msiArchive
 	} else {
 		return nil, fmt.Errorf("unknown archive type: %s", p)
 	}
@@ -61,11 +96,30 @@ func newArchive(p string) (*archive, error) {
 	if matchOrPanic("go*darwin*.tar.gz", name) {
 		a.archiveMacOS = true
 	}
+	return &a, nil
+}
+
+// newArchive creates an archive to sign from the file at p. If saved contains the progress of an
+// earlier run on the same file, the archive resumes from it.
+func newArchive(p string, saved *signState) (*archive, error) {
+	a, err := identifyArchive(p)
+	if err != nil {
+		return nil, err
+	}
+
+	sum, err := checksum.FileSHA256(p)
+	if err != nil {
+		return nil, err
+	}
+	a.state = archiveState{Path: p, SHA256: sum}
+	if as := saved.find(p, sum); as != nil && a.resume(as) {
+		return a, nil
+	}
 
 	if err := os.MkdirAll(*tempDir, 0o777); err != nil {
 		return nil, err
 	}
-	workDir, err := os.MkdirTemp(*tempDir, "sign-work-"+name)
+	workDir, err := os.MkdirTemp(*tempDir, "sign-work-"+a.name)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create work directory: %v", err)
 	}
@@ -75,7 +129,18 @@ func newArchive(p string) (*archive, error) {
 	}
 	a.workDir = workDir
 
-	return &a, nil
+	return a, nil
+}
+
+// logf logs a message about this archive. The message is buffered until flushLog.
+func (a *archive) logf(format string, v ...any) {
+	a.logger.Printf(format, v...)
+}
+
+// flushLog writes the buffered log output for this archive to the log.
+func (a *archive) flushLog() {
+	log.Writer().Write(a.logBuf.Bytes())
+	a.logBuf.Reset()
 }
 
 // latestPath returns the path of the file that has the most signing steps applied to it. This
@@ -94,6 +159,12 @@ func (a *archive) sigPath() string {
 	return filepath.Join(a.workDir, a.name+".sig")
 }
 
+// packageSignPath returns the path of the copy of a package that is signed. The copy keeps the
+// package's file name because signing tools choose how to sign a file by its extension.
+func (a *archive) packageSignPath() string {
+	return filepath.Join(a.workDir, "signed", a.name)
+}
+
 func (a *archive) macHardenPackPath() string {
 	return filepath.Join(a.workDir, a.name+".ToHardenBundle.zip")
 }
@@ -107,24 +178,20 @@ func (a *archive) macBundleNotarizePackPath() string {
 }
 
 // entrySignInfo returns signing details for a given file in the Go archive, or nil if the given
-// file entry doesn't need to be signed.
+// file entry doesn't need to be signed. The signing policy selects the entries to sign. For a zip
+// archive, planEntries must be called first.
 func (a *archive) entrySignInfo(name string) *fileToSign {
 	if a.archiveType == zipArchive {
-		if strings.HasSuffix(name, ".exe") {
-			return &fileToSign{
-				originalPath: a.path,
-				fullPath:     filepath.Join(a.workDir, "extract", name),
-				authenticode: "Microsoft400",
-			}
-		}
+		return a.plan.files[name]
 	} else if a.archiveMacOS {
-		if matchOrPanic("go/bin/*", name) ||
-			matchOrPanic("go/pkg/tool/*/*", name) {
-
-			return &fileToSign{
-				originalPath: a.path,
-				zip:          true,
-			}
+		// The policy for macOS archives doesn't depend on the content.
+		rule, _ := a.matchEntry(name, nil)
+		if rule == nil || rule.Certificate == "" {
+			return nil
+		}
+		return &fileToSign{
+			originalPath: a.path,
+			zip:          true,
 		}
 	}
 	return nil
@@ -140,36 +207,16 @@ func (a *archive) prepareEntriesToSign(ctx context.Context) ([]*fileToSign, erro
 	var results []*fileToSign
 
 	if a.archiveType == zipArchive {
-		log.Printf("Extracting files to sign from %q", a.path)
-		zr, err := zip.OpenReader(a.path)
+		a.logf("Extracting files to sign from %q", a.path)
+		plan, err := a.planEntries(ctx, true)
 		if err != nil {
 			return fail(err)
 		}
-		defer zr.Close()
-
-		if err := eachZipEntry(zr, func(f *zip.File) error {
-			if err := ctx.Err(); err != nil {
-				return err
-			}
-			if f.FileInfo().IsDir() {
-				return nil
-			}
-			if info := a.entrySignInfo(f.Name); info != nil {
-				if err := withFileCreate(info.fullPath, func(fWriter *os.File) error {
-					fReader, err := f.Open()
-					if err != nil {
-						return err
-					}
-					_, err = io.Copy(fWriter, fReader)
-					return cmp.Or(err, fReader.Close())
-				}); err != nil {
-					return err
-				}
+		// Sign the files in archive order.
+		for _, m := range plan.matches {
+			if info := plan.files[m.name]; info != nil {
 				results = append(results, info)
 			}
-			return nil
-		}); err != nil {
-			return fail(err)
 		}
 	} else if a.archiveMacOS {
 		// Store macOS files to sign in a zip. Zipping is needed for this platform specifically,
@@ -179,15 +226,27 @@ func (a *archive) prepareEntriesToSign(ctx context.Context) ([]*fileToSign, erro
 		fts := &fileToSign{
 			originalPath: a.path,
 			fullPath:     a.macHardenPackPath(),
-			authenticode: "MacDeveloperHarden",
+			authenticode: a.policy().macOSCertificate(),
 		}
-		log.Printf("Creating macOS file hardening bundle at %q", fts.fullPath)
-		if err := withZipCreate(fts.fullPath, func(zw *zip.Writer) error {
+		a.logf("Creating macOS file hardening bundle at %q", fts.fullPath)
+		if err := archiveutil.WithZipCreate(fts.fullPath, func(zw *zip.Writer) error {
 			return a.extractMacOSEntriesToZip(ctx, zw)
 		}); err != nil {
 			return fail(err)
 		}
 		results = append(results, fts)
+	} else if a.isPackage() {
+		// Sign a copy of the package: the signature is embedded in place.
+		fts := &fileToSign{
+			originalPath: a.path,
+			fullPath:     a.packageSignPath(),
+			authenticode: a.policy().PackageCertificate,
+		}
+		a.logf("Copying package to sign to %q", fts.fullPath)
+		if err := archiveutil.CopyFile(fts.fullPath, a.path); err != nil {
+			return fail(err)
+		}
+		results = append(results, fts)
 	}
 
 	return results, nil
@@ -204,16 +263,17 @@ func (a *archive) prepareIndividualNotarize(ctx context.Context) ([]*fileToSign,
 
 	// Simply send the hardened zip back to the signing service for notarization.
 	// Copy it first so that we can still access the hardened, pre-notarized files for diagnosis.
-	if err := copyFile(a.macIndividualNotarizePackPath(), a.macHardenPackPath()); err != nil {
+	if err := archiveutil.CopyFile(a.macIndividualNotarizePackPath(), a.macHardenPackPath()); err != nil {
 		return nil, err
 	}
 
+	n := a.policy().Notarize
 	return []*fileToSign{
 		{
 			originalPath: a.path,
 			fullPath:     a.macIndividualNotarizePackPath(),
-			authenticode: "8020", // Can't specify MacNotarize or MacAppName is not detected.
-			macAppName:   "MicrosoftGo",
+			authenticode: n.Certificate,
+			macAppName:   n.MacAppName,
 		},
 	}, nil
 }
@@ -221,8 +281,8 @@ func (a *archive) prepareIndividualNotarize(ctx context.Context) ([]*fileToSign,
 func (a *archive) extractMacOSEntriesToZip(ctx context.Context, zw *zip.Writer) error {
 	// Open tar.gz macOS archive to put files into the zip.
 	writtenNames := make(map[string]struct{})
-	return withTarGzOpen(a.path, func(tr *tar.Reader) error {
-		return eachTarEntry(tr, func(header *tar.Header, r io.Reader) error {
+	return archiveutil.WithTarGzOpen(a.path, func(tr *tar.Reader) error {
+		return archiveutil.EachTarEntry(tr, func(header *tar.Header, r io.Reader) error {
 			if err := ctx.Err(); err != nil {
 				return err
 			}
@@ -257,14 +317,17 @@ func (a *archive) extractMacOSEntriesToZip(ctx context.Context, zw *zip.Writer)
 func (a *archive) repackSignedEntries(ctx context.Context) error {
 	targetPath := filepath.Join(a.workDir, a.name+".WithSignedContent")
 	if a.archiveType == zipArchive {
-		log.Printf("Repacking signed content to %q", targetPath)
-		if err := withZipOpen(a.path, func(zr *zip.ReadCloser) error {
-			return withZipCreate(targetPath, func(zw *zip.Writer) error {
-				return eachZipEntry(zr, func(f *zip.File) error {
+		if _, err := a.planEntries(ctx, false); err != nil {
+			return err
+		}
+		a.logf("Repacking signed content to %q", targetPath)
+		if err := archiveutil.WithZipOpen(a.path, func(zr *zip.ReadCloser) error {
+			return archiveutil.WithZipCreate(targetPath, func(zw *zip.Writer) error {
+				return archiveutil.EachZipEntry(zr, func(f *zip.File) error {
 					if err := ctx.Err(); err != nil {
 						return err
 					}
-					return a.writeZipRepackEntry(f, zw)
+					return a.writeZipRepackEntry(ctx, f, zw, "")
 				})
 			})
 		}); err != nil {
@@ -272,15 +335,15 @@ func (a *archive) repackSignedEntries(ctx context.Context) error {
 		}
 		a.repackedPath = targetPath
 	} else if a.archiveMacOS {
-		log.Printf("Repacking hardened content to %q", targetPath)
+		a.logf("Repacking hardened content to %q", targetPath)
 		// Open the original tar.gz for header info and to read unchanged files from.
-		if err := withTarGzOpen(a.path, func(originalTR *tar.Reader) error {
+		if err := archiveutil.WithTarGzOpen(a.path, func(originalTR *tar.Reader) error {
 			// Create the new tar.gz that we're assembling.
-			return withTarGzCreate(targetPath, func(outTW *tar.Writer) error {
+			return archiveutil.WithTarGzCreate(targetPath, func(outTW *tar.Writer) error {
 				// Open the zip payload we got back from the signing service.
-				return withZipOpen(a.macIndividualNotarizePackPath(), func(zrc *zip.ReadCloser) error {
+				return archiveutil.WithZipOpen(a.macIndividualNotarizePackPath(), func(zrc *zip.ReadCloser) error {
 					// Iterate through the original tar.gz file to populate the target.
-					return eachTarEntry(originalTR, func(hdr *tar.Header, originalR io.Reader) error {
+					return archiveutil.EachTarEntry(originalTR, func(hdr *tar.Header, originalR io.Reader) error {
 						if err := ctx.Err(); err != nil {
 							return err
 						}
@@ -292,14 +355,19 @@ func (a *archive) repackSignedEntries(ctx context.Context) error {
 			return err
 		}
 		a.repackedPath = targetPath
+	} else if a.isPackage() {
+		// The signed package doesn't need to be repacked.
+		a.repackedPath = a.packageSignPath()
 	}
 	return nil
 }
 
 // writeZipRepackEntry looks at one entry in the original zip and creates a corresponding entry in
-// the output zip. Reads signed entry content from the signed file on disk. If the file hasn't been
-// signed, the content is read from the original zip.
-func (a *archive) writeZipRepackEntry(original *zip.File, out *zip.Writer) error {
+// the output zip. Reads signed entry content from the signed file on disk, and repacks a nested
+// archive that contains signed entries. Otherwise, the content is read from the original zip.
+// prefix is the name of the nested archive the zip is in, followed by "/", or "" for the archive
+// itself.
+func (a *archive) writeZipRepackEntry(ctx context.Context, original *zip.File, out *zip.Writer, prefix string) error {
 	w, err := out.CreateHeader(&zip.FileHeader{
 		// Copy necessary original file metadata.
 		Name:     original.Name,
@@ -307,6 +375,20 @@ func (a *archive) writeZipRepackEntry(original *zip.File, out *zip.Writer) error
 		Comment:  original.Comment,
 		Modified: original.Modified,
 		Extra:    original.Extra,
+		// The mode is stored in the external attributes, interpreted based on the creator.
+		CreatorVersion: original.CreatorVersion,
+		ExternalAttrs:  original.ExternalAttrs,
+	})
+	if err != nil {
+		return err
+	}
+	path, content, err := a.signedContent(ctx, prefix+original.Name, func() ([]byte, error) {
+		r, err := original.Open()
+		if err != nil {
+			return nil, err
+		}
+		b, err := io.ReadAll(r)
+		return b, cmp.Or(err, r.Close())
 	})
 	if err != nil {
 		return err
@@ -314,17 +396,15 @@ func (a *archive) writeZipRepackEntry(original *zip.File, out *zip.Writer) error
 	var r io.ReadCloser
 	// If we have a signed version of this file, read from that.
 	// Otherwise, read from the original.
-	if info := a.entrySignInfo(original.Name); info != nil {
-		log.Printf("Replacing with signed version: %q", original.Name)
-		r, err = os.Open(info.fullPath)
-		if err != nil {
-			return err
-		}
+	if path != "" {
+		r, err = os.Open(path)
+	} else if content != nil {
+		r = io.NopCloser(bytes.NewReader(content))
 	} else {
 		r, err = original.Open()
-		if err != nil {
-			return err
-		}
+	}
+	if err != nil {
+		return err
 	}
 	_, err = io.Copy(w, r)
 	return cmp.Or(err, r.Close())
@@ -355,7 +435,7 @@ func (a *archive) writeTarRepackEntry(hdr *tar.Header, original io.Reader, signe
 	}
 	isFile := hdr.Typeflag == tar.TypeReg
 	if info := a.entrySignInfo(hdr.Name); info != nil && isFile {
-		log.Printf("Replacing with signed version: %q", hdr.Name)
+		a.logf("Replacing with signed version: %q", hdr.Name)
 		replacementFile, err := signedPack.Open(filepath.Base(hdr.Name))
 		if err != nil {
 			return err
@@ -432,15 +512,16 @@ func (a *archive) prepareArchiveSignatures(ctx context.Context) ([]*fileToSign,
 	// process sends the "tar.gz.sig" file to get a signature, then replaces the "tar.gz.sig"
 	// file's content in-place with the result. We need to preemptively make a renamed copy of the
 	// file so we end up with both the original file and sig on the machine.
-	log.Printf("Copying file for signature generation: %q -> %q", a.latestPath(), a.sigPath())
-	if err := copyFile(a.sigPath(), a.latestPath()); err != nil {
+	a.logf("Copying file for signature generation: %q -> %q", a.latestPath(), a.sigPath())
+	if err := archiveutil.CopyFile(a.sigPath(), a.latestPath()); err != nil {
 		return nil, err
 	}
 	return []*fileToSign{
 		{
 			originalPath: a.path,
 			fullPath:     a.sigPath(),
-			authenticode: "LinuxSignManagedLanguageCompiler",
+			authenticode: policy.SignatureCertificate,
+			detached:     true,
 		},
 	}, nil
 }
@@ -454,12 +535,21 @@ func (a *archive) copyToDestination(ctx context.Context) error {
 		return fmt.Errorf("failed to create destination directory: %v", err)
 	}
 
-	log.Printf("Copying finished files to destination: %q", a.latestPath())
-	if err := copyFile(filepath.Join(*destinationDir, a.name), a.latestPath()); err != nil {
+	a.logf("Copying finished files to destination: %q", a.latestPath())
+	if err := archiveutil.CopyFile(filepath.Join(*destinationDir, a.name), a.latestPath()); err != nil {
 		return err
 	}
-	if err := copyFile(filepath.Join(*destinationDir, a.name+".sig"), a.sigPath()); err != nil {
+	if err := archiveutil.CopyFile(filepath.Join(*destinationDir, a.name+".sig"), a.sigPath()); err != nil {
 		return err
 	}
 	return nil
 }
+
+// matchOrPanic returns whether name matches the pattern glob, or panics if pattern is invalid.
+func matchOrPanic(pattern, name string) bool {
+	ok, err := filepath.Match(pattern, name)
+	if err != nil {
+		panic(err)
+	}
+	return ok
+}
@@ -0,0 +1,82 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+	"github.com/microsoft/go/_util/internal/linuxpkg"
+)
+
+// linuxPackageWriters are the package formats created from each Linux archive by
+// createLinuxPackages, by file extension.
+var linuxPackageWriters = []struct {
+	ext   string
+	write func(w io.Writer, archivePath string, m *linuxpkg.Metadata) error
+}{
+	{".deb", linuxpkg.WriteDeb},
+	{".rpm", linuxpkg.WriteRPM},
+}
+
+// createLinuxPackages creates a Debian and an RPM package from each Linux tar.gz archive in the
+// temp dir, and returns them as archives to sign. Creating a package from the same archive always
+// produces the same file, so a resumed run can find the progress of the packages in saved.
+func createLinuxPackages(ctx context.Context, archives []*archive, saved *signState) ([]*archive, error) {
+	var linuxArchives []*archive
+	for _, a := range archives {
+		if matchOrPanic("go*.linux-*.tar.gz", a.name) {
+			linuxArchives = append(linuxArchives, a)
+		}
+	}
+	if len(linuxArchives) == 0 {
+		return nil, errors.New("no Linux archives found to create packages from")
+	}
+
+	dir := filepath.Join(*tempDir, "linux-packages")
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	packagePaths, err := flatMapArchives(ctx, linuxArchives, func(a *archive, ctx context.Context) ([]string, error) {
+		m, err := linuxpkg.MetadataFromArchive(a.path, *linuxPackageRelease)
+		if err != nil {
+			return nil, err
+		}
+		var paths []string
+		for _, pw := range linuxPackageWriters {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			p := filepath.Join(dir, strings.TrimSuffix(a.name, ".tar.gz")+pw.ext)
+			a.logf("Creating package %q", p)
+			if err := archiveutil.WithFileCreate(p, func(f *os.File) error {
+				return pw.write(f, a.path, m)
+			}); err != nil {
+				return nil, fmt.Errorf("failed to create %q: %v", p, err)
+			}
+			paths = append(paths, p)
+		}
+		return paths, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var packages []*archive
+	for _, p := range packagePaths {
+		a, err := newArchive(p, saved)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process %q: %v", p, err)
+		}
+		packages = append(packages, a)
+	}
+	return packages, nil
+}
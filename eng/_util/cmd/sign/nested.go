@@ -0,0 +1,336 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+// entryPlan is the result of applying the signing policy to each entry of a zip archive,
+// including the entries of nested archives. The name of an entry in a nested archive is the name
+// of the nested archive, "/", then the name of the entry in the nested archive.
+type entryPlan struct {
+	// files maps the name of each entry to sign to its signing details.
+	files map[string]*fileToSign
+	// nested maps the name of each nested archive that contains entries to sign to its format.
+	nested map[string]string
+	// matches is the rule that matched each regular file entry, in archive order.
+	matches []entryMatch
+}
+
+type entryMatch struct {
+	name string
+	rule *entryRule
+}
+
+// planEntries applies the signing policy to the entries of the zip archive a and saves the result
+// for entrySignInfo. If extract is true, the entries to sign are extracted to their fullPath.
+func (a *archive) planEntries(ctx context.Context, extract bool) (*entryPlan, error) {
+	if a.plan != nil && !extract {
+		return a.plan, nil
+	}
+	p := &entryPlan{
+		files:  make(map[string]*fileToSign),
+		nested: make(map[string]string),
+	}
+	if err := archiveutil.WithZipOpen(a.path, func(zr *zip.ReadCloser) error {
+		return archiveutil.EachZipEntry(zr, func(f *zip.File) error {
+			if f.FileInfo().IsDir() {
+				return nil
+			}
+			return a.planEntry(ctx, p, f.Name, f.Open, extract)
+		})
+	}); err != nil {
+		return nil, fmt.Errorf("failed to plan the entries of %q: %v", a.path, err)
+	}
+	a.plan = p
+	return p, nil
+}
+
+// planEntry adds the entry name to the plan p. open returns the entry's content. It's only
+// called if a rule needs it. The PE check only reads the start of the entry: the whole content
+// is only read to extract the entry or to look inside a nested archive.
+func (a *archive) planEntry(ctx context.Context, p *entryPlan, name string, open func() (io.ReadCloser, error), extract bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	var r io.ReadCloser
+	var head []byte
+	defer func() {
+		if r != nil {
+			r.Close()
+		}
+	}()
+	header := func() ([]byte, error) {
+		if r == nil {
+			var err error
+			if r, err = open(); err != nil {
+				return nil, err
+			}
+			if head, err = readPEHeader(r); err != nil {
+				return nil, err
+			}
+		}
+		return head, nil
+	}
+	content := func() ([]byte, error) {
+		if _, err := header(); err != nil {
+			return nil, err
+		}
+		rest, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return append(head, rest...), nil
+	}
+
+	rule, err := a.matchEntry(name, header)
+	if err != nil {
+		return err
+	}
+	p.matches = append(p.matches, entryMatch{name, rule})
+	switch {
+	case rule == nil || (!rule.Nested && rule.Certificate == ""):
+		return nil
+
+	case rule.Nested:
+		format := nestedFormat(name)
+		if format == "" {
+			return fmt.Errorf("rule %q matches %q, which isn't a zip, tar, or tar.gz archive", rule.Name, name)
+		}
+		b, err := content()
+		if err != nil {
+			return err
+		}
+		signed := len(p.files)
+		if err := eachNestedEntry(b, format, func(hdr *tar.Header, f *zip.File, r io.Reader) error {
+			if f != nil {
+				if f.FileInfo().IsDir() {
+					return nil
+				}
+				return a.planEntry(ctx, p, name+"/"+f.Name, f.Open, extract)
+			}
+			if !hdr.FileInfo().Mode().IsRegular() {
+				return nil
+			}
+			return a.planEntry(ctx, p, name+"/"+hdr.Name, func() (io.ReadCloser, error) {
+				return io.NopCloser(r), nil
+			}, extract)
+		}); err != nil {
+			return fmt.Errorf("failed to read nested archive %q: %v", name, err)
+		}
+		if len(p.files) > signed {
+			p.nested[name] = format
+		}
+		return nil
+	}
+
+	info := &fileToSign{
+		originalPath: a.path,
+		fullPath:     filepath.Join(a.workDir, "extract", filepath.FromSlash(name)),
+		authenticode: rule.Certificate,
+	}
+	p.files[name] = info
+	if extract {
+		b, err := content()
+		if err != nil {
+			return err
+		}
+		if err := archiveutil.CopyToFile(info.fullPath, bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// maxPEHeaderOffset is the largest offset of the PE signature readPEHeader reads up to. The
+// signature of a real PE file is within the first few hundred bytes.
+const maxPEHeaderOffset = 4096
+
+// readPEHeader reads the start of r: enough for isPE to check for the headers of a PE file. That's
+// the 64-byte DOS header and, if it's present, up to the end of the 4-byte PE signature at the
+// offset it points to. Reads less if r is shorter.
+func readPEHeader(r io.Reader) ([]byte, error) {
+	head := make([]byte, 0x40)
+	n, err := io.ReadFull(r, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return head[:n], nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if string(head[:2]) != "MZ" {
+		return head, nil
+	}
+	off := int64(binary.LittleEndian.Uint32(head[0x3c:]))
+	if off+4 <= int64(len(head)) || off > maxPEHeaderOffset {
+		return head, nil
+	}
+	rest, err := io.ReadAll(io.LimitReader(r, off+4-int64(len(head))))
+	if err != nil {
+		return nil, err
+	}
+	return append(head, rest...), nil
+}
+
+// isPE returns true if data starts with the headers of a PE file.
+func isPE(data []byte) bool {
+	if len(data) < 0x40 || string(data[:2]) != "MZ" {
+		return false
+	}
+	off := int64(binary.LittleEndian.Uint32(data[0x3c:]))
+	return off+4 <= int64(len(data)) && string(data[off:off+4]) == "PE\x00\x00"
+}
+
+// nestedFormat returns the format of the nested archive with the given name: "zip", "tar", or
+// "tar.gz". Returns "" if the name doesn't have an archive extension.
+func nestedFormat(name string) string {
+	switch {
+	case strings.HasSuffix(name, ".zip"):
+		return "zip"
+	case strings.HasSuffix(name, ".tar"):
+		return "tar"
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return "tar.gz"
+	}
+	return ""
+}
+
+// eachNestedEntry calls f for each entry of the archive data in the given format. For a zip
+// archive, f is called with the zip entry and a nil reader. For a tar archive, f is called with
+// the tar header and a reader for the content. Returns an error without calling f if an entry has
+// a non-local path.
+func eachNestedEntry(data []byte, format string, f func(hdr *tar.Header, zf *zip.File, r io.Reader) error) error {
+	if format == "zip" {
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return err
+		}
+		for _, zf := range zr.File {
+			if !filepath.IsLocal(zf.Name) {
+				return fmt.Errorf("zip contains non-local path: %s", zf.Name)
+			}
+			if err := f(nil, zf, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	var r io.Reader = bytes.NewReader(data)
+	if format == "tar.gz" {
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+		r = gzr
+	}
+	return archiveutil.EachTarEntry(tar.NewReader(r), func(hdr *tar.Header, r io.Reader) error {
+		return f(hdr, nil, r)
+	})
+}
+
+// signedContent returns the path of the signed file to use as the content of the entry name, or
+// the repacked content of the nested archive name. Returns "", nil if the entry is unchanged.
+// original returns the original content of the entry.
+func (a *archive) signedContent(ctx context.Context, name string, original func() ([]byte, error)) (string, []byte, error) {
+	if info := a.plan.files[name]; info != nil {
+		a.logf("Replacing with signed version: %q", name)
+		return info.fullPath, nil, nil
+	}
+	format, ok := a.plan.nested[name]
+	if !ok {
+		return "", nil, nil
+	}
+	data, err := original()
+	if err != nil {
+		return "", nil, err
+	}
+	a.logf("Repacking nested archive: %q", name)
+	repacked, err := a.repackNested(ctx, name, data, format)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to repack nested archive %q: %v", name, err)
+	}
+	return "", repacked, nil
+}
+
+// repackNested returns a copy of the nested archive name with the given original data and format,
+// with its signed entries replaced. Nested archives inside it are repacked first.
+func (a *archive) repackNested(ctx context.Context, name string, data []byte, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	if format == "zip" {
+		zw := zip.NewWriter(&buf)
+		if err := eachNestedEntry(data, format, func(_ *tar.Header, f *zip.File, _ io.Reader) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return a.writeZipRepackEntry(ctx, f, zw, name+"/")
+		}); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	var w io.Writer = &buf
+	var gzw *gzip.Writer
+	if format == "tar.gz" {
+		gzw = gzip.NewWriter(&buf)
+		w = gzw
+	}
+	tw := tar.NewWriter(w)
+	if err := eachNestedEntry(data, format, func(hdr *tar.Header, _ *zip.File, r io.Reader) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		path, content, err := a.signedContent(ctx, name+"/"+hdr.Name, func() ([]byte, error) {
+			return io.ReadAll(r)
+		})
+		if err != nil {
+			return err
+		}
+		if path != "" {
+			if content, err = os.ReadFile(path); err != nil {
+				return err
+			}
+		}
+		if content != nil {
+			// Replace the content, keeping the rest of the header.
+			h := *hdr
+			h.Size = int64(len(content))
+			hdr, r = &h, bytes.NewReader(content)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("failed to write header for %q: %v", hdr.Name, err)
+		}
+		_, err = io.Copy(tw, r)
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if gzw != nil {
+		if err := gzw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
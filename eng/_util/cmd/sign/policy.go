@@ -0,0 +1,384 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+// defaultPolicyName is the name of the default signing policy file, in this package's dir.
+const defaultPolicyName = "sign-policy.json"
+
+// defaultPolicyJSON is the signing policy used unless -policy is set.
+//
+//go:embed sign-policy.json
+var defaultPolicyJSON []byte
+
+// policy is the signing policy in effect. main replaces it if -policy is set.
+var policy = mustParsePolicy(defaultPolicyJSON)
+
+// signPolicy declares what gets signed in each type of archive, and with which certificate.
+type signPolicy struct {
+	// ArchiveTypes maps each archive type name (see archiveTypeNames) to its policy. Every
+	// archive type must be listed.
+	ArchiveTypes map[string]*archivePolicy `json:"archiveTypes"`
+	// SignatureCertificate is the certificate used to create the detached signature (".sig")
+	// of every archive.
+	SignatureCertificate string `json:"signatureCertificate"`
+}
+
+// archivePolicy is the signing policy for one type of archive.
+type archivePolicy struct {
+	// Entries are the rules that select the entries of the archive to sign. The first rule that
+	// matches an entry applies to it. Only zip and darwin-tar.gz archives can have entry rules.
+	Entries []*entryRule `json:"entries,omitempty"`
+	// PackageCertificate is the certificate used to sign a package as a whole, embedding the
+	// signature. It's required for deb, rpm, and msi archives, and not allowed for others.
+	PackageCertificate string `json:"packageCertificate,omitempty"`
+	// Notarize configures macOS notarization. It's required for darwin-tar.gz archives, and not
+	// allowed for others.
+	Notarize *notarizePolicy `json:"notarize,omitempty"`
+}
+
+// entryRule selects entries of an archive to sign.
+type entryRule struct {
+	// Name identifies the rule in the -explain output.
+	Name string `json:"name"`
+	// Match are the globs of the entry names the rule applies to. See matchGlob.
+	Match []string `json:"match"`
+	// Certificate is the certificate to sign the entries with. If empty, the entries aren't
+	// signed: a rule like this excludes entries from later rules.
+	Certificate string `json:"certificate,omitempty"`
+	// Content restricts the rule to entries with a certain kind of content. The only kind is
+	// "pe": a PE file, such as an exe or dll, detected by its headers rather than its name.
+	Content string `json:"content,omitempty"`
+	// Nested is true if the entries are archives (zip, tar, or tar.gz) to look inside. The rules
+	// are applied to each entry of a nested archive, named "<nested archive>/<entry>". A nested
+	// archive that contains entries to sign is repacked with the signed entries.
+	Nested bool `json:"nested,omitempty"`
+}
+
+// peContent is the entryRule.Content of a rule that only matches PE files.
+const peContent = "pe"
+
+type notarizePolicy struct {
+	Certificate string `json:"certificate"`
+	MacAppName  string `json:"macAppName"`
+}
+
+// archiveTypeNames are the names of the archive types in the policy.
+var archiveTypeNames = map[archiveType]string{
+	zipArchive:   "zip",
+	tarGzArchive: "tar.gz",
+	debArchive:   "deb",
+	rpmArchive:   "rpm",
+	msiArchive:   "msi",
+}
+
+// darwinTarGzName is the policy name of a macOS tar.gz archive.
+const darwinTarGzName = "darwin-tar.gz"
+
+// policyTypeName returns the name of a's archive type in the policy.
+func (a *archive) policyTypeName() string {
+	if a.archiveMacOS {
+		return darwinTarGzName
+	}
+	return archiveTypeNames[a.archiveType]
+}
+
+// policy returns the signing policy for a.
+func (a *archive) policy() *archivePolicy {
+	return policy.ArchiveTypes[a.policyTypeName()]
+}
+
+// readPolicy reads and validates the signing policy file at path.
+func readPolicy(path string) (*signPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p, err := parsePolicy(data)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing policy %q: %v", path, err)
+	}
+	return p, nil
+}
+
+func mustParsePolicy(data []byte) *signPolicy {
+	p, err := parsePolicy(data)
+	if err != nil {
+		panic(fmt.Sprintf("invalid default signing policy: %v", err))
+	}
+	return p
+}
+
+func parsePolicy(data []byte) (*signPolicy, error) {
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.DisallowUnknownFields()
+	var p signPolicy
+	if err := d.Decode(&p); err != nil {
+		return nil, err
+	}
+	return &p, p.validate()
+}
+
+// validate checks that the policy can be applied by this command: every archive type is
+// configured, and only in ways the signing steps for that archive type support.
+func (p *signPolicy) validate() error {
+	var errs []error
+	if p.SignatureCertificate == "" {
+		errs = append(errs, errors.New("signatureCertificate is required"))
+	}
+	names := []string{darwinTarGzName}
+	for _, n := range archiveTypeNames {
+		names = append(names, n)
+	}
+	slices.Sort(names)
+	for name := range p.ArchiveTypes {
+		if !slices.Contains(names, name) {
+			errs = append(errs, fmt.Errorf("unknown archive type %q, expected one of %q", name, names))
+		}
+	}
+	for _, name := range names {
+		ap, ok := p.ArchiveTypes[name]
+		if !ok || ap == nil {
+			errs = append(errs, fmt.Errorf("archive type %q is missing", name))
+			continue
+		}
+		fail := func(format string, v ...any) {
+			errs = append(errs, fmt.Errorf("archive type %q: "+format, append([]any{name}, v...)...))
+		}
+
+		isPackage := name == "deb" || name == "rpm" || name == "msi"
+		if isPackage && ap.PackageCertificate == "" {
+			fail("packageCertificate is required")
+		}
+		if !isPackage && ap.PackageCertificate != "" {
+			fail("packageCertificate is only allowed for packages")
+		}
+		if name == darwinTarGzName && (ap.Notarize == nil || ap.Notarize.Certificate == "" || ap.Notarize.MacAppName == "") {
+			fail("notarize with a certificate and macAppName is required")
+		}
+		if name != darwinTarGzName && ap.Notarize != nil {
+			fail("notarize is only allowed for %q", darwinTarGzName)
+		}
+		if len(ap.Entries) > 0 && name != "zip" && name != darwinTarGzName {
+			fail("entry rules are only allowed for %q and %q", "zip", darwinTarGzName)
+		}
+
+		var certificates []string
+		for i, r := range ap.Entries {
+			if r.Name == "" {
+				fail("entry rule %v has no name", i)
+			}
+			if len(r.Match) == 0 {
+				fail("entry rule %q has no globs", r.Name)
+			}
+			for _, g := range r.Match {
+				if err := checkGlob(g); err != nil {
+					fail("entry rule %q: %v", r.Name, err)
+				}
+			}
+			if r.Content != "" && r.Content != peContent {
+				fail("entry rule %q: unknown content %q, expected %q", r.Name, r.Content, peContent)
+			}
+			if r.Nested && (r.Certificate != "" || r.Content != "") {
+				fail("entry rule %q: a nested rule can't have a certificate or content", r.Name)
+			}
+			if (r.Nested || r.Content != "") && name != "zip" {
+				fail("entry rule %q: nested and content rules are only allowed for %q", r.Name, "zip")
+			}
+			if r.Certificate != "" && !slices.Contains(certificates, r.Certificate) {
+				certificates = append(certificates, r.Certificate)
+			}
+		}
+		if name == darwinTarGzName && len(certificates) == 0 {
+			fail("an entry rule with a certificate is required")
+		}
+		// The macOS entries are sent to be signed in one zip, so they all use one certificate.
+		if name == darwinTarGzName && len(certificates) > 1 {
+			fail("entry rules use different certificates %q, but macOS entries are signed in one batch", certificates)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// matchEntry returns the first rule in the policy for a that matches the entry name, or nil.
+// header returns the start of the entry's content (see readPEHeader), for rules that depend on
+// it. It's only called if needed, and may be nil if the policy for a has no such rules.
+func (a *archive) matchEntry(name string, header func() ([]byte, error)) (*entryRule, error) {
+	for _, r := range a.policy().Entries {
+		if !slices.ContainsFunc(r.Match, func(g string) bool { return matchGlob(g, name) }) {
+			continue
+		}
+		if r.Content == peContent {
+			data, err := header()
+			if err != nil {
+				return nil, err
+			}
+			if !isPE(data) {
+				continue
+			}
+		}
+		return r, nil
+	}
+	return nil, nil
+}
+
+// macOSCertificate returns the certificate the macOS entries are signed with.
+func (ap *archivePolicy) macOSCertificate() string {
+	for _, r := range ap.Entries {
+		if r.Certificate != "" {
+			return r.Certificate
+		}
+	}
+	return ""
+}
+
+// matchGlob returns true if the slash-separated name matches the glob. Each "/"-separated element
+// of the glob is matched against an element of the name using path.Match, except "**", which
+// matches any number of elements, including zero.
+func matchGlob(glob, name string) bool {
+	return matchElems(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(glob, name []string) bool {
+	for len(glob) > 0 {
+		if glob[0] == "**" {
+			for i := range len(name) + 1 {
+				if matchElems(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+		glob, name = glob[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// checkGlob returns an error if glob is malformed.
+func checkGlob(glob string) error {
+	if glob == "" {
+		return errors.New("empty glob")
+	}
+	for _, elem := range strings.Split(glob, "/") {
+		if elem == "**" {
+			continue
+		}
+		if strings.Contains(elem, "**") {
+			return fmt.Errorf("glob %q: \"**\" must be a whole path element", glob)
+		}
+		if _, err := path.Match(elem, ""); err != nil {
+			return fmt.Errorf("glob %q: %v", glob, err)
+		}
+	}
+	return nil
+}
+
+// explainFiles explains the signing policy for the archives matching glob to stdout.
+func explainFiles(glob string) error {
+	files, err := filepath.Glob(glob)
+	if err != nil {
+		return fmt.Errorf("failed to glob files: %v", err)
+	}
+	var archives []*archive
+	for _, f := range files {
+		if isSidecarFile(f) {
+			continue
+		}
+		a, err := identifyArchive(f)
+		if err != nil {
+			return err
+		}
+		archives = append(archives, a)
+	}
+	if len(archives) == 0 {
+		return fmt.Errorf("no archives found matching glob %q", glob)
+	}
+	return explain(os.Stdout, archives)
+}
+
+// explain writes which rule of the policy applies to each entry of each archive to w, and how the
+// archive itself is signed. It doesn't sign anything.
+func explain(w io.Writer, archives []*archive) error {
+	for i, a := range archives {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		ap := a.policy()
+		fmt.Fprintf(w, "%v (archive type %q):\n", a.path, a.policyTypeName())
+		if a.isPackage() {
+			fmt.Fprintf(w, "  package: signed with %v\n", ap.PackageCertificate)
+		} else if a.archiveType == zipArchive {
+			plan, err := a.planEntries(context.Background(), false)
+			if err != nil {
+				return err
+			}
+			for _, e := range plan.matches {
+				explainEntry(w, e.name, e.rule)
+			}
+		} else {
+			if err := archiveutil.InspectArchiveEntries(a.path, func(e *archiveutil.Entry, r io.Reader) error {
+				if !e.Mode.IsRegular() {
+					return nil
+				}
+				rule, err := a.matchEntry(e.Name, nil)
+				if err != nil {
+					return err
+				}
+				explainEntry(w, e.Name, rule)
+				return nil
+			}); err != nil {
+				return fmt.Errorf("failed to read %q: %v", a.path, err)
+			}
+		}
+		if ap.Notarize != nil {
+			fmt.Fprintf(w, "  notarization: %v, app name %q\n", ap.Notarize.Certificate, ap.Notarize.MacAppName)
+		}
+		fmt.Fprintf(w, "  signature file: signed with %v\n", policy.SignatureCertificate)
+		if *linuxPackages && matchOrPanic("go*.linux-*.tar.gz", a.name) {
+			for _, t := range []string{"deb", "rpm"} {
+				fmt.Fprintf(w, "  %v package: signed with %v\n", t, policy.ArchiveTypes[t].PackageCertificate)
+			}
+		}
+		if *windowsInstallers && matchOrPanic("go*.windows-*.zip", a.name) {
+			fmt.Fprintf(w, "  msi installer: signed with %v\n", policy.ArchiveTypes["msi"].PackageCertificate)
+		}
+	}
+	return nil
+}
+
+func explainEntry(w io.Writer, name string, rule *entryRule) {
+	switch {
+	case rule == nil:
+		fmt.Fprintf(w, "  %v: not signed: no rule matches\n", name)
+	case rule.Nested:
+		fmt.Fprintf(w, "  %v: nested archive: rule %q\n", name, rule.Name)
+	case rule.Certificate == "":
+		fmt.Fprintf(w, "  %v: not signed: rule %q\n", name, rule.Name)
+	default:
+		fmt.Fprintf(w, "  %v: signed with %v: rule %q\n", name, rule.Certificate, rule.Name)
+	}
+}
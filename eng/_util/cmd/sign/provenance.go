@@ -0,0 +1,120 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+	"github.com/microsoft/go/_util/internal/checksum"
+	"github.com/microsoft/go/_util/internal/provenance"
+	"github.com/microsoft/go/_util/internal/sbom"
+)
+
+const signBuildType = "https://github.com/microsoft/go/eng/_util/cmd/sign@v1"
+
+// unsignedProvenanceSuffix is appended to the name of an archive to get the name of the
+// provenance statement that build wrote for the archive before it was signed.
+const unsignedProvenanceSuffix = ".unsigned" + provenance.FileSuffix
+
+// isSidecarFile returns true if path is a file that build or sign writes next to an archive,
+// rather than an archive to sign.
+func isSidecarFile(path string) bool {
+	if checksum.IsChecksumFile(path) {
+		return true
+	}
+	for _, suffix := range []string{sbom.FileSuffix, provenance.FileSuffix} {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// copySidecarsToDestination copies the SBOM and provenance statement that build wrote next to the
+// original archive into the destination dir, if they exist. The provenance statement is renamed:
+// it describes the archive before signing.
+func (a *archive) copySidecarsToDestination() error {
+	for src, dst := range map[string]string{
+		a.path + sbom.FileSuffix:       a.name + sbom.FileSuffix,
+		a.path + provenance.FileSuffix: a.name + unsignedProvenanceSuffix,
+	} {
+		if _, err := os.Stat(src); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		a.logf("Copying %q to destination", src)
+		if err := archiveutil.CopyFile(filepath.Join(*destinationDir, dst), src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeProvenance writes a provenance statement for the signed archive and its signature file into
+// the destination dir. Its materials are the unsigned archive and, if it exists, the statement
+// build wrote for the unsigned archive.
+func (a *archive) writeProvenance(startedOn time.Time) error {
+	signedPath := filepath.Join(*destinationDir, a.name)
+	var subjects []*provenance.ResourceDescriptor
+	for _, p := range []string{signedPath, signedPath + ".sig"} {
+		d, err := provenance.FileDescriptor(p)
+		if err != nil {
+			return err
+		}
+		subjects = append(subjects, d)
+	}
+
+	unsigned, err := provenance.FileDescriptor(a.path)
+	if err != nil {
+		return err
+	}
+	unsigned.URI = "unsigned:" + a.name
+	deps := []*provenance.ResourceDescriptor{unsigned}
+	if _, err := os.Stat(signedPath + unsignedProvenanceSuffix); err == nil {
+		d, err := provenance.FileDescriptor(signedPath + unsignedProvenanceSuffix)
+		if err != nil {
+			return err
+		}
+		deps = append(deps, d)
+	}
+
+	params := make(map[string]any)
+	flag.VisitAll(func(f *flag.Flag) {
+		params[f.Name] = f.Value.String()
+	})
+
+	finishedOn := time.Now().UTC()
+	startedOn = startedOn.UTC()
+	s := provenance.NewStatement(subjects, &provenance.Provenance{
+		BuildDefinition: &provenance.BuildDefinition{
+			BuildType:            signBuildType,
+			ExternalParameters:   params,
+			ResolvedDependencies: deps,
+		},
+		RunDetails: &provenance.RunDetails{
+			Builder: &provenance.Builder{ID: provenance.BuilderID("sign")},
+			Metadata: &provenance.BuildMetadata{
+				InvocationID: provenance.InvocationID(),
+				StartedOn:    &startedOn,
+				FinishedOn:   &finishedOn,
+			},
+		},
+	})
+	path := signedPath + provenance.FileSuffix
+	if err := s.WriteFile(path); err != nil {
+		return fmt.Errorf("failed to write provenance statement: %v", err)
+	}
+	a.logf("Wrote provenance statement %q", path)
+	return nil
+}
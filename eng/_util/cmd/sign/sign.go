@@ -11,9 +11,11 @@ import (
 	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/microsoft/go/_util/internal/checksum"
@@ -21,14 +23,33 @@ import (
 
 const description = `
 This command signs build artifacts using MicroBuild. It is used in the Microsoft build of Go build pipeline.
-Use '-n' to test the command locally.
+Use '-n' or '-signer local' to test the command locally.
 
 Signs in multiple passes. Some steps only apply to certain types of archives:
 
-1. Archive entries. Extracts specific entries from inside each archive, signs, and repacks.
+0. With '-linux-packages', locally creates a .deb and .rpm package from each
+   Linux archive. Packages are signed along with the archives.
+1. Archive entries. Extracts specific entries from inside each archive and its
+   nested archives, signs, and repacks.
+   Linux packages are signed as a whole, with the signature embedded.
+   With '-windows-installers', locally creates a .msi installer from each
+   repacked Windows archive, then signs it as a whole.
 2. Notarize. macOS archives get a notarization ticket attached to the tar.gz.
 3. Signatures. Creates sig files for each archive.
-4. Locally creates a .sha256 file for each archive.
+4. Locally verifies each signed archive against the original: entries that
+   should be signed contain a signature, and all other entries are unchanged.
+5. Locally creates a .sha256 file for each archive.
+6. Locally creates an unsigned in-toto SLSA provenance statement (.intoto.json)
+   for each archive. If build created an SBOM and provenance statement next to
+   the original archive, they're copied to the destination, with the build
+   statement renamed to .unsigned.intoto.json.
+
+The entries to sign and the certificates to use come from the signing policy,
+/eng/_util/cmd/sign/sign-policy.json. Use '-explain' to see which policy rule
+applies to each entry without signing.
+
+Progress is recorded in the temp dir after each step. If a run fails, use
+'-resume' to run again without repeating the steps that already completed.
 
 See /eng/_util/cmd/sign/README.md for more information.
 `
@@ -46,6 +67,24 @@ var (
 			"Any MSBuild processes launched by this tool are be manually killed. "+
 			"If set to a value lower than AzDO pipeline timeout, this helps avoid pipeline breakage when uploading MSBuild outputs.")
 	dryRun = flag.Bool("n", false, "Dry run: don't run the MSBuild signing tooling at all, even in test mode. This works on non-Windows platforms.")
+
+	jobs = flag.Int("j", 0, "Maximum number of archives to extract and repack at once. Defaults to the number of CPUs. Each signing step is still sent to the signer as one batch.")
+
+	resume = flag.Bool("resume", false, "Resume the previous run that used the same temp dir. Skips the steps it completed for each archive, as long as the archive and the step's outputs haven't changed since. Progress is always recorded in "+stateFileName+" in the temp dir.")
+
+	linuxPackages       = flag.Bool("linux-packages", false, "Create a Debian (.deb) and RPM (.rpm) package from each Linux tar.gz archive, and sign them along with the archives.")
+	linuxPackageRelease = flag.String("linux-package-release", "1", "Microsoft revision of the Go version, used as the package release by -linux-packages. The Go version is read from the archive's go/VERSION file.")
+
+	windowsInstallers = flag.Bool("windows-installers", false, "Create a Windows Installer package (.msi) from each Windows zip archive after signing the archive's content, and sign it. Requires the WiX Toolset v4 or later.")
+	wixPath           = flag.String("wix", "wix", "Path of the WiX Toolset 'wix' command used by -windows-installers.")
+	installerRevision = flag.String("windows-installer-revision", "1", "Microsoft revision of the Go version, used as the last field of the installer version by -windows-installers. The Go version is read from the archive's go/VERSION file.")
+
+	policyPath    = flag.String("policy", "", "Path of a signing policy file to use instead of the default, /eng/_util/cmd/sign/"+defaultPolicyName+". The policy selects the archive entries to sign and the certificates to sign with.")
+	explainPolicy = flag.Bool("explain", false, "Print which signing policy rule applies to each entry of each archive, then exit without signing anything.")
+
+	signerName = flag.String("signer", "msbuild", "Signing backend to use. Options:\n"+
+		"msbuild: sign using MicroBuild by running 'dotnet build Sign.csproj'.\n"+
+		"local: sign with a throwaway key, writing detached signatures. Doesn't require dotnet. For testing the signing flow end-to-end.")
 )
 
 func main() {
@@ -63,17 +102,35 @@ func main() {
 		return
 	}
 
-	if err := run(); err != nil {
+	if *policyPath != "" {
+		p, err := readPolicy(*policyPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		policy = p
+	}
+	if *explainPolicy {
+		if err := explainFiles(*filesGlob); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	s, err := newSigner()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := run(s); err != nil {
 		log.Printf("error: %v", err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
+func run(s signer) error {
+	startedOn := time.Now()
 	// A context for timeout. This timeout is mainly here to make sure child MSBuild processes are
-	// terminated. There are some ctx.Err() checks sprinkled into the Go code, but canceling
-	// quickly during the packaging/repackaging work in Go is not currently important: the Go work
-	// takes an insignificant amount of time compared to the signing service calls in MSBuild.
+	// terminated. The per-archive work in Go also checks ctx.Err() regularly, and the archives
+	// being processed concurrently are canceled as soon as one of them fails.
 	var ctx context.Context
 	if *timeout == 0 {
 		ctx = context.Background()
@@ -83,78 +140,88 @@ func run() error {
 		defer cancel()
 	}
 
-	archives, err := findArchives(ctx, *filesGlob)
-	if err != nil {
-		return err
+	var saved *signState
+	if *resume {
+		var err error
+		if saved, err = readState(); err != nil {
+			return err
+		}
+		if saved == nil {
+			log.Printf("No state file found at %q: starting from the beginning", stateFilePath())
+		}
 	}
 
-	log.Println("Signing individual files extracted from archives")
-
-	individualFilesToSign, err := flatMapSlice(archives, func(a *archive) ([]*fileToSign, error) {
-		return a.prepareEntriesToSign(ctx)
-	})
+	archives, err := findArchives(ctx, *filesGlob, saved)
 	if err != nil {
 		return err
 	}
+	if *linuxPackages {
+		log.Println("Creating Linux packages")
 
-	if err := sign(ctx, "1-Individual", individualFilesToSign); err != nil {
+		packages, err := createLinuxPackages(ctx, archives, saved)
+		if err != nil {
+			return err
+		}
+		archives = append(archives, packages...)
+	}
+	if err := writeState(archives); err != nil {
 		return err
 	}
 
-	log.Println("Notarizing macOS individual files")
-
-	individualFilesToNotarize, err := flatMapSlice(archives, func(a *archive) ([]*fileToSign, error) {
-		return a.prepareIndividualNotarize(ctx)
-	})
-
-	if err := sign(ctx, "2-Notarize-Individual", individualFilesToNotarize); err != nil {
+	if err := signEntries(ctx, s, archives); err != nil {
 		return err
 	}
+	if *windowsInstallers {
+		log.Println("Creating Windows installers")
 
-	for _, a := range archives {
-		if err := a.repackSignedEntries(ctx); err != nil {
+		installers, err := createWindowsInstallers(ctx, archives, saved)
+		if err != nil {
+			return err
+		}
+		archives = append(archives, installers...)
+		if err := writeState(archives); err != nil {
+			return err
+		}
+		// The other archives have already completed these steps, so only the installers are
+		// signed.
+		if err := signEntries(ctx, s, archives); err != nil {
 			return err
 		}
 	}
 
 	log.Println("Notarizing macOS bundles")
 
-	filesToNotarize, err := flatMapSlice(archives, func(a *archive) ([]*fileToSign, error) {
-		return a.prepareBundleNotarize(ctx)
-	})
-	if err != nil {
+	if err := signStep(ctx, s, archives, "3-Notarize-Bundles", (*archive).prepareBundleNotarize); err != nil {
 		return err
 	}
 
-	if err := sign(ctx, "3-Notarize-Bundles", filesToNotarize); err != nil {
+	if err := forEachArchive(ctx, archives, (*archive).unpackBundleNotarize); err != nil {
 		return err
 	}
 
-	for _, a := range archives {
-		if err := a.unpackBundleNotarize(ctx); err != nil {
-			return err
-		}
-	}
-
 	log.Println("Creating signature files")
 
-	signatureFiles, err := flatMapSlice(archives, func(a *archive) ([]*fileToSign, error) {
-		return a.prepareArchiveSignatures(ctx)
-	})
-	if err != nil {
-		return err
-	}
-
-	if err := sign(ctx, "4-Sigs", signatureFiles); err != nil {
+	if err := signStep(ctx, s, archives, "4-Sigs", (*archive).prepareArchiveSignatures); err != nil {
 		return err
 	}
 
 	log.Println("Copying finished files to destination")
 
-	for _, a := range archives {
+	if err := forEachArchive(ctx, archives, func(a *archive, ctx context.Context) error {
 		if err := a.copyToDestination(ctx); err != nil {
 			return err
 		}
+		return a.copySidecarsToDestination()
+	}); err != nil {
+		return err
+	}
+
+	log.Println("Verifying signed archives")
+
+	if err := forEachArchive(ctx, archives, func(a *archive, ctx context.Context) error {
+		return a.verifyDestination(ctx, s.EmbedsSignatures())
+	}); err != nil {
+		return err
 	}
 
 	log.Println("Generating checksum files")
@@ -165,10 +232,44 @@ func run() error {
 		}
 	}
 
+	log.Println("Generating provenance statements")
+
+	if err := forEachArchive(ctx, archives, func(a *archive, ctx context.Context) error {
+		return a.writeProvenance(startedOn)
+	}); err != nil {
+		return err
+	}
+
 	return nil
 }
 
-func findArchives(ctx context.Context, glob string) ([]*archive, error) {
+// signEntries signs the entries of each archive that need to be signed or notarized individually,
+// then repacks the archive with the signed entries.
+func signEntries(ctx context.Context, s signer, archives []*archive) error {
+	log.Println("Signing individual files extracted from archives")
+
+	if err := signStep(ctx, s, archives, "1-Individual", (*archive).prepareEntriesToSign); err != nil {
+		return err
+	}
+
+	log.Println("Notarizing macOS individual files")
+
+	if err := signStep(ctx, s, archives, "2-Notarize-Individual", (*archive).prepareIndividualNotarize); err != nil {
+		return err
+	}
+
+	return archiveStep(ctx, archives, repackStep, func(a *archive, ctx context.Context) ([]string, error) {
+		if err := a.repackSignedEntries(ctx); err != nil {
+			return nil, err
+		}
+		if a.repackedPath == "" {
+			return nil, nil
+		}
+		return []string{a.repackedPath}, nil
+	})
+}
+
+func findArchives(ctx context.Context, glob string, saved *signState) ([]*archive, error) {
 	files, err := filepath.Glob(glob)
 	if err != nil {
 		return nil, fmt.Errorf("failed to glob files: %v", err)
@@ -187,8 +288,9 @@ func findArchives(ctx context.Context, glob string) ([]*archive, error) {
 		if err := ctx.Err(); err != nil {
 			return nil, err
 		}
-		// Ignore checksum files: we always generate new ones.
-		if strings.HasSuffix(f, ".sha256") {
+		// Ignore checksum files (we always generate new ones) and other files build writes next to
+		// each archive.
+		if isSidecarFile(f) {
 			continue
 		}
 
@@ -198,7 +300,7 @@ func findArchives(ctx context.Context, glob string) ([]*archive, error) {
 		}
 		archiveFilenames[filenameLower] = f
 
-		a, err := newArchive(f)
+		a, err := newArchive(f, saved)
 		if err != nil {
 			return nil, fmt.Errorf("failed to process %q: %v", f, err)
 		}
@@ -212,56 +314,66 @@ func findArchives(ctx context.Context, glob string) ([]*archive, error) {
 	return archives, nil
 }
 
-func sign(ctx context.Context, step string, files []*fileToSign) error {
-	if len(files) == 0 {
-		log.Printf("No files to sign for step %q", step)
-		return nil
+// signStep runs a signing step for each archive that hasn't already completed it: prepare
+// returns the files to sign for the archive, then all the files are signed in one batch. Saves
+// the state file when done.
+func signStep(ctx context.Context, s signer, archives []*archive, step string, prepare func(*archive, context.Context) ([]*fileToSign, error)) error {
+	todo := pendingArchives(archives, step)
+	files, err := flatMapArchives(ctx, todo, prepare)
+	if err != nil {
+		return err
 	}
-
-	var sb strings.Builder
-	sb.WriteString("<Project>\n")
-	sb.WriteString("  <ItemGroup>\n")
-	for _, f := range files {
-		f.WriteMSBuildItem(&sb)
+	if err := sign(ctx, s, step, files); err != nil {
+		return err
 	}
-	sb.WriteString("  </ItemGroup>\n")
-	sb.WriteString("</Project>\n")
-
-	log.Printf("Signing with props file content:\n%s\n", sb.String())
-	if *dryRun {
-		log.Printf("Dry run: skipping signing.")
-		return nil
+	for _, a := range todo {
+		var outputs []string
+		for _, f := range files {
+			if f.originalPath == a.path {
+				outputs = append(outputs, f.fullPath)
+			}
+		}
+		if err := a.completeStep(step, outputs); err != nil {
+			return err
+		}
 	}
+	return writeState(archives)
+}
 
-	if err := os.MkdirAll(*tempDir, 0o777); err != nil {
-		return err
-	}
-	// Get an absolute path to pass to MSBuild, because our working dirs may not be the same.
-	// MSBuild in general will resolve paths relative to the csproj.
-	absTemp, err := filepath.Abs(*tempDir)
-	if err != nil {
+// archiveStep runs f for each archive that hasn't already completed the step. f returns the
+// files it produced. Saves the state file when done.
+func archiveStep(ctx context.Context, archives []*archive, step string, f func(*archive, context.Context) ([]string, error)) error {
+	if err := forEachArchive(ctx, pendingArchives(archives, step), func(a *archive, ctx context.Context) error {
+		outputs, err := f(a, ctx)
+		if err != nil {
+			return err
+		}
+		return a.completeStep(step, outputs)
+	}); err != nil {
 		return err
 	}
-	propsFilePath := filepath.Join(absTemp, "Sign"+step+".props")
-	if err := os.WriteFile(propsFilePath, []byte(sb.String()), 0o666); err != nil {
-		return err
+	return writeState(archives)
+}
+
+// pendingArchives returns the archives that haven't completed step.
+func pendingArchives(archives []*archive, step string) []*archive {
+	var pending []*archive
+	for _, a := range archives {
+		if a.stepDone(step) {
+			log.Printf("Skipping step %q for %q: already completed", step, a.name)
+			continue
+		}
+		pending = append(pending, a)
 	}
+	return pending
+}
 
-	cmd := exec.CommandContext(
-		ctx,
-		"dotnet", "build", "Sign.csproj",
-		"/p:SignFilesDir="+absTemp,
-		"/p:FilesToSignPropsFile="+propsFilePath,
-		"/t:AfterBuild",
-		"/p:SignType="+*signType,
-		"/bl:"+filepath.Join(absTemp, "Sign"+step+".binlog"),
-		"/v:n",
-	)
-	cmd.Dir = *signingCsprojDir
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	log.Printf("Running: %v", cmd)
-	return cmd.Run()
+func sign(ctx context.Context, s signer, step string, files []*fileToSign) error {
+	if len(files) == 0 {
+		log.Printf("No files to sign for step %q", step)
+		return nil
+	}
+	return s.Sign(ctx, step, files)
 }
 
 type fileToSign struct {
@@ -272,6 +384,9 @@ type fileToSign struct {
 	zip bool
 	// macAppName for notarization.
 	macAppName string
+	// detached is true if signing replaces the file with a detached signature of its content,
+	// like the signature files of the archives.
+	detached bool
 }
 
 func (f *fileToSign) WriteMSBuildItem(w io.Writer) {
@@ -286,16 +401,69 @@ func (f *fileToSign) WriteMSBuildItem(w io.Writer) {
 	fmt.Fprintf(w, " />\n")
 }
 
-// flatMapSlice sequentially maps each element of es to a slice using f and flattens the resulting
-// slices. If any call to f returns an error, the error is returned immediately.
-func flatMapSlice[E, R any](es []E, f func(E) ([]R, error)) ([]R, error) {
-	var results []R
-	for _, e := range es {
-		rs, err := f(e)
-		if err != nil {
-			return nil, err
+// forEachArchive calls f for each archive, processing up to *jobs archives at once. If any call
+// returns an error, the ctx passed to the other calls is canceled and the first error is returned.
+//
+// Each archive's buffered log output is flushed in the same order as archives as soon as the
+// archive and all the archives before it are done, so the log is the same as if the archives were
+// processed sequentially.
+func forEachArchive(ctx context.Context, archives []*archive, f func(*archive, context.Context) error) error {
+	n := *jobs
+	if n < 1 {
+		n = runtime.NumCPU()
+	}
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	done := make([]chan struct{}, len(archives))
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(n, len(archives)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				a := archives[i]
+				// Don't start new work if another archive failed or the timeout expired.
+				if ctx.Err() == nil {
+					if err := f(a, ctx); err != nil {
+						cancel(fmt.Errorf("failed to process %q: %w", a.name, err))
+					}
+				}
+				close(done[i])
+			}
+		}()
+	}
+	go func() {
+		for i := range archives {
+			indexes <- i
 		}
-		results = append(results, rs...)
+		close(indexes)
+	}()
+	for i, a := range archives {
+		<-done[i]
+		a.flushLog()
+	}
+	wg.Wait()
+
+	return context.Cause(ctx)
+}
+
+// flatMapArchives maps each archive to a slice using f, concurrently as described by
+// forEachArchive, and flattens the resulting slices in the same order as archives.
+func flatMapArchives[R any](ctx context.Context, archives []*archive, f func(*archive, context.Context) ([]R, error)) ([]R, error) {
+	results := make([][]R, len(archives))
+	if err := forEachArchive(ctx, archives, func(a *archive, ctx context.Context) error {
+		i := slices.Index(archives, a)
+		var err error
+		results[i], err = f(a, ctx)
+		return err
+	}); err != nil {
+		return nil, err
 	}
-	return results, nil
+	return slices.Concat(results...), nil
 }
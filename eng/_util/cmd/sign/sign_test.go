@@ -0,0 +1,728 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"debug/pe"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archivediff"
+	"github.com/microsoft/go/_util/internal/archiveutil"
+	"github.com/microsoft/go/_util/internal/checksum"
+)
+
+var testArchiveFiles = map[string]string{
+	"go/VERSION":                         "go1.24.1\n",
+	"go/src/fmt/print.go":                "package fmt\n",
+	"go/bin/go":                          "go binary",
+	"go/pkg/tool/os_arch/compile":        "compile binary",
+	"go/pkg/tool/os_arch/compile.exe":    string(testPE(false)),
+	"go/bin/gofmt.exe":                   string(testPE(false)),
+	"go/src/cmd/go/testdata/example.exe": string(testPE(false)),
+	"go/src/runtime/race/race.dll":       string(testPE(false)),
+	"go/misc/helpers.zip":                testNestedArchive("zip"),
+	"go/misc/helpers.tar.gz":             testNestedArchive("tar.gz"),
+}
+
+// testNestedArchive returns an archive in the given format containing a PE file and a text file.
+func testNestedArchive(format string) string {
+	files := []struct{ name, content string }{
+		{"bin/helper.exe", string(testPE(false))},
+		{"README", "helpers\n"},
+	}
+	var b bytes.Buffer
+	var err error
+	if format == "zip" {
+		zw := zip.NewWriter(&b)
+		for _, f := range files {
+			var w io.Writer
+			if w, err = zw.Create(f.name); err == nil {
+				_, err = io.WriteString(w, f.content)
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		err = zw.Close()
+	} else {
+		gzw := gzip.NewWriter(&b)
+		tw := tar.NewWriter(gzw)
+		for _, f := range files {
+			hdr := &tar.Header{Typeflag: tar.TypeReg, Name: f.name, Size: int64(len(f.content)), Mode: 0o755}
+			if err = tw.WriteHeader(hdr); err == nil {
+				_, err = io.WriteString(tw, f.content)
+			}
+			if err != nil {
+				panic(err)
+			}
+		}
+		err = cmp.Or(tw.Close(), gzw.Close())
+	}
+	if err != nil {
+		panic(err)
+	}
+	return b.String()
+}
+
+func writeTestZip(t *testing.T, path string) {
+	if err := archiveutil.WithZipCreate(path, func(zw *zip.Writer) error {
+		for name, content := range testArchiveFiles {
+			fh := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Unix(1700000000, 0)}
+			fh.SetMode(0o755)
+			w, err := zw.CreateHeader(fh)
+			if err != nil {
+				return err
+			}
+			if _, err := w.Write([]byte(content)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestTarGz(t *testing.T, path string) {
+	if err := archiveutil.WithTarGzCreate(path, func(tw *tar.Writer) error {
+		for name, content := range testArchiveFiles {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     name,
+				Size:     int64(len(content)),
+				Mode:     0o755,
+				ModTime:  time.Unix(1700000000, 0),
+			}); err != nil {
+				return err
+			}
+			if _, err := tw.Write([]byte(content)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setUpSignTest creates archives to sign in a temp dir and points the flags at it. Returns the
+// dir containing the archives and their names.
+func setUpSignTest(t *testing.T) (string, []string) {
+	dir := t.TempDir()
+	toSign := filepath.Join(dir, "tosign")
+	if err := os.MkdirAll(toSign, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	names := []string{
+		"go1.24.1.windows-amd64.zip",
+		"go1.24.1.darwin-arm64.tar.gz",
+		"go1.24.1.linux-amd64.tar.gz",
+	}
+	for _, name := range names {
+		if strings.HasSuffix(name, ".zip") {
+			writeTestZip(t, filepath.Join(toSign, name))
+		} else {
+			writeTestTarGz(t, filepath.Join(toSign, name))
+		}
+	}
+	// Build writes checksum files next to the archives. sign must skip them.
+	var paths []string
+	for _, name := range names {
+		paths = append(paths, filepath.Join(toSign, name))
+	}
+	if err := checksum.Write(paths, &checksum.WriteOptions{Algorithms: checksum.Algorithms, ManifestDir: toSign}); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, value := range map[string]string{
+		"files":    filepath.Join(toSign, "*"),
+		"o":        filepath.Join(dir, "signed"),
+		"temp-dir": filepath.Join(dir, "temp"),
+		"resume":   "false",
+	} {
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { flag.Set(name, old) })
+	}
+	return toSign, names
+}
+
+// TestLocalSign runs every signing step with the local signer and checks the results.
+func TestLocalSign(t *testing.T) {
+	toSign, names := setUpSignTest(t)
+
+	s, err := newLocalSigner(*tempDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(s); err != nil {
+		t.Fatal(err)
+	}
+
+	pub := s.key.Public().(ed25519.PublicKey)
+	for _, name := range names {
+		signed := filepath.Join(*destinationDir, name)
+		content, err := os.ReadFile(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := os.ReadFile(signed + ".sig")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ed25519.Verify(pub, content, sigBytes) {
+			t.Errorf("%v: signature doesn't match the signed archive", name)
+		}
+
+		sum, err := checksum.ReadSHA256ChecksumFile(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want, err := checksum.FileSHA256(signed); err != nil {
+			t.Fatal(err)
+		} else if sum != want {
+			t.Errorf("%v: checksum file has %v, want %v", name, sum, want)
+		}
+
+		if _, err := os.Stat(signed + ".intoto.json"); err != nil {
+			t.Error(err)
+		}
+
+		// The local signer doesn't change the files it signs, so repacking must reproduce the
+		// original archive's entries exactly. The exception is a nested zip, which is rewritten
+		// with the same entries, but not byte for byte: verifyDestination checks its entries.
+		diff, err := archivediff.Compare(filepath.Join(toSign, name), signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		diff.Modified = slices.DeleteFunc(diff.Modified, func(c *archivediff.Change) bool {
+			return c.Name == "go/misc/helpers.zip" && !c.ModeChanged && !c.ModTimeChanged
+		})
+		if !diff.Empty() {
+			var b strings.Builder
+			diff.Print(&b)
+			t.Errorf("%v: signed archive differs from original:\n%v", name, b.String())
+		}
+	}
+}
+
+func TestForEachArchiveLogOrderAndCancel(t *testing.T) {
+	var out strings.Builder
+	oldWriter, oldFlags := log.Writer(), log.Flags()
+	log.SetOutput(&out)
+	log.SetFlags(0)
+	t.Cleanup(func() {
+		log.SetOutput(oldWriter)
+		log.SetFlags(oldFlags)
+	})
+
+	var archives []*archive
+	for _, name := range []string{"a", "b", "c", "d"} {
+		a := &archive{name: name}
+		a.logger = log.New(&a.logBuf, "", 0)
+		archives = append(archives, a)
+	}
+
+	// Process all the archives at once, and make each one wait for the others to start before
+	// finishing, so the log calls interleave. The log must still be grouped in archive order.
+	oldJobs := *jobs
+	*jobs = len(archives)
+	t.Cleanup(func() { *jobs = oldJobs })
+	var wg sync.WaitGroup
+	wg.Add(len(archives))
+	err := forEachArchive(context.Background(), archives, func(a *archive, ctx context.Context) error {
+		a.logf("%v 1", a.name)
+		wg.Done()
+		wg.Wait()
+		a.logf("%v 2", a.name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a 1\na 2\nb 1\nb 2\nc 1\nc 2\nd 1\nd 2\n"; out.String() != want {
+		t.Errorf("got log %q, want %q", out.String(), want)
+	}
+
+	errFail := errors.New("fail")
+	err = forEachArchive(context.Background(), archives, func(a *archive, ctx context.Context) error {
+		if a.name == "b" {
+			return errFail
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, errFail) {
+		t.Errorf("got error %v, want %v", err, errFail)
+	}
+}
+
+// recordingSigner records the steps it signs, and fails the step named failStep.
+type recordingSigner struct {
+	signer
+	steps    []string
+	failStep string
+}
+
+func (s *recordingSigner) Sign(ctx context.Context, step string, files []*fileToSign) error {
+	if step == s.failStep {
+		return errors.New("signing service failed")
+	}
+	s.steps = append(s.steps, step)
+	return s.signer.Sign(ctx, step, files)
+}
+
+func TestResume(t *testing.T) {
+	_, names := setUpSignTest(t)
+
+	ls, err := newLocalSigner(*tempDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &recordingSigner{signer: ls, failStep: "4-Sigs"}
+	if err := run(s); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+
+	if err := flag.Set("resume", "true"); err != nil {
+		t.Fatal(err)
+	}
+	s.steps, s.failStep = nil, ""
+	if err := run(s); err != nil {
+		t.Fatal(err)
+	}
+	// Steps 1 and 2 completed in the first run. Step 3 has no files.
+	if want := []string{"4-Sigs"}; !slices.Equal(s.steps, want) {
+		t.Errorf("resumed run signed steps %v, want %v", s.steps, want)
+	}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(*destinationDir, name+".sig")); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Change a signed file from step 1: the Windows archive must be signed again from step 1,
+	// and the others must not.
+	state, err := readState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changed bool
+	for _, as := range state.Archives {
+		if strings.HasSuffix(as.Path, ".zip") {
+			for path := range as.Steps[0].Outputs {
+				if err := os.WriteFile(path, []byte("tampered"), 0o666); err != nil {
+					t.Fatal(err)
+				}
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		t.Fatal("no step 1 outputs found for the Windows archive")
+	}
+	s.steps = nil
+	if err := run(s); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1-Individual", "4-Sigs"}; !slices.Equal(s.steps, want) {
+		t.Errorf("resumed run signed steps %v, want %v", s.steps, want)
+	}
+}
+
+// TestResumeLocalSignerKey resumes a completed run with a new local signer. The kept signature
+// files must still verify against the published public key.
+func TestResumeLocalSignerKey(t *testing.T) {
+	_, names := setUpSignTest(t)
+	s, err := newLocalSigner(*tempDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(s); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := flag.Set("resume", "true"); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := newLocalSigner(*tempDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs := &recordingSigner{signer: resumed}
+	if err := run(rs); err != nil {
+		t.Fatal(err)
+	}
+	if len(rs.steps) != 0 {
+		t.Errorf("resumed run signed steps %v, want none", rs.steps)
+	}
+
+	data, err := os.ReadFile(resumed.publicKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		signed := filepath.Join(*destinationDir, name)
+		content, err := os.ReadFile(signed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := os.ReadFile(signed + ".sig")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sigBytes, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ed25519.Verify(pub, content, sigBytes) {
+			t.Errorf("%v: signature doesn't match the published public key", name)
+		}
+	}
+
+	// Without -resume, the signer starts over with a new key.
+	fresh, err := newLocalSigner(*tempDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh.key.Equal(resumed.key) {
+		t.Error("new signer reused the key of the previous run")
+	}
+}
+
+func TestVerifyDestinationDetectsChanges(t *testing.T) {
+	toSign, _ := setUpSignTest(t)
+	s, err := newLocalSigner(*tempDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Replace the signed archive with one where an unsigned entry changed.
+	name := "go1.24.1.linux-amd64.tar.gz"
+	testArchiveFiles["go/VERSION"] = "go1.24.2\n"
+	t.Cleanup(func() { testArchiveFiles["go/VERSION"] = "go1.24.1\n" })
+	writeTestTarGz(t, filepath.Join(*destinationDir, name))
+
+	a, err := newArchive(filepath.Join(toSign, name), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = a.verifyDestination(context.Background(), false)
+	if err == nil || !strings.Contains(err.Error(), `"go/VERSION" isn't signed, but its content changed`) {
+		t.Errorf("got error %v, want unsigned entry change", err)
+	}
+}
+
+// embeddingSigner replaces each PE file it signs with a signed PE file, like Authenticode signing
+// would, and signs the rest with the local signer.
+type embeddingSigner struct {
+	*localSigner
+}
+
+func (s embeddingSigner) Sign(ctx context.Context, step string, files []*fileToSign) error {
+	var rest []*fileToSign
+	for _, f := range files {
+		if f.authenticode == "" || f.detached {
+			rest = append(rest, f)
+		} else if err := os.WriteFile(f.fullPath, testPE(true), 0o666); err != nil {
+			return err
+		}
+	}
+	return s.localSigner.Sign(ctx, step, rest)
+}
+
+func (s embeddingSigner) EmbedsSignatures() bool { return true }
+
+// TestSignNestedArchives checks that PE files in nested archives are signed, and that the nested
+// archives are repacked with the signed files.
+func TestSignNestedArchives(t *testing.T) {
+	toSign, _ := setUpSignTest(t)
+	if err := flag.Set("files", filepath.Join(toSign, "*.zip")); err != nil {
+		t.Fatal(err)
+	}
+	ls, err := newLocalSigner(*tempDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// run verifies the destination, including the signatures of the nested entries.
+	if err := run(embeddingSigner{ls}); err != nil {
+		t.Fatal(err)
+	}
+
+	signed := make(map[string][]byte)
+	if err := archiveutil.EachArchiveEntry(filepath.Join(*destinationDir, "go1.24.1.windows-amd64.zip"), func(e *archiveutil.Entry, r io.Reader) error {
+		if r == nil || nestedFormat(e.Name) == "" {
+			return nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		entries, err := readNestedEntries(data, nestedFormat(e.Name))
+		if err != nil {
+			return err
+		}
+		for name, ne := range entries {
+			signed[e.Name+"/"+name] = ne.data
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"go/misc/helpers.zip/bin/helper.exe", "go/misc/helpers.tar.gz/bin/helper.exe"} {
+		if !bytes.Equal(signed[name], testPE(true)) {
+			t.Errorf("%v isn't signed", name)
+		}
+	}
+	if got := string(signed["go/misc/helpers.zip/README"]); got != "helpers\n" {
+		t.Errorf("README content %q, want unchanged", got)
+	}
+}
+
+// testPE returns a minimal 64-bit PE file. If signed, the certificate table entry is set.
+func testPE(signed bool) []byte {
+	var b bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	binary.LittleEndian.PutUint32(dos[0x3c:], 0x40)
+	b.Write(dos)
+	b.WriteString("PE\x00\x00")
+	oh := pe.OptionalHeader64{Magic: 0x20b, NumberOfRvaAndSizes: 16}
+	if signed {
+		oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_SECURITY] = pe.DataDirectory{VirtualAddress: 0x200, Size: 0x10}
+	}
+	fh := pe.FileHeader{Machine: pe.IMAGE_FILE_MACHINE_AMD64, SizeOfOptionalHeader: uint16(binary.Size(oh))}
+	for _, v := range []any{fh, oh} {
+		if err := binary.Write(&b, binary.LittleEndian, v); err != nil {
+			panic(err)
+		}
+	}
+	return b.Bytes()
+}
+
+func TestCheckEmbeddedSignature(t *testing.T) {
+	if err := checkEmbeddedSignature(testPE(true)); err != nil {
+		t.Errorf("signed PE: %v", err)
+	}
+	if err := checkEmbeddedSignature(testPE(false)); err == nil {
+		t.Error("unsigned PE: got no error")
+	}
+	if err := checkEmbeddedSignature([]byte("not a binary")); err == nil {
+		t.Error("non-binary: got no error")
+	}
+}
+
+func TestReadPEHeader(t *testing.T) {
+	// readPEHeader must not read past the PE signature: the rest of the entry fails to read.
+	pe := testPE(false)
+	tests := []struct {
+		name string
+		data []byte
+		want int
+		isPE bool
+	}{
+		{"pe", pe, 0x44, true},
+		{"text", bytes.Repeat([]byte("text"), 100), 0x40, false},
+		{"short", []byte("MZ"), 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := io.Reader(bytes.NewReader(tt.data))
+			if len(tt.data) > tt.want {
+				r = io.MultiReader(bytes.NewReader(tt.data[:tt.want]), iotest.ErrReader(errors.New("read too far")))
+			}
+			head, err := readPEHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(head) != tt.want {
+				t.Errorf("read %v bytes, want %v", len(head), tt.want)
+			}
+			if got := isPE(head); got != tt.isPE {
+				t.Errorf("isPE = %v, want %v", got, tt.isPE)
+			}
+		})
+	}
+}
+
+func TestLocalSignLinuxPackages(t *testing.T) {
+	setUpSignTest(t)
+	if err := flag.Set("linux-packages", "true"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("linux-packages", "false") })
+
+	s, err := newLocalSigner(*tempDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(s); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"go1.24.1.linux-amd64.deb", "go1.24.1.linux-amd64.rpm"} {
+		for _, suffix := range []string{"", ".sig", ".sha256", ".intoto.json"} {
+			if _, err := os.Stat(filepath.Join(*destinationDir, name+suffix)); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+}
+
+func TestLocalSignWindowsInstallers(t *testing.T) {
+	if _, err := exec.LookPath("wix"); err != nil {
+		t.Skip("wix not found")
+	}
+	setUpSignTest(t)
+	if err := flag.Set("windows-installers", "true"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { flag.Set("windows-installers", "false") })
+
+	s, err := newLocalSigner(*tempDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := run(s); err != nil {
+		t.Fatal(err)
+	}
+	for _, suffix := range []string{"", ".sig", ".sha256", ".intoto.json"} {
+		if _, err := os.Stat(filepath.Join(*destinationDir, "go1.24.1.windows-amd64.msi"+suffix)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		glob, name string
+		want       bool
+	}{
+		{"**/*.exe", "go/bin/go.exe", true},
+		{"**/*.exe", "go.exe", true},
+		{"**/*.exe", "go/bin/go", false},
+		{"go/bin/*", "go/bin/go", true},
+		{"go/bin/*", "go/bin/sub/go", false},
+		{"go/pkg/tool/*/*", "go/pkg/tool/linux_amd64/vet", true},
+		{"go/**/testdata/**", "go/src/cmd/go/testdata/x/example.exe", true},
+		{"go/**/testdata/**", "go/src/cmd/go/example.exe", false},
+		{"go/**", "go", true},
+	}
+	for _, tt := range tests {
+		if got := matchGlob(tt.glob, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.glob, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	zip, err := identifyArchive("go1.24.1.windows-amd64.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zip.path = filepath.Join(t.TempDir(), zip.name)
+	writeTestZip(t, zip.path)
+
+	// The first matching rule applies, so a rule without a certificate excludes entries.
+	pe := func() ([]byte, error) { return testPE(false), nil }
+	if r, err := zip.matchEntry("go/src/cmd/go/testdata/example.exe", pe); err != nil || r == nil || r.Name != "testdata" {
+		t.Errorf("testdata entry matched %+v, %v", r, err)
+	}
+	// PE files are recognized by content, not by extension.
+	if r, err := zip.matchEntry("go/lib/helper", pe); err != nil || r == nil || r.Certificate != "Microsoft400" {
+		t.Errorf("PE entry matched %+v, %v", r, err)
+	}
+	text := func() ([]byte, error) { return []byte("text"), nil }
+	if r, err := zip.matchEntry("go/bin/go.exe", text); err != nil || r != nil {
+		t.Errorf("non-PE entry matched %+v, %v", r, err)
+	}
+
+	if _, err := zip.planEntries(context.Background(), false); err != nil {
+		t.Fatal(err)
+	}
+	if info := zip.entrySignInfo("go/src/cmd/go/testdata/example.exe"); info != nil {
+		t.Errorf("testdata sign info %+v", info)
+	}
+	for _, name := range []string{"go/bin/gofmt.exe", "go/src/runtime/race/race.dll", "go/misc/helpers.zip/bin/helper.exe", "go/misc/helpers.tar.gz/bin/helper.exe"} {
+		if info := zip.entrySignInfo(name); info == nil || info.authenticode != "Microsoft400" {
+			t.Errorf("%v sign info %+v", name, info)
+		}
+	}
+
+	var b strings.Builder
+	if err := explain(&b, []*archive{zip}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		`go/bin/gofmt.exe: signed with Microsoft400: rule "windows-pe"`,
+		`go/src/runtime/race/race.dll: signed with Microsoft400: rule "windows-pe"`,
+		`go/src/cmd/go/testdata/example.exe: not signed: rule "testdata"`,
+		`go/misc/helpers.zip: nested archive: rule "nested-archives"`,
+		`go/misc/helpers.zip/bin/helper.exe: signed with Microsoft400: rule "windows-pe"`,
+		`go/misc/helpers.tar.gz/README: not signed: no rule matches`,
+		`go/VERSION: not signed: no rule matches`,
+		`signature file: signed with LinuxSignManagedLanguageCompiler`,
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("explain output doesn't contain %q:\n%v", want, b.String())
+		}
+	}
+
+	for _, bad := range []struct{ old, new, err string }{
+		{`"tar.gz": {},`, ``, `archive type "tar.gz" is missing`},
+		{`"tar.gz": {},`, `"tar.gz": {}, "exe": {},`, `unknown archive type "exe"`},
+		{`"tar.gz": {}`, `"tar.gz": {"packageCertificate": "LinuxSign"}`, `packageCertificate is only allowed for packages`},
+		{`"nested": true`, `"nested": true, "zip": true`, `unknown field "zip"`},
+		{`["**/testdata/**"]`, `["go/**testdata"]`, `"**" must be a whole path element`},
+		{`"content": "pe"`, `"content": "elf"`, `unknown content "elf"`},
+		{`"nested": true`, `"nested": true, "certificate": "Microsoft400"`, `a nested rule can't have a certificate or content`},
+		{`"certificate": "MacDeveloperHarden"`, `"certificate": "MacDeveloperHarden", "nested": true`, `nested and content rules are only allowed for "zip"`},
+		{`"MacDeveloperHarden"`, `""`, `an entry rule with a certificate is required`},
+		{`"rpm": {
+      "packageCertificate": "LinuxSign"
+    }`, `"rpm": {}`, `archive type "rpm": packageCertificate is required`},
+	} {
+		data := strings.Replace(string(defaultPolicyJSON), bad.old, bad.new, 1)
+		if data == string(defaultPolicyJSON) {
+			t.Fatalf("replacing %q didn't change the policy", bad.old)
+		}
+		if _, err := parsePolicy([]byte(data)); err == nil || !strings.Contains(err.Error(), bad.err) {
+			t.Errorf("replacing %q with %q: got error %v, want %q", bad.old, bad.new, err, bad.err)
+		}
+	}
+}
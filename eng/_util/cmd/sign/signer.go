@@ -0,0 +1,197 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// signer signs a batch of files for one signing step.
+//
+// Each file is signed in place: when Sign returns, the file at fullPath holds the signed content.
+// For a file with detached set, the signed content is a detached signature of the original
+// content.
+type signer interface {
+	Sign(ctx context.Context, step string, files []*fileToSign) error
+	// EmbedsSignatures returns true if signing a binary embeds a signature in it, like
+	// Authenticode does for a PE file.
+	EmbedsSignatures() bool
+}
+
+// newSigner returns the signer selected by the command line flags.
+func newSigner() (signer, error) {
+	switch *signerName {
+	case "msbuild":
+		return &msbuildSigner{
+			csprojDir: *signingCsprojDir,
+			tempDir:   *tempDir,
+			signType:  *signType,
+			dryRun:    *dryRun,
+		}, nil
+	case "local":
+		if *dryRun {
+			return nil, fmt.Errorf("dry run is not supported by the local signer")
+		}
+		return newLocalSigner(*tempDir, *resume)
+	}
+	return nil, fmt.Errorf("unknown signer %q, expected 'msbuild' or 'local'", *signerName)
+}
+
+// msbuildSigner signs files using MicroBuild by building Sign.csproj with a generated props file
+// listing the files.
+type msbuildSigner struct {
+	csprojDir string
+	tempDir   string
+	signType  string
+	// dryRun logs the props file but doesn't run MSBuild.
+	dryRun bool
+}
+
+func (s *msbuildSigner) EmbedsSignatures() bool {
+	return !s.dryRun
+}
+
+func (s *msbuildSigner) Sign(ctx context.Context, step string, files []*fileToSign) error {
+	var sb strings.Builder
+	sb.WriteString("<Project>\n")
+	sb.WriteString("  <ItemGroup>\n")
+	for _, f := range files {
+		f.WriteMSBuildItem(&sb)
+	}
+	sb.WriteString("  </ItemGroup>\n")
+	sb.WriteString("</Project>\n")
+
+	log.Printf("Signing with props file content:\n%s\n", sb.String())
+	if s.dryRun {
+		log.Printf("Dry run: skipping signing.")
+		return nil
+	}
+
+	if err := os.MkdirAll(s.tempDir, 0o777); err != nil {
+		return err
+	}
+	// Get an absolute path to pass to MSBuild, because our working dirs may not be the same.
+	// MSBuild in general will resolve paths relative to the csproj.
+	absTemp, err := filepath.Abs(s.tempDir)
+	if err != nil {
+		return err
+	}
+	propsFilePath := filepath.Join(absTemp, "Sign"+step+".props")
+	if err := os.WriteFile(propsFilePath, []byte(sb.String()), 0o666); err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(
+		ctx,
+		"dotnet", "build", "Sign.csproj",
+		"/p:SignFilesDir="+absTemp,
+		"/p:FilesToSignPropsFile="+propsFilePath,
+		"/t:AfterBuild",
+		"/p:SignType="+s.signType,
+		"/bl:"+filepath.Join(absTemp, "Sign"+step+".binlog"),
+		"/v:n",
+	)
+	cmd.Dir = s.csprojDir
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	log.Printf("Running: %v", cmd)
+	return cmd.Run()
+}
+
+// localSigner is a signer for testing the signing flow without MicroBuild. It signs with a
+// throwaway ed25519 key generated when it's created, or with the key of the run it resumes.
+//
+// Signature files (".sig") are replaced with a base64-encoded detached signature of their
+// content. Other files can't be signed in a way the OS would recognize, so their content is left
+// unchanged and a detached signature is written next to them with a ".localsig" suffix.
+type localSigner struct {
+	key ed25519.PrivateKey
+	// publicKeyPath is the path of the file containing the base64-encoded public key.
+	publicKeyPath string
+}
+
+// localSignatureSuffix is appended to the name of a file to get the name of the detached
+// signature written by localSigner.
+const localSignatureSuffix = ".localsig"
+
+// newLocalSigner generates a key, saves it in dir as "local-signer.key", and writes the public key
+// to dir as "local-signer.pub". If resume is true and dir already has a key, that key is used
+// instead, so the signatures kept from the resumed run still match the public key.
+func newLocalSigner(dir string, resume bool) (*localSigner, error) {
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	keyPath := filepath.Join(dir, "local-signer.key")
+	var key ed25519.PrivateKey
+	if resume {
+		data, err := os.ReadFile(keyPath)
+		if err == nil {
+			seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+			if err != nil || len(seed) != ed25519.SeedSize {
+				return nil, fmt.Errorf("invalid local signer key %q", keyPath)
+			}
+			key = ed25519.NewKeyFromSeed(seed)
+			log.Printf("Local signer: resuming with the key in %q", keyPath)
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if key == nil {
+		var err error
+		if _, key, err = ed25519.GenerateKey(rand.Reader); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(keyPath, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0o600); err != nil {
+			return nil, err
+		}
+	}
+	s := &localSigner{
+		key:           key,
+		publicKeyPath: filepath.Join(dir, "local-signer.pub"),
+	}
+	pub := key.Public().(ed25519.PublicKey)
+	if err := os.WriteFile(s.publicKeyPath, []byte(base64.StdEncoding.EncodeToString(pub)+"\n"), 0o666); err != nil {
+		return nil, err
+	}
+	log.Printf("Local signer: wrote public key to %q", s.publicKeyPath)
+	return s, nil
+}
+
+func (s *localSigner) EmbedsSignatures() bool {
+	return false
+}
+
+func (s *localSigner) Sign(ctx context.Context, step string, files []*fileToSign) error {
+	for _, f := range files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		content, err := os.ReadFile(f.fullPath)
+		if err != nil {
+			return err
+		}
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, content)) + "\n"
+		sigPath := f.fullPath + localSignatureSuffix
+		if f.detached {
+			sigPath = f.fullPath
+		}
+		log.Printf("Local signer: step %q: signing %q (%v) to %q", step, f.fullPath, f.authenticode, sigPath)
+		if err := os.WriteFile(sigPath, []byte(sig), 0o666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/microsoft/go/_util/internal/checksum"
+)
+
+// stateFileName is the name of the file in the temp dir that records the progress of the sign
+// run, so a failed run can be resumed with -resume.
+const stateFileName = "sign-state.json"
+
+// Names of the per-archive steps that aren't signing steps.
+const repackStep = "repack"
+
+// signState is the content of the state file.
+type signState struct {
+	Archives []*archiveState `json:"archives"`
+}
+
+// archiveState is the progress of signing one archive.
+type archiveState struct {
+	// Path and SHA256 identify the original archive. If the archive at Path changes, its state is
+	// discarded.
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+
+	WorkDir       string `json:"workDir"`
+	RepackedPath  string `json:"repackedPath,omitempty"`
+	NotarizedPath string `json:"notarizedPath,omitempty"`
+
+	// Steps are the steps completed for this archive, in the order they were completed.
+	Steps []*completedStep `json:"steps,omitempty"`
+}
+
+// completedStep is a step that was completed for an archive.
+type completedStep struct {
+	Name string `json:"name"`
+	// Outputs maps the path of each file the step produced for the archive to its SHA256
+	// checksum.
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+func stateFilePath() string {
+	return filepath.Join(*tempDir, stateFileName)
+}
+
+// readState reads the state file. Returns nil if there is no state file.
+func readState() (*signState, error) {
+	data, err := os.ReadFile(stateFilePath())
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var s signState
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to read state file %q: %v", stateFilePath(), err)
+	}
+	return &s, nil
+}
+
+// writeState writes the current state of archives to the state file.
+func writeState(archives []*archive) error {
+	var s signState
+	for _, a := range archives {
+		a.state.WorkDir = a.workDir
+		a.state.RepackedPath = a.repackedPath
+		a.state.NotarizedPath = a.notarizedPath
+		s.Archives = append(s.Archives, &a.state)
+	}
+	data, err := json.MarshalIndent(&s, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(*tempDir, 0o777); err != nil {
+		return err
+	}
+	return os.WriteFile(stateFilePath(), append(data, '\n'), 0o666)
+}
+
+// find returns the saved state for the archive at path with the given checksum, or nil.
+func (s *signState) find(path, sha256 string) *archiveState {
+	if s == nil {
+		return nil
+	}
+	for _, as := range s.Archives {
+		if as.Path == path && as.SHA256 == sha256 {
+			return as
+		}
+	}
+	return nil
+}
+
+// resume restores the progress of a from saved. Only the completed steps whose outputs are
+// unchanged are kept, up to the first step that doesn't match: every later step depends on it.
+// Returns false if none of the progress can be used.
+func (a *archive) resume(saved *archiveState) bool {
+	if _, err := os.Stat(saved.WorkDir); err != nil {
+		log.Printf("Not resuming %q: work dir: %v", a.name, err)
+		return false
+	}
+	a.workDir = saved.WorkDir
+	for _, step := range saved.Steps {
+		if err := step.check(); err != nil {
+			log.Printf("Not resuming %q from step %q onward: %v", a.name, step.Name, err)
+			break
+		}
+		a.state.Steps = append(a.state.Steps, step)
+		if step.Name == repackStep {
+			a.repackedPath = saved.RepackedPath
+		}
+	}
+	if len(a.state.Steps) == 0 {
+		return true
+	}
+	var names []string
+	for _, step := range a.state.Steps {
+		names = append(names, step.Name)
+	}
+	log.Printf("Resuming %q: completed steps %v", a.name, names)
+	return true
+}
+
+// check returns an error if any output of the step is missing or has changed.
+func (c *completedStep) check() error {
+	for path, want := range c.Outputs {
+		sum, err := checksum.FileSHA256(path)
+		if err != nil {
+			return err
+		}
+		if sum != want {
+			return fmt.Errorf("output %q has changed", path)
+		}
+	}
+	return nil
+}
+
+// stepDone returns true if the step is already complete for a.
+func (a *archive) stepDone(name string) bool {
+	return slices.ContainsFunc(a.state.Steps, func(c *completedStep) bool {
+		return c.Name == name
+	})
+}
+
+// completeStep records that the step is complete for a and produced outputs.
+func (a *archive) completeStep(name string, outputs []string) error {
+	c := &completedStep{Name: name, Outputs: make(map[string]string, len(outputs))}
+	for _, p := range outputs {
+		sum, err := checksum.FileSHA256(p)
+		if err != nil {
+			return err
+		}
+		c.Outputs[p] = sum
+	}
+	a.state.Steps = append(a.state.Steps, c)
+	return nil
+}
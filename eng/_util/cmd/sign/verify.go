@@ -0,0 +1,358 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"debug/macho"
+	"debug/pe"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archivediff"
+	"github.com/microsoft/go/_util/internal/archiveutil"
+	"github.com/microsoft/go/_util/internal/linuxpkg"
+	"github.com/microsoft/go/_util/internal/wininstaller"
+)
+
+// lcCodeSignature is the Mach-O load command that locates the code signature.
+const lcCodeSignature macho.LoadCmd = 0x1d
+
+// verifyDestination checks the signed archive in the destination dir against the original.
+//
+// The signed archive must have the same entries as the original, with the same modes and
+// modification times. Entries that weren't selected for signing by entrySignInfo must have the
+// same content. A nested archive that contains entries to sign is checked the same way, entry by
+// entry. If embedded is true, the signer embeds signatures in the files it signs, so each
+// selected entry must also differ from the original and contain a signature: an Authenticode
+// certificate table for a PE file, or an LC_CODE_SIGNATURE load command for a Mach-O file.
+func (a *archive) verifyDestination(ctx context.Context, embedded bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	signed := filepath.Join(*destinationDir, a.name)
+	a.logf("Verifying %q against %q", signed, a.path)
+	if a.isPackage() {
+		return a.verifyPackageDestination(signed, embedded)
+	}
+	var nested map[string]string
+	if a.archiveType == zipArchive {
+		plan, err := a.planEntries(ctx, false)
+		if err != nil {
+			return err
+		}
+		nested = plan.nested
+	}
+
+	diff, err := archivediff.Compare(a.path, signed)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, e := range diff.Added {
+		errs = append(errs, fmt.Errorf("entry %q was added", e.Name))
+	}
+	for _, e := range diff.Removed {
+		errs = append(errs, fmt.Errorf("entry %q was removed", e.Name))
+	}
+	changed := make(map[string]bool)
+	for _, c := range diff.Modified {
+		if c.ModeChanged {
+			errs = append(errs, fmt.Errorf("entry %q mode changed from %v to %v", c.Name, c.Old.Mode, c.New.Mode))
+		}
+		if c.ModTimeChanged {
+			errs = append(errs, fmt.Errorf("entry %q modification time changed from %v to %v", c.Name, c.Old.ModTime, c.New.ModTime))
+		}
+		if c.LinknameChanged {
+			errs = append(errs, fmt.Errorf("entry %q link target changed from %q to %q", c.Name, c.Old.Linkname, c.New.Linkname))
+		}
+		if c.ContentChanged {
+			if _, ok := nested[c.Name]; ok {
+				// Checked entry by entry below.
+			} else if a.entrySignInfo(c.Name) == nil {
+				errs = append(errs, fmt.Errorf("entry %q isn't signed, but its content changed", c.Name))
+			}
+			changed[c.Name] = true
+		}
+	}
+
+	if len(nested) > 0 {
+		// Collect the original content of the nested archives to compare the signed ones to.
+		originals := make(map[string][]byte)
+		if err := archiveutil.EachArchiveEntry(a.path, func(e *archiveutil.Entry, r io.Reader) error {
+			if _, ok := nested[e.Name]; !ok || r == nil {
+				return nil
+			}
+			data, err := io.ReadAll(r)
+			originals[e.Name] = data
+			return err
+		}); err != nil {
+			return err
+		}
+		if err := archiveutil.EachArchiveEntry(signed, func(e *archiveutil.Entry, r io.Reader) error {
+			if _, ok := nested[e.Name]; !ok || r == nil {
+				return nil
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			errs = append(errs, a.verifyNested(e.Name, originals[e.Name], data, embedded)...)
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	if embedded {
+		var checked int
+		if err := archiveutil.EachArchiveEntry(signed, func(e *archiveutil.Entry, r io.Reader) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if r == nil || a.entrySignInfo(e.Name) == nil {
+				return nil
+			}
+			checked++
+			if !changed[e.Name] {
+				errs = append(errs, fmt.Errorf("entry %q should be signed, but its content is unchanged", e.Name))
+				return nil
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if err := checkEmbeddedSignature(data); err != nil {
+				errs = append(errs, fmt.Errorf("entry %q: %v", e.Name, err))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		a.logf("Checked the signatures of %v entries", checked)
+	} else {
+		a.logf("The signer doesn't embed signatures: skipping the signature check of signed entries")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("verification of %q failed: %w", signed, errors.Join(errs...))
+	}
+	a.logf("Verified %q", signed)
+	return nil
+}
+
+// nestedEntry is the metadata and content of an entry in a nested archive.
+type nestedEntry struct {
+	mode    fs.FileMode
+	modTime time.Time
+	data    []byte
+}
+
+// readNestedEntries returns the regular file entries of the archive data in the given format.
+func readNestedEntries(data []byte, format string) (map[string]nestedEntry, error) {
+	entries := make(map[string]nestedEntry)
+	err := eachNestedEntry(data, format, func(hdr *tar.Header, f *zip.File, r io.Reader) error {
+		var e nestedEntry
+		var name string
+		if f != nil {
+			if f.FileInfo().IsDir() {
+				return nil
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return err
+			}
+			defer rc.Close()
+			r = rc
+			name, e.mode, e.modTime = f.Name, f.Mode(), f.Modified
+		} else {
+			if !hdr.FileInfo().Mode().IsRegular() {
+				return nil
+			}
+			name, e.mode, e.modTime = hdr.Name, hdr.FileInfo().Mode(), hdr.ModTime
+		}
+		var err error
+		if e.data, err = io.ReadAll(r); err != nil {
+			return err
+		}
+		entries[name] = e
+		return nil
+	})
+	return entries, err
+}
+
+// verifyNested checks the signed copy of the nested archive name against the original data, and
+// returns the problems it finds. It applies the same checks as verifyDestination.
+func (a *archive) verifyNested(name string, original, signed []byte, embedded bool) []error {
+	format := a.plan.nested[name]
+	originalEntries, err := readNestedEntries(original, format)
+	if err != nil {
+		return []error{fmt.Errorf("failed to read original nested archive %q: %v", name, err)}
+	}
+	signedEntries, err := readNestedEntries(signed, format)
+	if err != nil {
+		return []error{fmt.Errorf("failed to read signed nested archive %q: %v", name, err)}
+	}
+	var errs []error
+	for _, innerName := range slices.Sorted(maps.Keys(signedEntries)) {
+		if _, ok := originalEntries[innerName]; !ok {
+			errs = append(errs, fmt.Errorf("entry %q was added", name+"/"+innerName))
+		}
+	}
+	for _, innerName := range slices.Sorted(maps.Keys(originalEntries)) {
+		o := originalEntries[innerName]
+		fullName := name + "/" + innerName
+		s, ok := signedEntries[innerName]
+		if !ok {
+			errs = append(errs, fmt.Errorf("entry %q was removed", fullName))
+			continue
+		}
+		if s.mode != o.mode {
+			errs = append(errs, fmt.Errorf("entry %q mode changed from %v to %v", fullName, o.mode, s.mode))
+		}
+		if !s.modTime.Equal(o.modTime) {
+			errs = append(errs, fmt.Errorf("entry %q modification time changed from %v to %v", fullName, o.modTime, s.modTime))
+		}
+		changed := !bytes.Equal(s.data, o.data)
+		if _, ok := a.plan.nested[fullName]; ok {
+			errs = append(errs, a.verifyNested(fullName, o.data, s.data, embedded)...)
+		} else if a.entrySignInfo(fullName) == nil {
+			if changed {
+				errs = append(errs, fmt.Errorf("entry %q isn't signed, but its content changed", fullName))
+			}
+		} else if embedded {
+			if !changed {
+				errs = append(errs, fmt.Errorf("entry %q should be signed, but its content is unchanged", fullName))
+			} else if err := checkEmbeddedSignature(s.data); err != nil {
+				errs = append(errs, fmt.Errorf("entry %q: %v", fullName, err))
+			}
+		}
+	}
+	return errs
+}
+
+// checkEmbeddedSignature returns an error if data is a PE or Mach-O file without a signature, or
+// if it's neither.
+func checkEmbeddedSignature(data []byte) error {
+	if pf, err := pe.NewFile(bytes.NewReader(data)); err == nil {
+		defer pf.Close()
+		var dirs []pe.DataDirectory
+		switch oh := pf.OptionalHeader.(type) {
+		case *pe.OptionalHeader32:
+			dirs = oh.DataDirectory[:min(int(oh.NumberOfRvaAndSizes), len(oh.DataDirectory))]
+		case *pe.OptionalHeader64:
+			dirs = oh.DataDirectory[:min(int(oh.NumberOfRvaAndSizes), len(oh.DataDirectory))]
+		}
+		if len(dirs) <= pe.IMAGE_DIRECTORY_ENTRY_SECURITY {
+			return errors.New("PE file has no certificate table entry")
+		}
+		if d := dirs[pe.IMAGE_DIRECTORY_ENTRY_SECURITY]; d.VirtualAddress == 0 || d.Size == 0 {
+			return errors.New("PE file has no Authenticode signature")
+		}
+		return nil
+	}
+	if mf, err := macho.NewFile(bytes.NewReader(data)); err == nil {
+		defer mf.Close()
+		for _, l := range mf.Loads {
+			raw := l.Raw()
+			if len(raw) >= 4 && macho.LoadCmd(mf.ByteOrder.Uint32(raw)) == lcCodeSignature {
+				return nil
+			}
+		}
+		return errors.New("Mach-O file has no LC_CODE_SIGNATURE load command")
+	}
+	return errors.New("not a PE or Mach-O file")
+}
+
+// verifyPackageDestination checks the signed package in the destination dir against the
+// original. Signing may only add a signature: a signature member for a Debian package, signature
+// header tags for an RPM package, or signature streams for a Windows Installer package. The rest
+// of the package must be unchanged. If embedded is true, the signed package must contain a
+// signature.
+func (a *archive) verifyPackageDestination(signed string, embedded bool) error {
+	var hasSignature bool
+	switch a.archiveType {
+	case debArchive:
+		original, err := linuxpkg.ReadDebMembers(a.path)
+		if err != nil {
+			return err
+		}
+		signedMembers, err := linuxpkg.ReadDebMembers(signed)
+		if err != nil {
+			return err
+		}
+		signedByName := make(map[string]linuxpkg.Member)
+		for _, m := range signedMembers {
+			signedByName[m.Name] = m
+			if linuxpkg.IsDebSignatureMember(m.Name) {
+				hasSignature = true
+			}
+		}
+		var errs []error
+		for _, m := range original {
+			if sm, ok := signedByName[m.Name]; !ok {
+				errs = append(errs, fmt.Errorf("member %q was removed", m.Name))
+			} else if sm != m {
+				errs = append(errs, fmt.Errorf("member %q changed", m.Name))
+			}
+			delete(signedByName, m.Name)
+		}
+		for name := range signedByName {
+			if !linuxpkg.IsDebSignatureMember(name) {
+				errs = append(errs, fmt.Errorf("member %q was added", name))
+			}
+		}
+		if len(errs) > 0 {
+			return fmt.Errorf("verification of %q failed: %w", signed, errors.Join(errs...))
+		}
+
+	case rpmArchive:
+		original, err := linuxpkg.ReadRPM(a.path)
+		if err != nil {
+			return err
+		}
+		signedInfo, err := linuxpkg.ReadRPM(signed)
+		if err != nil {
+			return err
+		}
+		if signedInfo.ContentSHA256 != original.ContentSHA256 {
+			return fmt.Errorf("verification of %q failed: the header or payload changed", signed)
+		}
+		hasSignature = signedInfo.Signed()
+
+	case msiArchive:
+		original, err := wininstaller.ReadMSI(a.path)
+		if err != nil {
+			return err
+		}
+		signedInfo, err := wininstaller.ReadMSI(signed)
+		if err != nil {
+			return err
+		}
+		if signedInfo.ContentSHA256 != original.ContentSHA256 {
+			return fmt.Errorf("verification of %q failed: a stream other than the signature changed", signed)
+		}
+		hasSignature = signedInfo.Signed()
+	}
+
+	if embedded && !hasSignature {
+		return fmt.Errorf("verification of %q failed: the package isn't signed", signed)
+	}
+	if !embedded {
+		a.logf("The signer doesn't embed signatures: skipping the signature check")
+	}
+	a.logf("Verified %q", signed)
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/wininstaller"
+)
+
+// createWindowsInstallers creates a Windows Installer package (.msi) from each Windows zip archive,
+// and returns them as archives to sign. The installers contain the signed
+// content of the archives, so this must run after the archives are repacked.
+//
+// Building an installer isn't reproducible, so a resumed run builds the installers again and
+// usually signs them from the beginning.
+func createWindowsInstallers(ctx context.Context, archives []*archive, saved *signState) ([]*archive, error) {
+	var windowsArchives []*archive
+	for _, a := range archives {
+		if matchOrPanic("go*.windows-*.zip", a.name) {
+			windowsArchives = append(windowsArchives, a)
+		}
+	}
+	if len(windowsArchives) == 0 {
+		return nil, errors.New("no Windows archives found to create installers from")
+	}
+
+	dir := filepath.Join(*tempDir, "windows-installers")
+	if err := os.MkdirAll(dir, 0o777); err != nil {
+		return nil, err
+	}
+	installerPaths, err := flatMapArchives(ctx, windowsArchives, func(a *archive, ctx context.Context) ([]string, error) {
+		m, err := wininstaller.MetadataFromArchive(a.path, *installerRevision)
+		if err != nil {
+			return nil, err
+		}
+		p := filepath.Join(dir, strings.TrimSuffix(a.name, ".zip")+".msi")
+		workDir := filepath.Join(a.workDir, "installer")
+		// Start from an empty work dir in case an earlier run left a payload behind.
+		if err := os.RemoveAll(workDir); err != nil {
+			return nil, err
+		}
+		a.logf("Creating installer %q from %q", p, a.latestPath())
+		if err := wininstaller.Build(ctx, *wixPath, a.latestPath(), workDir, p, m); err != nil {
+			return nil, fmt.Errorf("failed to create %q: %v", p, err)
+		}
+		return []string{p}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var installers []*archive
+	for _, p := range installerPaths {
+		a, err := newArchive(p, saved)
+		if err != nil {
+			return nil, fmt.Errorf("failed to process %q: %v", p, err)
+		}
+		installers = append(installers, a)
+	}
+	return installers, nil
+}
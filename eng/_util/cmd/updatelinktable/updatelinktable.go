@@ -79,6 +79,12 @@ var windowsFiles = []goFileType{
 		Ext:      ".zip",
 		Checksum: true,
 	},
+	{
+		Kind:     supportdata.Installer,
+		Name:     "Installer (msi)",
+		Ext:      ".msi",
+		Checksum: true,
+	},
 }
 
 var sourceFiles = []goFileType{
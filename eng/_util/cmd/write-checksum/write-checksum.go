@@ -5,23 +5,63 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/microsoft/go/_util/internal/checksum"
 )
 
 const description = `
-This command creates a SHA256 checksum file for the given files, in the same
-location and with the same name as each given file but with ".sha256" added to
-the end. Pass files as non-flag arguments.
+This command creates a checksum file for the given files, in the same location
+and with the same name as each given file but with an algorithm-specific
+extension such as ".sha256" added to the end. Pass files as non-flag arguments.
+Each file is read once, no matter how many algorithms are used.
 
-Generated files are compatible with "sha256sum -c".
+Supported algorithms and their extensions are: sha256 (".sha256"), sha512
+(".sha512"), and sha3-256 (".sha3-256").
+
+With -manifest, also writes one combined manifest per algorithm to the given
+directory, such as "SHA256SUMS", listing each file by its path relative to the
+directory. If no files are passed, every file in the directory and its
+subdirectories is listed, except existing checksum files.
+
+Generated files are compatible with "sha256sum -c" and similar tools.
+
+To check existing checksum files instead, use the "verify" subcommand. Pass
+"verify -h" for details. The -verify flag is an alias for "verify".
+
+Example: Write SHA256 and SHA512 sidecars and manifests for a dir:
+
+  eng/run.ps1 write-checksum -algorithms sha256,sha512 -nosidecar -manifest eng/artifacts/bin
+
+Example: Check downloaded files:
+
+  eng/run.ps1 write-checksum verify SHA256SUMS go.linux-amd64.tar.gz
+`
+
+const verifyDescription = `
+Checks the given checksum files. A sidecar (e.g. "go.zip.sha256") or manifest
+(e.g. "SHA256SUMS") is checked directly. For any other file, its existing
+sidecars are checked. Lines may use the text format ("<hex>  <name>") written by
+this command and "sha256sum", the binary format ("<hex> *<name>"), or the BSD
+format ("SHA256 (<name>) = <hex>"). File names in a checksum file are relative
+to the dir containing the checksum file.
+
+Files are hashed in parallel, and each file is read once even if it's listed by
+multiple checksum files. Prints the result for each file like "sha256sum -c",
+then the details of each problem. Exits nonzero if any file is missing,
+unreadable, or doesn't match, or if any line of a checksum file is malformed.
 `
 
 func main() {
 	help := flag.Bool("h", false, "Print this help message.")
+	algorithms := flag.String("algorithms", "sha256", "Comma-separated list of checksum algorithms to write: sha256, sha512, sha3-256.")
+	manifestDir := flag.String("manifest", "", "Write a combined manifest for each algorithm to this dir.")
+	noSidecar := flag.Bool("nosidecar", false, "Don't write a checksum file next to each file.")
+	verify := flag.Bool("verify", false, "Check existing checksum files rather than writing new ones. Alias for the \"verify\" subcommand.")
 
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage:\n")
@@ -29,18 +69,144 @@ func main() {
 		fmt.Fprintf(flag.CommandLine.Output(), "%s\n", description)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "verify" {
+		verifyCommand(os.Args[2:])
+		return
+	}
+
 	flag.Parse()
 	if *help {
 		flag.Usage()
 		return
 	}
-	if flag.NArg() == 0 {
+
+	if *verify {
+		verifyCommand(flag.Args())
+		return
+	}
+
+	algs, err := checksum.ParseAlgorithms(*algorithms)
+	if err != nil {
+		log.Fatal(err)
+	}
+	files := flag.Args()
+	if len(files) == 0 && *manifestDir != "" {
+		if files, err = checksum.ManifestFiles(*manifestDir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(files) == 0 {
 		flag.Usage()
 		log.Fatal("No files specified.")
 	}
-	for _, m := range flag.Args() {
-		if err := checksum.WriteSHA256ChecksumFile(m); err != nil {
-			log.Fatal(err)
+	if *noSidecar && *manifestDir == "" {
+		log.Fatal("Nothing to write: -nosidecar requires -manifest.")
+	}
+	if err := checksum.Write(files, &checksum.WriteOptions{
+		Algorithms:  algs,
+		NoSidecars:  *noSidecar,
+		ManifestDir: *manifestDir,
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func verifyCommand(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	help := fs.Bool("h", false, "Print this help message.")
+	jobs := fs.Int("j", 0, "Maximum number of files to hash at once. Defaults to the number of CPUs.")
+	quiet := fs.Bool("quiet", false, "Don't print a line for each file that matches.")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of verify:\n")
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "%s\n", verifyDescription)
+	}
+
+	fs.Parse(args)
+	if *help {
+		fs.Usage()
+		return
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		log.Fatal("No checksum files specified.")
+	}
+	ok, err := verifyFiles(fs.Args(), *jobs, *quiet)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// verifyFiles checks the given checksum files, or the sidecars of the given files, and prints the
+// results in the style of "sha256sum -c" followed by the details of each problem. Returns false if
+// any check failed or any checksum file has a malformed line.
+func verifyFiles(args []string, jobs int, quiet bool) (bool, error) {
+	var entries []checksum.Entry
+	var malformed []error
+	for _, arg := range args {
+		checksumFiles := []string{arg}
+		if !checksum.IsChecksumFile(arg) {
+			var err error
+			if checksumFiles, err = checksum.Sidecars(arg); err != nil {
+				return false, err
+			}
+			if len(checksumFiles) == 0 {
+				return false, fmt.Errorf("no checksum files found for %q", arg)
+			}
 		}
+		for _, c := range checksumFiles {
+			e, m, err := checksum.ReadChecksumFile(c)
+			if err != nil {
+				return false, err
+			}
+			if len(e) == 0 && len(m) == 0 {
+				malformed = append(malformed, fmt.Errorf("%v: no checksum lines found", c))
+			}
+			entries = append(entries, e...)
+			malformed = append(malformed, m...)
+		}
+	}
+
+	var mismatched, missing, unreadable []checksum.Result
+	for _, r := range checksum.Verify(entries, jobs) {
+		switch {
+		case r.Err == nil:
+			if !quiet {
+				fmt.Printf("%v: OK\n", r.Path)
+			}
+			continue
+		case errors.Is(r.Err, checksum.ErrMismatch):
+			mismatched = append(mismatched, r)
+		case errors.Is(r.Err, os.ErrNotExist):
+			missing = append(missing, r)
+		default:
+			unreadable = append(unreadable, r)
+		}
+		fmt.Printf("%v: FAILED\n", r.Path)
+	}
+
+	for _, r := range mismatched {
+		fmt.Fprintf(os.Stderr, "MISMATCH: %v (%v:%v)\n  %v expected: %v\n  %v actual:   %v\n",
+			r.Path, r.ChecksumFile, r.Line, r.Algorithm.Name, r.Sum, r.Algorithm.Name, r.Actual)
+	}
+	for _, r := range missing {
+		fmt.Fprintf(os.Stderr, "MISSING: %v (%v:%v)\n", r.Path, r.ChecksumFile, r.Line)
+	}
+	for _, r := range unreadable {
+		fmt.Fprintf(os.Stderr, "UNREADABLE: %v (%v:%v): %v\n", r.Path, r.ChecksumFile, r.Line, r.Err)
+	}
+	for _, err := range malformed {
+		fmt.Fprintf(os.Stderr, "MALFORMED: %v\n", err)
+	}
+
+	if n := len(mismatched) + len(missing) + len(unreadable) + len(malformed); n > 0 {
+		fmt.Fprintf(os.Stderr, "Checked %v checksums: %v mismatched, %v missing, %v unreadable; %v malformed lines\n",
+			len(entries), len(mismatched), len(missing), len(unreadable), len(malformed))
+		return false, nil
 	}
+	fmt.Printf("Checked %v checksums: all OK\n", len(entries))
+	return true, nil
 }
@@ -4,7 +4,7 @@
 
 module github.com/microsoft/go/_util
 
-go 1.22.0
+go 1.24.0
 
 require (
 	github.com/microsoft/go-infra v0.0.7-0.20250217095817-3d02b2f77127
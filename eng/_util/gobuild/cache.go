@@ -0,0 +1,383 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/sbom"
+)
+
+// cacheEnvVars are environment variables that affect the output of make.bash, so they are part
+// of the cache key.
+var cacheEnvVars = []string{
+	"GOEXPERIMENT",
+	"CGO_ENABLED",
+	"GOARM",
+	"GOAMD64",
+	"GO386",
+	"GOARM64",
+	"GO_GCFLAGS",
+	"GO_LDFLAGS",
+	"CC",
+	"CXX",
+}
+
+// cacheCompleteFile is written into a cache entry after everything else, so a partially written
+// entry is never restored.
+const cacheCompleteFile = "cache-key.json"
+
+// buildCacheKey is the set of inputs that determines the output of the make phase.
+type buildCacheKey struct {
+	TargetOS   string `json:"targetOS"`
+	TargetArch string `json:"targetArch"`
+	// SubmoduleCommit is the commit checked out in the go submodule.
+	SubmoduleCommit string `json:"submoduleCommit"`
+	// SubmoduleDiff is the hash of the uncommitted changes in the go submodule, including applied
+	// patches and any local edits.
+	SubmoduleDiff string `json:"submoduleDiff"`
+	// Patches maps each patch file name to its SHA256 hash.
+	Patches map[string]string `json:"patches"`
+	// Env has the value of each of cacheEnvVars that is set.
+	Env map[string]string `json:"env"`
+	// Stage0Version is the VERSION of the Go toolchain used to bootstrap the build, if known.
+	Stage0Version string `json:"stage0Version,omitempty"`
+	// RaceRuntime is true if the race runtime is built.
+	RaceRuntime bool `json:"raceRuntime"`
+}
+
+// hash returns a hex string that identifies k.
+func (k *buildCacheKey) hash() (string, error) {
+	// encoding/json sorts map keys, so this is deterministic.
+	data, err := json.Marshal(k)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// newBuildCacheKey calculates the cache key for the current state of the repository at rootDir.
+func newBuildCacheKey(rootDir, targetOS, targetArch string, race bool) (*buildCacheKey, error) {
+	goRootDir := filepath.Join(rootDir, "go")
+	k := &buildCacheKey{
+		TargetOS:    targetOS,
+		TargetArch:  targetArch,
+		Patches:     make(map[string]string),
+		RaceRuntime: race,
+	}
+
+	commit, err := gitOutput(goRootDir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	k.SubmoduleCommit = strings.TrimSpace(commit)
+
+	diff, err := gitOutput(goRootDir, "diff", "--binary", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	// Untracked files are part of the build too, e.g. new files added by patches.
+	untracked, err := gitOutput(goRootDir, "ls-files", "-z", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	io.WriteString(h, diff)
+	for _, name := range strings.Split(untracked, "\x00") {
+		if name == "" {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(goRootDir, name))
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(h, "%v\x00%v\x00", name, len(data))
+		h.Write(data)
+	}
+	k.SubmoduleDiff = hex.EncodeToString(h.Sum(nil))
+
+	patches, err := sbom.ReadPatches(filepath.Join(rootDir, "patches"))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range patches {
+		k.Patches[p.Name] = p.SHA256
+	}
+
+	k.Env = buildEnv()
+	k.Stage0Version = stage0Version()
+	return k, nil
+}
+
+// buildEnv returns the value of each of cacheEnvVars that is set.
+func buildEnv() map[string]string {
+	env := make(map[string]string)
+	for _, name := range cacheEnvVars {
+		if v, ok := os.LookupEnv(name); ok {
+			env[name] = v
+		}
+	}
+	return env
+}
+
+// stage0Version returns the first line of the VERSION file of the Go toolchain in STAGE_0_GOROOT,
+// or "" if it isn't known.
+func stage0Version() string {
+	stage0 := os.Getenv("STAGE_0_GOROOT")
+	if stage0 == "" {
+		return ""
+	}
+	data, err := os.ReadFile(filepath.Join(stage0, "VERSION"))
+	if err != nil {
+		return ""
+	}
+	v, _, _ := strings.Cut(string(data), "\n")
+	return v
+}
+
+// cachedDirs are the dirs in GOROOT that the make phase produces, relative to GOROOT. Other dirs
+// in pkg, such as the archives in pkg/distpack, aren't part of the make output.
+var cachedDirs = []string{"bin", "pkg/tool", "pkg/include"}
+
+// generatedSrcDir is the dir, relative to GOROOT, of the source files the make phase generates,
+// such as src/internal/buildcfg/zbootstrap.go and src/go/build/zcgo.go. They're saved in a cache
+// entry along with cachedDirs: a clean submodule doesn't have them, and distpack packs them.
+const generatedSrcDir = "src"
+
+// defaultMaxCacheEntries is the number of entries a build cache keeps by default. Each entry is a
+// whole toolchain, so old ones are evicted rather than kept forever.
+const defaultMaxCacheEntries = 4
+
+// buildCache stores the dirs produced by the make phase, keyed by buildCacheKey.
+type buildCache struct {
+	dir string
+	// maxEntries is the number of entries to keep. When a save goes over, the least recently used
+	// entries are evicted.
+	maxEntries int
+}
+
+func (c *buildCache) entryDir(hash string) string {
+	return filepath.Join(c.dir, hash)
+}
+
+// restore copies the cached dirs for key into goRootDir, replacing the existing ones, and the
+// cached generated source files. Returns false if there is no complete cache entry for key.
+func (c *buildCache) restore(key *buildCacheKey, goRootDir string) (bool, error) {
+	hash, err := key.hash()
+	if err != nil {
+		return false, err
+	}
+	entry := c.entryDir(hash)
+	if _, err := os.Stat(filepath.Join(entry, cacheCompleteFile)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("---- Build cache miss: %v\n", hash)
+			return false, nil
+		}
+		return false, err
+	}
+	// Entries saved before generated source files were cached can't restore a complete GOROOT.
+	if _, err := os.Stat(filepath.Join(entry, generatedSrcDir)); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("---- Build cache miss: %v has no generated source files\n", hash)
+			return false, nil
+		}
+		return false, err
+	}
+	fmt.Printf("---- Build cache hit: restoring %v\n", entry)
+	for _, d := range cachedDirs {
+		d = filepath.FromSlash(d)
+		if err := os.RemoveAll(filepath.Join(goRootDir, d)); err != nil {
+			return false, err
+		}
+		if err := copyTree(filepath.Join(goRootDir, d), filepath.Join(entry, d)); err != nil {
+			return false, fmt.Errorf("failed to restore %v from build cache: %v", d, err)
+		}
+	}
+	// The generated files go into the existing source tree, so copy them over it.
+	if err := copyTree(filepath.Join(goRootDir, generatedSrcDir), filepath.Join(entry, generatedSrcDir)); err != nil {
+		return false, fmt.Errorf("failed to restore generated source files from build cache: %v", err)
+	}
+	// Mark the entry as recently used, so eviction keeps it.
+	now := time.Now()
+	if err := os.Chtimes(filepath.Join(entry, cacheCompleteFile), now, now); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// save copies the cached dirs and the generated source files from goRootDir into the cache entry
+// for key, then evicts the least recently used entries over maxEntries.
+func (c *buildCache) save(key *buildCacheKey, goRootDir string) error {
+	hash, err := key.hash()
+	if err != nil {
+		return err
+	}
+	entry := c.entryDir(hash)
+	fmt.Printf("---- Saving build to cache: %v\n", entry)
+	// Start over in case an earlier attempt was interrupted.
+	if err := os.RemoveAll(entry); err != nil {
+		return err
+	}
+	for _, d := range cachedDirs {
+		d = filepath.FromSlash(d)
+		if err := copyTree(filepath.Join(entry, d), filepath.Join(goRootDir, d)); err != nil {
+			return fmt.Errorf("failed to save %v to build cache: %v", d, err)
+		}
+	}
+	generated, err := generatedSrcFiles(goRootDir)
+	if err != nil {
+		return err
+	}
+	if len(generated) == 0 {
+		return fmt.Errorf("no generated source files in %v", filepath.Join(goRootDir, generatedSrcDir))
+	}
+	for _, name := range generated {
+		name = filepath.FromSlash(name)
+		info, err := os.Stat(filepath.Join(goRootDir, name))
+		if err != nil {
+			return err
+		}
+		if err := copyFile(filepath.Join(entry, name), filepath.Join(goRootDir, name)); err != nil {
+			return fmt.Errorf("failed to save %v to build cache: %v", name, err)
+		}
+		if err := os.Chmod(filepath.Join(entry, name), info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(key, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(entry, cacheCompleteFile), append(data, '\n'), 0o666); err != nil {
+		return err
+	}
+	return c.evict()
+}
+
+// generatedSrcFiles returns the paths of the files in the generatedSrcDir of goRootDir that git
+// ignores, relative to goRootDir. These are the ones the make phase generates: upstream's
+// .gitignore lists them.
+func generatedSrcFiles(goRootDir string) ([]string, error) {
+	out, err := gitOutput(goRootDir, "ls-files", "-z", "--others", "--ignored", "--exclude-standard", "--", generatedSrcDir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, name := range strings.Split(out, "\x00") {
+		if name != "" {
+			files = append(files, name)
+		}
+	}
+	return files, nil
+}
+
+// isEntryName reports whether name is the name of a cache entry: a buildCacheKey hash.
+func isEntryName(name string) bool {
+	b, err := hex.DecodeString(name)
+	return err == nil && len(b) == sha256.Size && name == strings.ToLower(name)
+}
+
+// evict removes the least recently used complete entries over maxEntries, and any incomplete
+// entries left by interrupted saves. Only dirs named like entries are considered: the cache dir
+// may be shared with other files.
+func (c *buildCache) evict() error {
+	dirs, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	type usedEntry struct {
+		path string
+		used time.Time
+	}
+	var entries []usedEntry
+	for _, d := range dirs {
+		if !d.IsDir() || !isEntryName(d.Name()) {
+			continue
+		}
+		p := filepath.Join(c.dir, d.Name())
+		info, err := os.Stat(filepath.Join(p, cacheCompleteFile))
+		if errors.Is(err, fs.ErrNotExist) {
+			fmt.Printf("---- Removing incomplete build cache entry: %v\n", p)
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		entries = append(entries, usedEntry{p, info.ModTime()})
+	}
+	// Most recently used first.
+	slices.SortFunc(entries, func(a, b usedEntry) int {
+		return b.used.Compare(a.used)
+	})
+	maxEntries := cmp.Or(c.maxEntries, defaultMaxCacheEntries)
+	for _, e := range entries[min(maxEntries, len(entries)):] {
+		fmt.Printf("---- Evicting build cache entry: %v\n", e.path)
+		if err := os.RemoveAll(e.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyTree copies the directory src to dst, keeping file modes and symlinks.
+func copyTree(dst, src string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			if err := copyFile(target, path); err != nil {
+				return err
+			}
+			return os.Chmod(target, info.Mode().Perm())
+		}
+		return fmt.Errorf("unexpected file type %v: %v", d.Type(), path)
+	})
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %v failed: %v", strings.Join(args, " "), err)
+	}
+	return string(out), nil
+}
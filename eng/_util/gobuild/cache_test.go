@@ -0,0 +1,227 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestGoRoot returns a git repo with a minimal GOROOT source tree and a .gitignore like
+// upstream's, listing a generated source file.
+func newTestGoRoot(t *testing.T) string {
+	t.Helper()
+	goRootDir := t.TempDir()
+	writeTestFile(t, goRootDir, ".gitignore", "/bin/\n/pkg/\n/src/internal/buildcfg/zbootstrap.go\n", 0o644)
+	writeTestFile(t, goRootDir, "src/internal/buildcfg/cfg.go", "package buildcfg\n", 0o644)
+	cmd := exec.Command("git", "init", "-q")
+	cmd.Dir = goRootDir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git init failed: %v\n%s", err, out)
+	}
+	return goRootDir
+}
+
+// writeTestFile writes content to the slash-separated path name in dir, creating parent dirs.
+func writeTestFile(t *testing.T, dir, name, content string, perm os.FileMode) {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(p, []byte(content), perm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestMakeOutput writes the files the make phase would produce into goRootDir.
+func writeTestMakeOutput(t *testing.T, goRootDir string) {
+	t.Helper()
+	writeTestFile(t, goRootDir, "bin/go", "go binary", 0o755)
+	writeTestFile(t, goRootDir, "pkg/tool/linux_amd64/compile", "compile binary", 0o755)
+	writeTestFile(t, goRootDir, "pkg/include/textflag.h", "header", 0o644)
+	writeTestFile(t, goRootDir, "src/internal/buildcfg/zbootstrap.go", "package buildcfg // generated\n", 0o644)
+}
+
+func TestBuildCacheRoundTrip(t *testing.T) {
+	goRootDir := newTestGoRoot(t)
+	write := func(name, content string, perm os.FileMode) {
+		t.Helper()
+		writeTestFile(t, goRootDir, name, content, perm)
+	}
+	writeTestMakeOutput(t, goRootDir)
+	write("pkg/distpack/go1.24.1.linux-amd64.tar.gz", "old archive", 0o644)
+
+	c := &buildCache{dir: t.TempDir()}
+	key := &buildCacheKey{TargetOS: "linux", TargetArch: "amd64", SubmoduleCommit: "abc"}
+
+	if ok, err := c.restore(key, goRootDir); err != nil || ok {
+		t.Fatalf("restore from empty cache = %v, %v; want false, nil", ok, err)
+	}
+	if err := c.save(key, goRootDir); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := key.hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only the make output is cached, not other dirs in pkg.
+	if _, err := os.Stat(filepath.Join(c.entryDir(hash), "pkg", "distpack")); !os.IsNotExist(err) {
+		t.Errorf("pkg/distpack is in the cache entry: %v", err)
+	}
+
+	// Changing the output and restoring should bring back the saved content.
+	write("bin/go", "modified", 0o755)
+	write("bin/extra", "extra", 0o644)
+	if ok, err := c.restore(key, goRootDir); err != nil || !ok {
+		t.Fatalf("restore = %v, %v; want true, nil", ok, err)
+	}
+	data, err := os.ReadFile(filepath.Join(goRootDir, "bin", "go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "go binary" {
+		t.Errorf("bin/go = %q, want %q", data, "go binary")
+	}
+	if _, err := os.Stat(filepath.Join(goRootDir, "bin", "extra")); !os.IsNotExist(err) {
+		t.Errorf("bin/extra exists after restore: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(goRootDir, "pkg", "distpack", "go1.24.1.linux-amd64.tar.gz")); err != nil {
+		t.Errorf("restore changed pkg/distpack: %v", err)
+	}
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(filepath.Join(goRootDir, "pkg", "tool", "linux_amd64", "compile"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0o755 {
+			t.Errorf("compile mode = %v, want %v", info.Mode().Perm(), os.FileMode(0o755))
+		}
+	}
+
+	// A different key must not hit the same entry.
+	other := *key
+	other.TargetArch = "arm64"
+	if ok, err := c.restore(&other, goRootDir); err != nil || ok {
+		t.Errorf("restore with different key = %v, %v; want false, nil", ok, err)
+	}
+}
+
+// TestBuildCacheRestoreCleanTree restores a cache entry into a source tree that has never been
+// built, such as after -refresh. The result must have everything the make phase produces.
+func TestBuildCacheRestoreCleanTree(t *testing.T) {
+	builtDir := newTestGoRoot(t)
+	writeTestMakeOutput(t, builtDir)
+	c := &buildCache{dir: t.TempDir()}
+	key := &buildCacheKey{TargetOS: "linux", TargetArch: "amd64", SubmoduleCommit: "abc"}
+	if err := c.save(key, builtDir); err != nil {
+		t.Fatal(err)
+	}
+
+	cleanDir := newTestGoRoot(t)
+	if ok, err := c.restore(key, cleanDir); err != nil || !ok {
+		t.Fatalf("restore = %v, %v; want true, nil", ok, err)
+	}
+	for _, name := range []string{"bin/go", "pkg/tool/linux_amd64/compile", "pkg/include/textflag.h", "src/internal/buildcfg/zbootstrap.go", "src/internal/buildcfg/cfg.go"} {
+		want, err := os.ReadFile(filepath.Join(builtDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.ReadFile(filepath.Join(cleanDir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Errorf("%v not restored: %v", name, err)
+			continue
+		}
+		if string(got) != string(want) {
+			t.Errorf("%v = %q, want %q", name, got, want)
+		}
+	}
+	generated, err := generatedSrcFiles(cleanDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(generated, ",") != "src/internal/buildcfg/zbootstrap.go" {
+		t.Errorf("generated source files after restore = %v", generated)
+	}
+
+	// An entry without the generated source files, saved by an older version, is a miss.
+	hash, err := key.hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(filepath.Join(c.entryDir(hash), generatedSrcDir)); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.restore(key, newTestGoRoot(t)); err != nil || ok {
+		t.Errorf("restore of entry without generated files = %v, %v; want false, nil", ok, err)
+	}
+}
+
+func TestBuildCacheEviction(t *testing.T) {
+	goRootDir := newTestGoRoot(t)
+	writeTestMakeOutput(t, goRootDir)
+	c := &buildCache{dir: t.TempDir(), maxEntries: 2}
+	var keys []*buildCacheKey
+	for _, commit := range []string{"a", "b", "c"} {
+		keys = append(keys, &buildCacheKey{TargetOS: "linux", TargetArch: "amd64", SubmoduleCommit: commit})
+	}
+	setUsed := func(k *buildCacheKey, used time.Time) {
+		t.Helper()
+		hash, err := k.hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(filepath.Join(c.entryDir(hash), cacheCompleteFile), used, used); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, k := range keys[:2] {
+		if err := c.save(k, goRootDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "a" was saved first, but restoring it makes it more recently used than "b".
+	past := time.Now().Add(-time.Hour)
+	setUsed(keys[0], past)
+	setUsed(keys[1], past.Add(time.Minute))
+	if ok, err := c.restore(keys[0], goRootDir); err != nil || !ok {
+		t.Fatalf("restore = %v, %v; want true, nil", ok, err)
+	}
+	// An interrupted save leaves an incomplete entry.
+	incomplete := filepath.Join(c.dir, strings.Repeat("0", 64))
+	if err := os.MkdirAll(filepath.Join(incomplete, "bin"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	// Dirs the cache didn't create must be left alone, even without the completion file.
+	other := filepath.Join(c.dir, "bin")
+	if err := os.MkdirAll(other, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(keys[2], goRootDir); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, want := range []bool{true, false, true} {
+		ok, err := c.restore(keys[i], goRootDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("restore %v = %v, want %v", keys[i].SubmoduleCommit, ok, want)
+		}
+	}
+	if _, err := os.Stat(incomplete); !os.IsNotExist(err) {
+		t.Errorf("incomplete entry wasn't removed: %v", err)
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("dir not created by the cache was removed: %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+// distpackFile is an archive in pkg/distpack, described by metadata parsed from its name.
+type distpackFile struct {
+	Name    string
+	Version string
+	// Source is true for the source archive. Otherwise, this is a binary archive for Target.
+	Source bool
+	Target Target
+}
+
+func (f *distpackFile) String() string {
+	if f.Source {
+		return fmt.Sprintf("%v (source, version %v)", f.Name, f.Version)
+	}
+	return fmt.Sprintf("%v (binary, version %v, %v)", f.Name, f.Version, f.Target)
+}
+
+// parseDistpackName parses the name of a file created by distpack. Returns false if the name
+// isn't a source or binary archive, e.g. the module zip and metadata files.
+func parseDistpackName(name string) (*distpackFile, bool) {
+	// Module files are named e.g. "v0.0.1-go1.21.0.linux-amd64.zip".
+	if strings.HasPrefix(name, "v0.0.1-") {
+		return nil, false
+	}
+	var base string
+	if b, ok := strings.CutSuffix(name, ".tar.gz"); ok {
+		base = b
+		if version, ok := strings.CutSuffix(base, ".src"); ok && version != "" {
+			return &distpackFile{Name: name, Version: version, Source: true}, true
+		}
+	} else if b, ok := strings.CutSuffix(name, ".zip"); ok {
+		base = b
+	} else {
+		return nil, false
+	}
+	i := strings.LastIndexByte(base, '.')
+	if i <= 0 {
+		return nil, false
+	}
+	goos, goarch, ok := strings.Cut(base[i+1:], "-")
+	if !ok || goos == "" || goarch == "" {
+		return nil, false
+	}
+	return &distpackFile{Name: name, Version: base[:i], Target: Target{OS: goos, Arch: goarch}}, true
+}
+
+// readDistpackDir parses the names of the archives in dir, sorted by name.
+func readDistpackDir(dir string) ([]*distpackFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []*distpackFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		if f, ok := parseDistpackName(e.Name()); ok {
+			files = append(files, f)
+		}
+	}
+	return files, nil
+}
+
+// findDistpackArchive finds the archive distpack produced in dir for version. If source is
+// false, it finds the binary archive for t. If there's no match, the error lists what distpack
+// produced and what was expected.
+func findDistpackArchive(dir, version string, source bool, t Target) (string, error) {
+	files, err := readDistpackDir(dir)
+	if err != nil {
+		return "", err
+	}
+	var matches []*distpackFile
+	for _, f := range files {
+		if f.Source == source && f.Version == version && (source || f.Target == t) {
+			matches = append(matches, f)
+		}
+	}
+	var expected string
+	if source {
+		expected = fmt.Sprintf("source archive for version %v", version)
+	} else {
+		expected = fmt.Sprintf("binary archive for version %v, %v", version, t)
+	}
+	if len(matches) == 1 {
+		fmt.Printf("---- Found distpack %v: %v\n", expected, matches[0].Name)
+		return filepath.Join(dir, matches[0].Name), nil
+	}
+
+	var b strings.Builder
+	if len(matches) == 0 {
+		fmt.Fprintf(&b, "distpack didn't produce the expected %v", expected)
+	} else {
+		fmt.Fprintf(&b, "distpack produced %v archives matching the expected %v", len(matches), expected)
+	}
+	if len(files) == 0 {
+		fmt.Fprintf(&b, "; %v contains no recognized archives", dir)
+	} else {
+		fmt.Fprintf(&b, "; %v contains:", dir)
+		for _, f := range files {
+			fmt.Fprintf(&b, "\n  %v", f)
+		}
+	}
+	return "", errors.New(b.String())
+}
+
+// checkDistpackArchive checks that the layout of the archive at path is what we expect from
+// distpack: everything inside a top-level "go/" dir, and a VERSION file. A binary archive for t
+// must also contain the go command and the tool dir for t. A source archive must contain src.
+func checkDistpackArchive(path string, source bool, t Target) error {
+	required := []string{"go/VERSION"}
+	var requiredPrefixes []string
+	if source {
+		requiredPrefixes = append(requiredPrefixes, "go/src/")
+	} else {
+		exe := ""
+		if t.OS == "windows" {
+			exe = ".exe"
+		}
+		required = append(required, "go/bin/go"+exe)
+		requiredPrefixes = append(requiredPrefixes, "go/pkg/tool/"+t.OS+"_"+t.Arch+"/")
+	}
+
+	found := make(map[string]bool)
+	var problems []string
+	err := archiveutil.EachArchiveEntry(path, func(e *archiveutil.Entry, r io.Reader) error {
+		if !strings.HasPrefix(e.Name, "go/") {
+			problems = append(problems, fmt.Sprintf("entry %q is outside the top-level go/ dir", e.Name))
+			return nil
+		}
+		if slices.Contains(required, e.Name) {
+			found[e.Name] = true
+		}
+		for _, p := range requiredPrefixes {
+			if strings.HasPrefix(e.Name, p) {
+				found[p] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to read %v: %v", path, err)
+	}
+	for _, name := range required {
+		if !found[name] {
+			problems = append(problems, fmt.Sprintf("missing %v", name))
+		}
+	}
+	for _, p := range requiredPrefixes {
+		if !found[p] {
+			problems = append(problems, fmt.Sprintf("missing %v", p))
+		}
+	}
+	if len(problems) > 0 {
+		// Cap the output: an archive with the wrong layout may have thousands of bad entries.
+		const maxProblems = 10
+		if len(problems) > maxProblems {
+			problems = append(problems[:maxProblems], fmt.Sprintf("... and %v more problems", len(problems)-maxProblems))
+		}
+		return fmt.Errorf("unexpected layout in %v:\n  %v", path, strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+func TestParseDistpackName(t *testing.T) {
+	tests := []struct {
+		name string
+		want *distpackFile
+	}{
+		{"go1.23.1.src.tar.gz", &distpackFile{Name: "go1.23.1.src.tar.gz", Version: "go1.23.1", Source: true}},
+		{"go1.23.1.linux-amd64.tar.gz", &distpackFile{Name: "go1.23.1.linux-amd64.tar.gz", Version: "go1.23.1", Target: Target{"linux", "amd64"}}},
+		{"go1.23-abc123.windows-arm64.zip", &distpackFile{Name: "go1.23-abc123.windows-arm64.zip", Version: "go1.23-abc123", Target: Target{"windows", "arm64"}}},
+		{"v0.0.1-go1.23.1.linux-amd64.zip", nil},
+		{"v0.0.1-go1.23.1.linux-amd64.mod", nil},
+		{"go1.23.1.linux-amd64.tar.gz.sha256", nil},
+		{"linux-amd64.tar.gz", nil},
+	}
+	for _, tt := range tests {
+		got, ok := parseDistpackName(tt.name)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseDistpackName(%q) = %v, %v; want %v", tt.name, got, ok, tt.want)
+		}
+	}
+}
+
+func TestFindDistpackArchive(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{
+		"go1.23.1.src.tar.gz",
+		"go1.23.1.linux-amd64.tar.gz",
+		"v0.0.1-go1.23.1.linux-amd64.zip",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := findDistpackArchive(dir, "go1.23.1", false, Target{"linux", "amd64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "go1.23.1.linux-amd64.tar.gz"); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := findDistpackArchive(dir, "go1.23.1", true, Target{}); err != nil {
+		t.Error(err)
+	}
+
+	_, err = findDistpackArchive(dir, "go1.23.1", false, Target{"linux", "arm64"})
+	if err == nil {
+		t.Fatal("expected error for missing target")
+	}
+	// The error should list what was produced.
+	if !strings.Contains(err.Error(), "go1.23.1.linux-amd64.tar.gz (binary, version go1.23.1, linux/amd64)") {
+		t.Errorf("error doesn't list produced archives: %v", err)
+	}
+}
+
+func TestCheckDistpackArchive(t *testing.T) {
+	linux := Target{"linux", "amd64"}
+	tests := []struct {
+		name    string
+		entries []string
+		source  bool
+		wantErr string
+	}{
+		{"binary", []string{"go/VERSION", "go/bin/go", "go/pkg/tool/linux_amd64/compile"}, false, ""},
+		{"source", []string{"go/VERSION", "go/src/make.bash"}, true, ""},
+		{"no go dir", []string{"VERSION", "go/VERSION", "go/bin/go", "go/pkg/tool/linux_amd64/compile"}, false, `"VERSION" is outside`},
+		{"no version", []string{"go/bin/go", "go/pkg/tool/linux_amd64/compile"}, false, "missing go/VERSION"},
+		{"wrong tool dir", []string{"go/VERSION", "go/bin/go", "go/pkg/tool/linux_arm64/compile"}, false, "missing go/pkg/tool/linux_amd64/"},
+		{"no go command", []string{"go/VERSION", "go/pkg/tool/linux_amd64/compile"}, false, "missing go/bin/go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "a.tar.gz")
+			err := archiveutil.WithTarGzCreate(path, func(tw *tar.Writer) error {
+				for _, name := range tt.entries {
+					if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Typeflag: tar.TypeReg}); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = checkDistpackArchive(path, tt.source, linux)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("error = %v, want containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
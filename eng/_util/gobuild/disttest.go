@@ -0,0 +1,148 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// TestSelection picks a subset of the dist tests to run. The zero value selects every test.
+type TestSelection struct {
+	// Run is a regular expression matched against dist test names, as in "go tool dist test -run".
+	Run string
+	// ExcludeFile is the path to a list of dist test names to skip, one per line. Empty lines and
+	// lines starting with "#" are ignored.
+	ExcludeFile string
+	// Shard is the zero-based index of the shard to run, out of ShardCount. If ShardCount is less
+	// than 2, all selected tests are run.
+	Shard      int
+	ShardCount int
+}
+
+func (s *TestSelection) sharded() bool {
+	return s.ShardCount > 1
+}
+
+// needsList returns true if the selection can only be done by listing the tests. Otherwise, the
+// selection can be passed directly to dist.
+func (s *TestSelection) needsList() bool {
+	return s.ExcludeFile != "" || s.sharded()
+}
+
+func (s *TestSelection) validate() error {
+	if s.ShardCount < 0 {
+		return fmt.Errorf("shard count must not be negative: %v", s.ShardCount)
+	}
+	if s.sharded() && (s.Shard < 0 || s.Shard >= s.ShardCount) {
+		return fmt.Errorf("shard index %v out of range for %v shards", s.Shard, s.ShardCount)
+	}
+	if !s.sharded() && s.Shard != 0 {
+		return fmt.Errorf("shard index %v specified without a shard count", s.Shard)
+	}
+	if s.Run != "" {
+		if _, err := regexp.Compile(s.Run); err != nil {
+			return fmt.Errorf("invalid test regex: %v", err)
+		}
+	}
+	return nil
+}
+
+// distTestArgs returns the args to pass to "go tool dist test" to run the selected tests. If no
+// tests are selected, returns ok false.
+func (s *TestSelection) distTestArgs(goBin, dir string) (args []string, ok bool, err error) {
+	if err := s.validate(); err != nil {
+		return nil, false, err
+	}
+	if !s.needsList() {
+		if s.Run != "" {
+			args = append(args, "-run", s.Run)
+		}
+		return args, true, nil
+	}
+
+	names, err := listDistTests(goBin, dir)
+	if err != nil {
+		return nil, false, err
+	}
+	var exclude map[string]struct{}
+	if s.ExcludeFile != "" {
+		if exclude, err = readTestExcludeFile(s.ExcludeFile); err != nil {
+			return nil, false, err
+		}
+	}
+	var run *regexp.Regexp
+	if s.Run != "" {
+		run = regexp.MustCompile(s.Run)
+	}
+	selected := selectDistTests(names, run, exclude, s.Shard, s.ShardCount)
+	fmt.Printf("---- Selected %v of %v dist tests.\n", len(selected), len(names))
+	if len(selected) == 0 {
+		return nil, false, nil
+	}
+	return selected, true, nil
+}
+
+// selectDistTests returns the names that match run (if not nil), are not in exclude, and are in
+// the given shard. Shards are assigned round-robin in the order of names, so every shard gets a
+// similar number of tests and the result is deterministic for a given list.
+func selectDistTests(names []string, run *regexp.Regexp, exclude map[string]struct{}, shard, shardCount int) []string {
+	var filtered []string
+	for _, name := range names {
+		if run != nil && !run.MatchString(name) {
+			continue
+		}
+		if _, ok := exclude[name]; ok {
+			fmt.Printf("---- Excluding dist test: %v\n", name)
+			continue
+		}
+		filtered = append(filtered, name)
+	}
+	if shardCount < 2 {
+		return filtered
+	}
+	var selected []string
+	for i, name := range filtered {
+		if i%shardCount == shard {
+			selected = append(selected, name)
+		}
+	}
+	return selected
+}
+
+// listDistTests runs "go tool dist test -list" and returns the test names.
+func listDistTests(goBin, dir string) ([]string, error) {
+	cmd := exec.Command(goBin, "tool", "dist", "test", "-list")
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	fmt.Printf("---- Running command: %v\n", cmd.Args)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list dist tests: %v", err)
+	}
+	return strings.Fields(string(out)), nil
+}
+
+func readTestExcludeFile(path string) (map[string]struct{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	exclude := make(map[string]struct{})
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		exclude[line] = struct{}{}
+	}
+	return exclude, sc.Err()
+}
@@ -0,0 +1,51 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+)
+
+func TestSelectDistTests(t *testing.T) {
+	names := []string{"go_test:a", "go_test:b", "go_test:c", "go_test:d", "cgo_test", "race"}
+	exclude := map[string]struct{}{"race": {}}
+
+	// Every test is in exactly one shard.
+	var all []string
+	for shard := range 3 {
+		all = append(all, selectDistTests(names, nil, exclude, shard, 3)...)
+	}
+	slices.Sort(all)
+	want := []string{"cgo_test", "go_test:a", "go_test:b", "go_test:c", "go_test:d"}
+	if !slices.Equal(all, want) {
+		t.Errorf("union of shards = %v, want %v", all, want)
+	}
+
+	got := selectDistTests(names, regexp.MustCompile("^go_test:"), nil, 1, 2)
+	want = []string{"go_test:b", "go_test:d"}
+	if !slices.Equal(got, want) {
+		t.Errorf("shard 1 of 2 matching ^go_test: = %v, want %v", got, want)
+	}
+}
+
+func TestTestSelectionValidate(t *testing.T) {
+	tests := []struct {
+		s       TestSelection
+		wantErr bool
+	}{
+		{TestSelection{}, false},
+		{TestSelection{Shard: 3, ShardCount: 4}, false},
+		{TestSelection{Shard: 4, ShardCount: 4}, true},
+		{TestSelection{Shard: 1}, true},
+		{TestSelection{Run: "("}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.s.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v validate() = %v, want error: %v", tt.s, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,642 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package gobuild builds the Microsoft build of Go, optionally running tests, creating PDBs, and
+// packing archive files. It is the implementation of the "build" command, and other commands such
+// as "run-builder" use it to build Go in-process.
+package gobuild
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/microsoft/go-infra/json2junit"
+	"github.com/microsoft/go-infra/patch"
+	"github.com/microsoft/go-infra/submodule"
+	"github.com/microsoft/go/_util/buildutil"
+	"github.com/microsoft/go/_util/internal/sbom"
+)
+
+// Options configures a call to Build.
+type Options struct {
+	// RootDir is the root of the Microsoft build of Go repository. If empty, the current working
+	// directory is used. (eng/run.ps1 guarantees the working directory is the repository root.)
+	RootDir string
+
+	SkipBuild  bool
+	Test       bool
+	PackBuild  bool
+	PackSource bool
+	CreatePDB  bool
+	Refresh    bool
+	// Race is RaceAuto, RaceOn, or RaceOff and controls whether the race runtime is built. If
+	// empty, RaceAuto is used.
+	Race string
+	// PDBJobs is the maximum number of gopdb processes to run at once. If less than 1, the number
+	// of CPUs is used.
+	PDBJobs int
+	// Experiment is included in GOEXPERIMENT, if not empty.
+	Experiment string
+	// JUnitOutFile is the path to write test results to as a JUnit file, if not empty.
+	JUnitOutFile string
+	// TestSelection picks which dist tests to run if Test is true.
+	TestSelection TestSelection
+	// TestRetries is the number of times to rerun failed dist test units. Requires JUnitOutFile.
+	TestRetries int
+
+	// NoCache disables the build cache. By default, the bin, pkg/tool, and pkg/include dirs and
+	// the generated source files produced by the make phase are saved in a cache keyed by the
+	// submodule commit, patches, and build configuration. If a matching cache entry exists, it is restored rather than running
+	// make. Only the most recently used entries are kept.
+	NoCache bool
+	// CacheDir is the build cache location. If empty, eng/artifacts/cache is used.
+	CacheDir string
+
+	// Targets, if not empty, are the platforms to pack. The host toolchain is built once, then the
+	// toolchain for each target is cross-compiled and packed. Requires PackBuild. GOOS and GOARCH
+	// must not be set to a non-host platform in the environment.
+	Targets []Target
+
+	// MaxMakeAttempts is the number of times to attempt "make" before giving up. Values less than
+	// 1 are treated as 1.
+	MaxMakeAttempts int
+}
+
+// Result describes the files produced by Build.
+type Result struct {
+	// TargetOS and TargetArch are the GOOS and GOARCH the build targeted. If Options.Targets is
+	// set, this is the host platform.
+	TargetOS   string
+	TargetArch string
+
+	// Archives are the paths of the archives copied into eng/artifacts/bin.
+	Archives []string
+	// PDBs are the paths of the PDB files created in eng/artifacts/symbols.
+	PDBs []string
+	// SBOMs are the paths of the SPDX SBOMs created next to each archive.
+	SBOMs []string
+	// Provenance are the paths of the unsigned in-toto SLSA provenance statements created next to
+	// each archive.
+	Provenance []string
+	// JUnitFile is the path of the JUnit test result file, or empty if none was written.
+	JUnitFile string
+	// ManifestFile is the path of the JSON build manifest, or empty if none was written. See
+	// [Manifest].
+	ManifestFile string
+}
+
+// producesArtifacts returns true if Build builds or packs Go, or creates PDBs. Otherwise, such as
+// when it only runs tests, Build doesn't write a manifest: it would replace the manifest of the
+// build that produced the artifacts.
+func (o *Options) producesArtifacts() bool {
+	return !o.SkipBuild || o.PackBuild || o.PackSource || o.CreatePDB
+}
+
+// Build builds Go according to o and returns information about the files it produced. Build sets
+// environment variables in the current process to configure the upstream build scripts.
+func Build(o *Options) (result *Result, err error) {
+	startedOn := time.Now()
+	scriptExtension := ".bash"
+	executableExtension := ""
+	shellPrefix := []string{"bash"}
+
+	if runtime.GOOS == "windows" {
+		scriptExtension = ".bat"
+		executableExtension = ".exe"
+		shellPrefix = []string{"cmd.exe", "/c"}
+	}
+
+	// Keep track of the root dir so we can optionally pack it up later.
+	rootDir := o.RootDir
+	if rootDir == "" {
+		if rootDir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	if rootDir, err = filepath.Abs(rootDir); err != nil {
+		return nil, err
+	}
+
+	if err := validateRaceMode(o.Race); err != nil {
+		return nil, err
+	}
+	if len(o.Targets) > 0 {
+		if !o.PackBuild {
+			return nil, errors.New("packing multiple targets requires PackBuild")
+		}
+		if o.Test || o.CreatePDB {
+			return nil, errors.New("packing multiple targets can't be combined with running tests or creating PDBs")
+		}
+		for name, host := range map[string]string{"GOOS": runtime.GOOS, "GOARCH": runtime.GOARCH} {
+			if v := os.Getenv(name); v != "" && v != host {
+				return nil, fmt.Errorf("packing multiple targets builds the host toolchain first, but %v is set to %q", name, v)
+			}
+		}
+	}
+	if o.Test {
+		// Check the test options now rather than finding out after a long build.
+		if err := o.TestSelection.validate(); err != nil {
+			return nil, err
+		}
+		if o.TestRetries > 0 && o.JUnitOutFile == "" {
+			return nil, errors.New("retrying tests requires a JUnit output file")
+		}
+	}
+
+	if o.Refresh {
+		config, err := patch.FindAncestorConfig(rootDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := submodule.Reset(rootDir, filepath.Join(config.RootDir, config.SubmoduleDir), true); err != nil {
+			return nil, err
+		}
+		if err := patch.Apply(config, patch.ApplyModeIndex); err != nil {
+			return nil, err
+		}
+	}
+
+	// Get the target platform information. If the environment variable is different from the
+	// runtime value, this means we're doing a cross-compiled build. These values are used for
+	// capability checks and to make sure that if Pack is enabled, the output archive is formatted
+	// correctly and uses the right filename.
+	targetOS, err := buildutil.GetEnvOrDefault("GOOS", runtime.GOOS)
+	if err != nil {
+		return nil, err
+	}
+	targetArch, err := buildutil.GetEnvOrDefault("GOARCH", runtime.GOARCH)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Printf("---- Target platform: %v_%v\n", targetOS, targetArch)
+
+	// Decide now so an unsupported "-race=on" fails before building anything.
+	race, err := buildRaceRuntime(o.Race, targetOS, targetArch)
+	if err != nil {
+		return nil, err
+	}
+
+	result = &Result{
+		TargetOS:   targetOS,
+		TargetArch: targetArch,
+	}
+	artifactsDir := filepath.Join(rootDir, "eng", "artifacts")
+	manifest := &Manifest{
+		TargetOS:   targetOS,
+		TargetArch: targetArch,
+		BuildID:    getBuildID(),
+	}
+
+	if err := buildutil.UnassignGOROOT(); err != nil {
+		return nil, err
+	}
+
+	// The upstream build scripts in {repo-root}/src require your working directory to be src, or
+	// they instantly fail. Run them with src as their working directory.
+	goRootDir := filepath.Join(rootDir, "go")
+	srcDir := filepath.Join(goRootDir, "src")
+
+	if o.Experiment != "" {
+		buildutil.AppendExperimentEnv(o.Experiment)
+	}
+	manifest.Experiment = os.Getenv("GOEXPERIMENT")
+
+	if !o.SkipBuild {
+		// If we have a stage 0 copy of Go in an env variable (as set by run.ps1), use it in the
+		// build command by setting GOROOT_BOOTSTRAP. The upstream build script "make.bash" uses
+		// this env variable to find the copy of Go to use to build.
+		//
+		// Forcing the build script to use our stage 0 avoids uncertainty that could occur if we
+		// allowed it to use arbitrary versions of Go from the build machine PATH.
+		//
+		// To avoid this behavior and use an ambiently installed version of Go from PATH, run
+		// "make.bash" manually instead of using this tool.
+		if stage0Goroot := os.Getenv("STAGE_0_GOROOT"); stage0Goroot != "" {
+			if err := os.Setenv("GOROOT_BOOTSTRAP", stage0Goroot); err != nil {
+				return nil, err
+			}
+		}
+
+		// Set GOBUILDEXIT so 'make.bat' exits with exit code upon failure. The ordinary behavior of
+		// 'make.bat' is to always end with 0 exit code even if an error occurred, so 'all.bat' can
+		// handle the error. See https://github.com/golang/go/issues/7806.
+		if err := os.Setenv("GOBUILDEXIT", "1"); err != nil {
+			return nil, err
+		}
+
+		var cache *buildCache
+		var cacheKey *buildCacheKey
+		var restored bool
+		if !o.NoCache {
+			cacheDir := o.CacheDir
+			if cacheDir == "" {
+				cacheDir = filepath.Join(artifactsDir, "cache")
+			}
+			cache = &buildCache{dir: cacheDir}
+			if cacheKey, err = newBuildCacheKey(rootDir, targetOS, targetArch, race); err != nil {
+				return nil, fmt.Errorf("failed to calculate build cache key: %v", err)
+			}
+			if err := manifest.timePhase("cache-restore", func() error {
+				restored, err = cache.restore(cacheKey, goRootDir)
+				return err
+			}); err != nil {
+				return nil, err
+			}
+		}
+
+		if !restored {
+			buildCommandLine := append(shellPrefix, "make"+scriptExtension)
+
+			if err := manifest.timePhase("make", func() error {
+				return buildutil.Retry(max(o.MaxMakeAttempts, 1), func() error {
+					return runCommandLine(srcDir, buildCommandLine...)
+				})
+			}); err != nil {
+				return nil, err
+			}
+
+			if race {
+				fmt.Println("---- Building race runtime...")
+				err := manifest.timePhase("race", func() error {
+					return runCommandLine(
+						srcDir,
+						filepath.Join(goRootDir, "bin", "go"+executableExtension),
+						"install", "-race", "-a", "std",
+					)
+				})
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if cache != nil {
+				// The cache is best-effort: the build succeeded, so don't fail it.
+				if err := manifest.timePhase("cache-save", func() error {
+					return cache.save(cacheKey, goRootDir)
+				}); err != nil {
+					fmt.Printf("---- Unable to save build to cache, continuing: %v\n", err)
+				}
+			}
+		}
+	}
+
+	if o.Test {
+		// Normally, use the dev script to build.
+		testCommandLine := append(
+			shellPrefix,
+			[]string{
+				"run" + scriptExtension,
+				"--no-rebuild",
+			}...,
+		)
+
+		if o.JUnitOutFile != "" {
+			testCommandLine = append(testCommandLine, "-json")
+		}
+
+		goBin := filepath.Join(goRootDir, "bin", "go"+executableExtension)
+		distTestArgs, ok, err := o.TestSelection.distTestArgs(goBin, srcDir)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			fmt.Println("---- No dist tests selected. Skipping tests.")
+		} else {
+			if err := manifest.timePhase("test", func() error {
+				if o.JUnitOutFile != "" {
+					run := DistTestRun{
+						CommandLine:  testCommandLine,
+						Args:         distTestArgs,
+						Dir:          srcDir,
+						GoBin:        goBin,
+						JUnitOutFile: o.JUnitOutFile,
+						Retries:      o.TestRetries,
+					}
+					return run.Run()
+				}
+				return runCmdMultiWriter(srcDir, append(testCommandLine, distTestArgs...), os.Stdout)
+			}); err != nil {
+				return nil, err
+			}
+			result.JUnitFile = o.JUnitOutFile
+		}
+	}
+
+	if o.CreatePDB {
+		if _, err := exec.LookPath("gopdb"); err != nil {
+			return nil, fmt.Errorf("gopdb not found in PATH: %v", err)
+		}
+		// Print the version of gopdb to the console.
+		cmd := exec.Command("gopdb", "-version")
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		if err := runCmd(cmd); err != nil {
+			return nil, fmt.Errorf("gopdb failed: %v", err)
+		}
+
+		// Traverse the bin and tool directories to find all the binaries to generate PDBs for.
+		binDir := filepath.Join(goRootDir, "bin")
+		toolsDir := filepath.Join(goRootDir, "pkg", "tool", targetOS+"_"+targetArch)
+		artifactsPDBDir := filepath.Join(artifactsDir, "symbols")
+
+		if err := os.MkdirAll(artifactsPDBDir, os.ModePerm); err != nil {
+			return nil, err
+		}
+
+		bins, err := findPDBCandidates(binDir, toolsDir)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkPDBInputs(bins, targetArch); err != nil {
+			return nil, err
+		}
+
+		// Generate PDBs for all the binaries.
+		if err := manifest.timePhase("pdb", func() error {
+			result.PDBs, err = createPDBs(bins, artifactsPDBDir, targetOS, targetArch, o.PDBJobs)
+			return err
+		}); err != nil {
+			return nil, err
+		}
+		if err := checkPDBOutputs(bins, result.PDBs); err != nil {
+			return nil, err
+		}
+		for _, pdb := range result.PDBs {
+			f, err := newManifestFile(artifactsDir, pdb)
+			if err != nil {
+				return nil, err
+			}
+			manifest.PDBs = append(manifest.PDBs, f)
+		}
+	}
+
+	if o.PackBuild || o.PackSource {
+		// Find the host version of distpack. (Not the target version, which might not run.)
+		toolsDir := filepath.Join(goRootDir, "pkg", "tool", runtime.GOOS+"_"+runtime.GOARCH)
+		// distpack needs a VERSION file to run. If we're on the main branch, we don't have one, so
+		// use dist's version calculation to create a temp dev version and put it in VERSION.
+		var version string
+		if data, err := os.ReadFile(filepath.Join(goRootDir, "VERSION")); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				if version, err = writeDevelVersionFile(goRootDir, toolsDir); err != nil {
+					return nil, fmt.Errorf("unable to pack: failed writing development VERSION file: %v", err)
+				}
+				// Best effort: clean up the VERSION file when we're done. This is just for dev
+				// workflows: the temp VERSION file should never be checked in.
+				defer os.Remove(filepath.Join(goRootDir, "VERSION"))
+			} else {
+				return nil, fmt.Errorf("unable to pack: VERSION file in unexpected state: %v", err)
+			}
+		} else {
+			version, _, _ = strings.Cut(string(data), "\n")
+		}
+		manifest.Version = version
+
+		// Gather the information about the source that goes into each archive's SBOM.
+		submoduleCommit, err := gitOutput(goRootDir, "rev-parse", "HEAD")
+		if err != nil {
+			return nil, err
+		}
+		submoduleCommit = strings.TrimSpace(submoduleCommit)
+		patches, err := sbom.ReadPatches(filepath.Join(rootDir, "patches"))
+		if err != nil {
+			return nil, err
+		}
+		prov, err := newBuildProvenance(o, rootDir, submoduleCommit, patches, startedOn)
+		if err != nil {
+			return nil, err
+		}
+
+		// Pack the build target by default, or each requested target after cross-compiling its
+		// toolchain with the host toolchain.
+		targets := o.Targets
+		if len(targets) == 0 {
+			targets = []Target{{OS: targetOS, Arch: targetArch}}
+		}
+		distPackDir := filepath.Join(goRootDir, "pkg", "distpack")
+		artifactsBinDir := filepath.Join(artifactsDir, "bin")
+		for i, t := range targets {
+			// Name the phases after the target when there's more than one.
+			phaseSuffix := ""
+			if len(o.Targets) > 0 {
+				phaseSuffix = "-" + t.OS + "-" + t.Arch
+			}
+			env := append(os.Environ(), "GOROOT="+goRootDir, "GOOS="+t.OS, "GOARCH="+t.Arch)
+
+			if len(o.Targets) > 0 && !t.isHost() {
+				fmt.Printf("---- Building toolchain for %v...\n", t)
+				// "go install" puts cross-compiled commands in bin/{goos}_{goarch} and tools in
+				// pkg/tool/{goos}_{goarch}, where distpack expects them. It refuses to install
+				// cross-compiled commands if GOBIN is set. Use the same settings as dist so the
+				// commands are built the same way as in a native build.
+				cmd := exec.Command(filepath.Join(goRootDir, "bin", "go"+executableExtension), "install", "cmd")
+				cmd.Dir = srcDir
+				cmd.Env = append(append(env, "GOBIN="), t.toolEnv(version)...)
+				cmd.Stdout = os.Stdout
+				cmd.Stderr = os.Stderr
+				if err := manifest.timePhase("cross"+phaseSuffix, func() error {
+					return runCmd(cmd)
+				}); err != nil {
+					return nil, fmt.Errorf("building toolchain for %v failed: %v", t, err)
+				}
+			}
+
+			cmd := exec.Command(filepath.Join(toolsDir, "distpack"+executableExtension))
+			cmd.Env = env
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := manifest.timePhase("distpack"+phaseSuffix, func() error {
+				return runCmd(cmd)
+			}); err != nil {
+				return nil, fmt.Errorf("distpack failed: %v", err)
+			}
+
+			// distpack creates some files we don't need. Find the ones we want by parsing the
+			// names of the files it produced, check their layout, and copy them to our artifacts
+			// dir.
+			type packCopy struct{ src, dst string }
+			var packs []packCopy
+			if o.PackBuild {
+				src, err := findDistpackArchive(distPackDir, version, false, t)
+				if err != nil {
+					return nil, err
+				}
+				if err := checkDistpackArchive(src, false, t); err != nil {
+					return nil, err
+				}
+				packs = append(packs, packCopy{
+					src: src,
+					dst: filepath.Join(artifactsBinDir, artifactArchiveName(version, manifest.BuildID, t)),
+				})
+			}
+			// The source archive is the same for every target.
+			if o.PackSource && i == 0 {
+				src, err := findDistpackArchive(distPackDir, version, true, t)
+				if err != nil {
+					return nil, err
+				}
+				if err := checkDistpackArchive(src, true, t); err != nil {
+					return nil, err
+				}
+				packs = append(packs, packCopy{
+					src: src,
+					dst: filepath.Join(artifactsBinDir, version+"-"+manifest.BuildID+".src.tar.gz"),
+				})
+			}
+			fmt.Printf("---- Copying distpack output to artifacts dir %v\n", artifactsBinDir)
+			for _, p := range packs {
+				fmt.Printf("---- Copying %q to %q...\n", p.src, p.dst)
+				if err := copyFile(p.dst, p.src); err != nil {
+					return nil, err
+				}
+				result.Archives = append(result.Archives, p.dst)
+				f, err := newManifestFile(artifactsDir, p.dst)
+				if err != nil {
+					return nil, err
+				}
+				manifest.Archives = append(manifest.Archives, f)
+
+				sbomPath, err := writeSBOM(p.dst, version, submoduleCommit, patches)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create SBOM for %v: %v", p.dst, err)
+				}
+				result.SBOMs = append(result.SBOMs, sbomPath)
+				if f, err = newManifestFile(artifactsDir, sbomPath); err != nil {
+					return nil, err
+				}
+				manifest.SBOMs = append(manifest.SBOMs, f)
+
+				provPath, err := prov.write(p.dst, sbomPath)
+				if err != nil {
+					return nil, fmt.Errorf("failed to create provenance statement for %v: %v", p.dst, err)
+				}
+				result.Provenance = append(result.Provenance, provPath)
+				if f, err = newManifestFile(artifactsDir, provPath); err != nil {
+					return nil, err
+				}
+				manifest.Provenance = append(manifest.Provenance, f)
+			}
+		}
+	}
+
+	if o.producesArtifacts() {
+		if result.ManifestFile, err = manifest.write(artifactsDir); err != nil {
+			return nil, fmt.Errorf("failed to write build manifest: %v", err)
+		}
+		fmt.Printf("---- Wrote build manifest %v\n", result.ManifestFile)
+	}
+
+	fmt.Printf("---- Build command complete.\n")
+	return result, nil
+}
+
+// runTestsToJUnit runs the test command line in dir, converting its "-json" output to a JUnit
+// file at junitPath while also passing it through to stdout.
+func runTestsToJUnit(dir string, testCommandLine []string, junitPath string) (err error) {
+	f, err := os.Create(junitPath)
+	if err != nil {
+		return err
+	}
+	conv := json2junit.NewConverter(f)
+	defer func() {
+		if closeErr := conv.Close(); err == nil {
+			err = closeErr
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	return runCmdMultiWriter(dir, testCommandLine, conv, os.Stdout)
+}
+
+func writeDevelVersionFile(goRootDir, toolsDir string) (string, error) {
+	cmd := exec.Command(filepath.Join(toolsDir, "dist"), "version")
+	cmd.Env = append(os.Environ(), "GOROOT="+goRootDir)
+	vBytes, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("unable to get dist version: %v (%v)", err, string(vBytes))
+	}
+	fields := strings.Fields(string(vBytes))
+	if len(fields) < 2 {
+		return "", fmt.Errorf("expected at least 2 fields in dist version output, got %q in %q", len(fields), string(vBytes))
+	}
+	if fields[0] != "devel" {
+		return "", fmt.Errorf("expected first field 'devel' in dist version, got %q", fields[0])
+	}
+	// The second field should be something like "go1.21-abcde1234", and the remaining fields are a
+	// timestamp. Just using the second field as is: the full VERSION file string is placed into the
+	// archive filename, so this keeps it simple and avoids special characters.
+	if err := os.WriteFile(filepath.Join(goRootDir, "VERSION"), []byte(fields[1]), 0o666); err != nil {
+		return "", err
+	}
+	return fields[1], nil
+}
+
+// copyFile copies src to dst, creating dst's directory if necessary. Handles errors robustly,
+// see https://github.com/golang/go/blob/c3458e35f4/src/cmd/internal/archive/archive_test.go#L57
+// Doesn't copy file permissions.
+func copyFile(dst, src string) (err error) {
+	err = os.MkdirAll(filepath.Dir(dst), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	var s, d *os.File
+	s, err = os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	d, err = os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if e := d.Close(); err == nil {
+			err = e
+		}
+	}()
+	_, err = io.Copy(d, s)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func runCommandLine(dir string, commandLine ...string) error {
+	c := exec.Command(commandLine[0], commandLine[1:]...)
+	c.Dir = dir
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	return runCmd(c)
+}
+
+// runCmdMultiWriter runs a command in dir and outputs the stdout to multiple [io.Writer].
+func runCmdMultiWriter(dir string, commandLine []string, stdout ...io.Writer) error {
+	c := exec.Command(commandLine[0], commandLine[1:]...)
+	c.Dir = dir
+	c.Stdout = io.MultiWriter(stdout...)
+	c.Stderr = os.Stderr
+	return runCmd(c)
+}
+
+func runCmd(cmd *exec.Cmd) error {
+	fmt.Printf("---- Running command: %v\n", cmd.Args)
+	return cmd.Run()
+}
+
+// getBuildID returns BUILD_BUILDNUMBER if defined (e.g. a CI build). Otherwise, "dev".
+func getBuildID() string {
+	archiveVersion := os.Getenv("BUILD_BUILDNUMBER")
+	if archiveVersion == "" {
+		return "dev"
+	}
+	return archiveVersion
+}
@@ -0,0 +1,119 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/checksum"
+)
+
+// ManifestFilename is the name of the manifest file Build writes into eng/artifacts.
+const ManifestFilename = "build-manifest.json"
+
+// Manifest is a machine-readable record of what a call to Build did and produced. Downstream
+// steps can read it rather than searching the artifacts directory.
+type Manifest struct {
+	TargetOS   string `json:"targetOS"`
+	TargetArch string `json:"targetArch"`
+	// Experiment is the value of GOEXPERIMENT used for the build, if any.
+	Experiment string `json:"goexperiment,omitempty"`
+	// Version is the content of the VERSION file used to pack the build. Empty if nothing was
+	// packed.
+	Version string `json:"version,omitempty"`
+	// BuildID is the CI build number, or "dev".
+	BuildID string `json:"buildID"`
+
+	Archives []*ManifestFile `json:"archives,omitempty"`
+	PDBs     []*ManifestFile `json:"pdbs,omitempty"`
+	// SBOMs are the SPDX SBOMs of the archives, named after the archive plus ".spdx.json".
+	SBOMs []*ManifestFile `json:"sboms,omitempty"`
+	// Provenance are the in-toto SLSA provenance statements of the archives, named after the
+	// archive plus ".intoto.json".
+	Provenance []*ManifestFile `json:"provenance,omitempty"`
+
+	// Phases lists the time spent in each phase of the build, in the order they ran.
+	Phases []*Phase `json:"phases,omitempty"`
+}
+
+// ManifestFile describes a file produced by the build.
+type ManifestFile struct {
+	// Path is the slash-separated path of the file relative to eng/artifacts.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Phase records how long one phase of the build took.
+type Phase struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// ReadManifest reads a manifest file written by Build.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %q: %v", path, err)
+	}
+	return &m, nil
+}
+
+// timePhase runs f and records how long it took as a phase with the given name.
+func (m *Manifest) timePhase(name string, f func() error) error {
+	start := time.Now()
+	err := f()
+	m.Phases = append(m.Phases, &Phase{
+		Name:    name,
+		Seconds: time.Since(start).Seconds(),
+	})
+	return err
+}
+
+// newManifestFile hashes the file at path and returns a description of it. The path in the
+// description is relative to artifactsDir.
+func newManifestFile(artifactsDir, path string) (*ManifestFile, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	sum, err := checksum.FileSHA256(path)
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(artifactsDir, path)
+	if err != nil {
+		return nil, err
+	}
+	return &ManifestFile{
+		Path:   filepath.ToSlash(rel),
+		Size:   stat.Size(),
+		SHA256: sum,
+	}, nil
+}
+
+// write writes the manifest into artifactsDir and returns the path of the file.
+func (m *Manifest) write(artifactsDir string) (string, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(artifactsDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	path := filepath.Join(artifactsDir, ManifestFilename)
+	if err := os.WriteFile(path, append(data, '\n'), 0o666); err != nil {
+		return "", err
+	}
+	return path, nil
+}
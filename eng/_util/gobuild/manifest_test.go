@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestRoundTrip(t *testing.T) {
+	artifactsDir := t.TempDir()
+	archive := filepath.Join(artifactsDir, "bin", "go1.24.1-dev.linux-amd64.tar.gz")
+	if err := os.MkdirAll(filepath.Dir(archive), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(archive, []byte("archive"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+
+	m := &Manifest{TargetOS: "linux", TargetArch: "amd64", Version: "go1.24.1", BuildID: "dev"}
+	f, err := newManifestFile(artifactsDir, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ManifestFile{
+		Path: "bin/go1.24.1-dev.linux-amd64.tar.gz",
+		Size: int64(len("archive")),
+		// printf archive | sha256sum
+		SHA256: "0eb3e36bfb24dcd9bb1d1bece1531216b59539a8fde17ee80224af0653c92aa3",
+	}
+	if !reflect.DeepEqual(f, want) {
+		t.Errorf("newManifestFile = %+v, want %+v", f, want)
+	}
+	m.Archives = append(m.Archives, f)
+
+	errPhase := errors.New("phase failed")
+	if err := m.timePhase("make", func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.timePhase("test", func() error { return errPhase }); err != errPhase {
+		t.Errorf("timePhase returned %v, want %v", err, errPhase)
+	}
+	if len(m.Phases) != 2 || m.Phases[0].Name != "make" || m.Phases[1].Name != "test" {
+		t.Errorf("phases = %+v, want make then test", m.Phases)
+	}
+
+	path, err := m.write(artifactsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path != filepath.Join(artifactsDir, ManifestFilename) {
+		t.Errorf("wrote %v, want %v in the artifacts dir", path, ManifestFilename)
+	}
+	got, err := ReadManifest(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, m) {
+		t.Errorf("ReadManifest = %+v, want %+v", got, m)
+	}
+}
+
+func TestProducesArtifacts(t *testing.T) {
+	tests := []struct {
+		o    Options
+		want bool
+	}{
+		{Options{}, true},
+		{Options{SkipBuild: true, Test: true}, false},
+		{Options{SkipBuild: true}, false},
+		{Options{SkipBuild: true, PackBuild: true}, true},
+		{Options{SkipBuild: true, PackSource: true}, true},
+		{Options{SkipBuild: true, CreatePDB: true}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.o.producesArtifacts(); got != tt.want {
+			t.Errorf("producesArtifacts(%+v) = %v, want %v", tt.o, got, tt.want)
+		}
+	}
+}
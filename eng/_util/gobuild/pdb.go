@@ -0,0 +1,142 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// findPDBCandidates returns the regular files in dirs that are PE images. Files that aren't PE
+// images are reported and skipped: gopdb can't do anything useful with them.
+func findPDBCandidates(dirs ...string) ([]string, error) {
+	var bins []string
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+			p := filepath.Join(dir, entry.Name())
+			ok, err := isPE(p)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				fmt.Printf("---- Skipping non-PE file: %v\n", p)
+				continue
+			}
+			bins = append(bins, p)
+		}
+	}
+	return bins, nil
+}
+
+// isPE reports whether the file at path starts with a DOS header that points at a PE signature.
+func isPE(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	// The DOS header starts with "MZ" and stores the offset of the PE signature at 0x3c.
+	var dos [0x40]byte
+	if _, err := io.ReadFull(f, dos[:]); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	if dos[0] != 'M' || dos[1] != 'Z' {
+		return false, nil
+	}
+	var sig [4]byte
+	if _, err := f.ReadAt(sig[:], int64(binary.LittleEndian.Uint32(dos[0x3c:]))); err != nil {
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		}
+		return false, err
+	}
+	return sig == [4]byte{'P', 'E', 0, 0}, nil
+}
+
+// createPDBs runs gopdb on each of bins, using up to jobs concurrent processes. If jobs is less
+// than 1, the number of CPUs is used. Each PDB is placed in pdbDir, named after its binary and the
+// target platform. Returns the paths of the PDBs created, in the same order as bins.
+//
+// Every binary is attempted even if some fail. All failures are returned together.
+func createPDBs(bins []string, pdbDir, targetOS, targetArch string, jobs int) ([]string, error) {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	type pdbJob struct {
+		bin, out string
+		err      error
+	}
+	results := make([]pdbJob, len(bins))
+	for i, bin := range bins {
+		results[i] = pdbJob{
+			bin: bin,
+			out: filepath.Join(pdbDir, filepath.Base(bin)+"."+targetOS+"-"+targetArch+".pdb"),
+		}
+	}
+
+	// Print each process's output all at once when it finishes, so the logs for each binary are
+	// readable even though the processes run at the same time.
+	var outputMu sync.Mutex
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(jobs, len(bins)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				r := &results[i]
+				var out bytes.Buffer
+				cmd := exec.Command("gopdb", "-o", r.out, r.bin)
+				cmd.Stdout = &out
+				cmd.Stderr = &out
+				r.err = cmd.Run()
+
+				outputMu.Lock()
+				fmt.Printf("---- Ran command: %v\n", cmd.Args)
+				os.Stdout.Write(out.Bytes())
+				outputMu.Unlock()
+			}
+		}()
+	}
+	for i := range results {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var pdbs []string
+	var errs []error
+	for _, r := range results {
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("gopdb failed for %q: %v", r.bin, r.err))
+			continue
+		}
+		pdbs = append(pdbs, r.out)
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("failed to create %v of %v PDBs: %w", len(errs), len(bins), errors.Join(errs...))
+	}
+	return pdbs, nil
+}
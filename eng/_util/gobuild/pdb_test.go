@@ -0,0 +1,50 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsPE(t *testing.T) {
+	pe := make([]byte, 0x80)
+	copy(pe, "MZ")
+	binary.LittleEndian.PutUint32(pe[0x3c:], 0x40)
+	copy(pe[0x40:], "PE\x00\x00")
+
+	badOffset := append([]byte(nil), pe...)
+	binary.LittleEndian.PutUint32(badOffset[0x3c:], 0x1000)
+
+	tests := []struct {
+		name    string
+		content []byte
+		want    bool
+	}{
+		{"pe", pe, true},
+		{"empty", nil, false},
+		{"script", []byte("#!/bin/sh\necho hello\n"), false},
+		{"mz-only", pe[:0x40], false},
+		{"offset-past-end", badOffset, false},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(dir, tt.name)
+			if err := os.WriteFile(p, tt.content, 0o666); err != nil {
+				t.Fatal(err)
+			}
+			got, err := isPE(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("isPE() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,335 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// peMachines maps GOARCH to the PE machine type of a binary built for it.
+var peMachines = map[string]uint16{
+	"386":   pe.IMAGE_FILE_MACHINE_I386,
+	"amd64": pe.IMAGE_FILE_MACHINE_AMD64,
+	"arm":   pe.IMAGE_FILE_MACHINE_ARMNT,
+	"arm64": pe.IMAGE_FILE_MACHINE_ARM64,
+}
+
+// checkPDBInputs checks that every binary in bins is ready for gopdb. All problems are returned
+// together.
+func checkPDBInputs(bins []string, targetArch string) error {
+	var errs []error
+	for _, bin := range bins {
+		if err := checkPDBInput(bin, targetArch); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", bin, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("binaries not suitable for PDB creation: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// checkPDBInput checks that the PE file at path targets targetArch and still has the DWARF data
+// and symbols that gopdb converts into a PDB.
+func checkPDBInput(path, targetArch string) error {
+	f, err := pe.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	want, ok := peMachines[targetArch]
+	if !ok {
+		return fmt.Errorf("no known PE machine type for GOARCH %q", targetArch)
+	}
+	if f.Machine != want {
+		return fmt.Errorf("PE machine type is %#x, expected %#x for GOARCH %q", f.Machine, want, targetArch)
+	}
+	if f.Section(".debug_info") == nil && f.Section(".zdebug_info") == nil {
+		return errors.New("no DWARF debug info sections found; was it built with -w or already converted?")
+	}
+	if len(f.Symbols) == 0 {
+		return errors.New("no COFF symbols found; was it built with -s?")
+	}
+	return nil
+}
+
+// checkPDBOutputs checks that each PDB in pdbs is a valid MSF file that matches the corresponding
+// binary in bins. All problems are returned together.
+func checkPDBOutputs(bins, pdbs []string) error {
+	if len(bins) != len(pdbs) {
+		return fmt.Errorf("found %v PDBs for %v binaries", len(pdbs), len(bins))
+	}
+	var errs []error
+	for i := range bins {
+		if err := checkPDBMatch(bins[i], pdbs[i]); err != nil {
+			errs = append(errs, fmt.Errorf("%v: %v", pdbs[i], err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("PDB verification failed: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// checkPDBMatch checks that the GUID and age in the PDB file match the CodeView debug directory
+// entry in the PE file, so a debugger will load the PDB for the binary.
+func checkPDBMatch(binPath, pdbPath string) error {
+	peInfo, err := readPECodeView(binPath)
+	if err != nil {
+		return err
+	}
+	pdbInfo, err := readPDBIdentity(pdbPath)
+	if err != nil {
+		return err
+	}
+	if peInfo.guid != pdbInfo.guid {
+		return fmt.Errorf("GUID %x doesn't match %x in %v", pdbInfo.guid, peInfo.guid, binPath)
+	}
+	if peInfo.age != pdbInfo.age {
+		return fmt.Errorf("age %v doesn't match %v in %v", pdbInfo.age, peInfo.age, binPath)
+	}
+	return nil
+}
+
+// pdbIdentity is the data a debugger uses to match a binary to its PDB.
+type pdbIdentity struct {
+	guid [16]byte
+	age  uint32
+}
+
+// readPECodeView reads the RSDS CodeView record from the debug directory of the PE file at path.
+func readPECodeView(path string) (*pdbIdentity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	pf, err := pe.NewFile(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var dd pe.DataDirectory
+	switch oh := pf.OptionalHeader.(type) {
+	case *pe.OptionalHeader32:
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_DEBUG {
+			dd = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_DEBUG]
+		}
+	case *pe.OptionalHeader64:
+		if oh.NumberOfRvaAndSizes > pe.IMAGE_DIRECTORY_ENTRY_DEBUG {
+			dd = oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_DEBUG]
+		}
+	}
+	if dd.VirtualAddress == 0 || dd.Size == 0 {
+		return nil, errors.New("no debug directory found")
+	}
+
+	// The debug directory is addressed by RVA: find the section containing it.
+	var dir []byte
+	for _, s := range pf.Sections {
+		if dd.VirtualAddress >= s.VirtualAddress && dd.VirtualAddress+dd.Size <= s.VirtualAddress+s.VirtualSize {
+			dir = make([]byte, dd.Size)
+			if _, err := s.ReadAt(dir, int64(dd.VirtualAddress-s.VirtualAddress)); err != nil {
+				return nil, fmt.Errorf("failed to read debug directory: %v", err)
+			}
+			break
+		}
+	}
+	if dir == nil {
+		return nil, errors.New("debug directory is not inside a section")
+	}
+
+	// Each IMAGE_DEBUG_DIRECTORY entry is 28 bytes.
+	const (
+		entrySize          = 28
+		debugTypeCodeView  = 2
+		rsdsHeaderSize     = 4 + 16 + 4
+		typeOffset         = 12
+		sizeOfDataOffset   = 16
+		pointerToRawOffset = 24
+	)
+	for len(dir) >= entrySize {
+		entry := dir[:entrySize]
+		dir = dir[entrySize:]
+		if binary.LittleEndian.Uint32(entry[typeOffset:]) != debugTypeCodeView {
+			continue
+		}
+		size := binary.LittleEndian.Uint32(entry[sizeOfDataOffset:])
+		if size < rsdsHeaderSize {
+			return nil, fmt.Errorf("CodeView record too small: %v bytes", size)
+		}
+		var rec [rsdsHeaderSize]byte
+		if _, err := f.ReadAt(rec[:], int64(binary.LittleEndian.Uint32(entry[pointerToRawOffset:]))); err != nil {
+			return nil, fmt.Errorf("failed to read CodeView record: %v", err)
+		}
+		if string(rec[:4]) != "RSDS" {
+			return nil, fmt.Errorf("unexpected CodeView signature %q", rec[:4])
+		}
+		var id pdbIdentity
+		copy(id.guid[:], rec[4:20])
+		id.age = binary.LittleEndian.Uint32(rec[20:])
+		return &id, nil
+	}
+	return nil, errors.New("no CodeView entry found in debug directory")
+}
+
+// msfMagic is the start of the superblock of an MSF 7.0 file, the container format of a PDB.
+const msfMagic = "Microsoft C/C++ MSF 7.00\r\n\x1aDS\x00\x00\x00"
+
+// readPDBIdentity parses the PDB file at path as an MSF container and returns the GUID from the
+// PDB info stream and the age from the DBI stream.
+func readPDBIdentity(path string) (*pdbIdentity, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := openMSF(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stream 1 is the PDB info stream: Version, Signature, Age, GUID.
+	info, err := m.stream(1)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read PDB info stream: %v", err)
+	}
+	if len(info) < 28 {
+		return nil, fmt.Errorf("PDB info stream too small: %v bytes", len(info))
+	}
+	var id pdbIdentity
+	id.age = binary.LittleEndian.Uint32(info[8:])
+	copy(id.guid[:], info[12:28])
+
+	// Stream 3 is the DBI stream. Its age is the one debuggers compare with the binary. Some
+	// writers only set the age in the info stream, so only use it if it's present.
+	if dbi, err := m.stream(3); err == nil && len(dbi) >= 12 {
+		id.age = binary.LittleEndian.Uint32(dbi[8:])
+	}
+	return &id, nil
+}
+
+// msf is a minimal reader for the streams in an MSF file.
+type msf struct {
+	r         io.ReaderAt
+	blockSize uint32
+	numBlocks uint32
+	// streams is the list of blocks that make up each stream, along with its size.
+	streams []msfStream
+}
+
+type msfStream struct {
+	size   uint32
+	blocks []uint32
+}
+
+// msfNilStreamSize is the size recorded for a stream that doesn't exist.
+const msfNilStreamSize = 0xFFFFFFFF
+
+func openMSF(r io.ReaderAt) (*msf, error) {
+	var sb [len(msfMagic) + 6*4]byte
+	if _, err := r.ReadAt(sb[:], 0); err != nil {
+		return nil, fmt.Errorf("failed to read MSF superblock: %v", err)
+	}
+	if !bytes.Equal(sb[:len(msfMagic)], []byte(msfMagic)) {
+		return nil, errors.New("not an MSF 7.0 file: bad magic")
+	}
+	fields := sb[len(msfMagic):]
+	u32 := func(i int) uint32 { return binary.LittleEndian.Uint32(fields[i*4:]) }
+	m := &msf{r: r, blockSize: u32(0), numBlocks: u32(2)}
+	numDirectoryBytes := u32(3)
+	blockMapAddr := u32(5)
+	switch m.blockSize {
+	case 512, 1024, 2048, 4096:
+	default:
+		return nil, fmt.Errorf("invalid MSF block size %v", m.blockSize)
+	}
+	if blockMapAddr >= m.numBlocks {
+		return nil, fmt.Errorf("MSF block map address %v out of range", blockMapAddr)
+	}
+
+	// The block map lists the blocks that hold the stream directory.
+	numDirectoryBlocks := (numDirectoryBytes + m.blockSize - 1) / m.blockSize
+	blockMap := make([]byte, numDirectoryBlocks*4)
+	if _, err := r.ReadAt(blockMap, int64(blockMapAddr)*int64(m.blockSize)); err != nil {
+		return nil, fmt.Errorf("failed to read MSF block map: %v", err)
+	}
+	dirBlocks := make([]uint32, numDirectoryBlocks)
+	for i := range dirBlocks {
+		dirBlocks[i] = binary.LittleEndian.Uint32(blockMap[i*4:])
+	}
+	dir, err := m.read(msfStream{size: numDirectoryBytes, blocks: dirBlocks})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MSF stream directory: %v", err)
+	}
+
+	// Directory: NumStreams, StreamSizes[NumStreams], then each stream's block list.
+	next := func() (uint32, error) {
+		if len(dir) < 4 {
+			return 0, errors.New("MSF stream directory truncated")
+		}
+		v := binary.LittleEndian.Uint32(dir)
+		dir = dir[4:]
+		return v, nil
+	}
+	numStreams, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if uint64(numStreams)*4 > uint64(len(dir)) {
+		return nil, fmt.Errorf("MSF stream directory too small for %v streams", numStreams)
+	}
+	m.streams = make([]msfStream, numStreams)
+	for i := range m.streams {
+		m.streams[i].size, _ = next()
+	}
+	for i := range m.streams {
+		s := &m.streams[i]
+		if s.size == msfNilStreamSize {
+			continue
+		}
+		s.blocks = make([]uint32, (s.size+m.blockSize-1)/m.blockSize)
+		for j := range s.blocks {
+			if s.blocks[j], err = next(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return m, nil
+}
+
+// stream returns the content of stream i.
+func (m *msf) stream(i int) ([]byte, error) {
+	if i >= len(m.streams) {
+		return nil, fmt.Errorf("MSF stream %v doesn't exist, found %v streams", i, len(m.streams))
+	}
+	if m.streams[i].size == msfNilStreamSize {
+		return nil, fmt.Errorf("MSF stream %v is nil", i)
+	}
+	return m.read(m.streams[i])
+}
+
+func (m *msf) read(s msfStream) ([]byte, error) {
+	data := make([]byte, 0, s.size)
+	for _, b := range s.blocks {
+		if b >= m.numBlocks {
+			return nil, fmt.Errorf("block %v out of range", b)
+		}
+		n := min(m.blockSize, s.size-uint32(len(data)))
+		chunk := make([]byte, n)
+		if _, err := m.r.ReadAt(chunk, int64(b)*int64(m.blockSize)); err != nil {
+			return nil, err
+		}
+		data = append(data, chunk...)
+	}
+	return data, nil
+}
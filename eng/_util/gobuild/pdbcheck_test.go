@@ -0,0 +1,260 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"bytes"
+	"debug/pe"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testPEOptions configures writeTestPE.
+type testPEOptions struct {
+	machine uint16
+	// debugType is the type of the debug directory entry, or 0 for no debug directory.
+	debugType uint32
+	guid      [16]byte
+	age       uint32
+	// dwarf adds a .debug_info section, and symbols adds a COFF symbol.
+	dwarf, symbols bool
+}
+
+// writeTestPE writes a minimal 64-bit PE file with an .rdata section that holds the debug
+// directory and the CodeView record it points to.
+func writeTestPE(t *testing.T, o testPEOptions) string {
+	const (
+		headersSize = 0x400
+		sectionSize = 0x200
+		rdataRVA    = 0x1000
+		debugRVA    = 0x2000
+	)
+	le := binary.LittleEndian
+	var sections []pe.SectionHeader32
+	var raw [][]byte
+
+	rdata := make([]byte, sectionSize)
+	var dd pe.DataDirectory
+	if o.debugType != 0 {
+		const recordOffset = 28
+		record := append([]byte("RSDS"), o.guid[:]...)
+		record = le.AppendUint32(record, o.age)
+		record = append(record, "test.pdb\x00"...)
+		copy(rdata[recordOffset:], record)
+		le.PutUint32(rdata[12:], o.debugType)
+		le.PutUint32(rdata[16:], uint32(len(record)))
+		le.PutUint32(rdata[20:], rdataRVA+recordOffset)
+		le.PutUint32(rdata[24:], headersSize+recordOffset)
+		dd = pe.DataDirectory{VirtualAddress: rdataRVA, Size: 28}
+	}
+	sections = append(sections, pe.SectionHeader32{Name: [8]uint8{'.', 'r', 'd', 'a', 't', 'a'}, VirtualAddress: rdataRVA})
+	raw = append(raw, rdata)
+
+	// The string table holds the long section name, after its 4-byte size.
+	stringTable := le.AppendUint32(nil, 0)
+	if o.dwarf {
+		name := [8]uint8{}
+		copy(name[:], "/4")
+		stringTable = append(stringTable, ".debug_info\x00"...)
+		sections = append(sections, pe.SectionHeader32{Name: name, VirtualAddress: debugRVA})
+		raw = append(raw, make([]byte, sectionSize))
+	}
+	le.PutUint32(stringTable, uint32(len(stringTable)))
+	for i := range sections {
+		sections[i].VirtualSize = sectionSize
+		sections[i].SizeOfRawData = sectionSize
+		sections[i].PointerToRawData = headersSize + uint32(i)*sectionSize
+	}
+
+	oh := pe.OptionalHeader64{Magic: 0x20b, SectionAlignment: 0x1000, FileAlignment: 0x200, NumberOfRvaAndSizes: 16}
+	oh.DataDirectory[pe.IMAGE_DIRECTORY_ENTRY_DEBUG] = dd
+	fh := pe.FileHeader{
+		Machine:              o.machine,
+		NumberOfSections:     uint16(len(sections)),
+		PointerToSymbolTable: headersSize + uint32(len(sections))*sectionSize,
+		SizeOfOptionalHeader: uint16(binary.Size(oh)),
+	}
+	var symbols []byte
+	if o.symbols {
+		fh.NumberOfSymbols = 1
+		symbols = make([]byte, pe.COFFSymbolSize)
+		copy(symbols, "main")
+	}
+
+	var b bytes.Buffer
+	dos := make([]byte, 0x40)
+	copy(dos, "MZ")
+	le.PutUint32(dos[0x3c:], 0x40)
+	b.Write(dos)
+	b.WriteString("PE\x00\x00")
+	for _, v := range []any{fh, oh, sections} {
+		if err := binary.Write(&b, le, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Write(make([]byte, headersSize-b.Len()))
+	for _, r := range raw {
+		b.Write(r)
+	}
+	b.Write(symbols)
+	b.Write(stringTable)
+
+	p := filepath.Join(t.TempDir(), "test.exe")
+	if err := os.WriteFile(p, b.Bytes(), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// testPDBInput returns options for a PE that is ready for gopdb.
+func testPDBInput() testPEOptions {
+	return testPEOptions{machine: pe.IMAGE_FILE_MACHINE_AMD64, dwarf: true, symbols: true}
+}
+
+// writeTestPDB writes a minimal MSF file with a PDB info stream and DBI stream.
+func writeTestPDB(t *testing.T, guid [16]byte, infoAge, dbiAge uint32) string {
+	const blockSize = 512
+	blocks := make([][]byte, 5)
+	for i := range blocks {
+		blocks[i] = make([]byte, blockSize)
+	}
+	le := binary.LittleEndian
+
+	// Block 0: superblock.
+	sb := blocks[0]
+	copy(sb, msfMagic)
+	fields := sb[len(msfMagic):]
+	le.PutUint32(fields[0:], blockSize)
+	le.PutUint32(fields[4:], 1)
+	le.PutUint32(fields[8:], uint32(len(blocks)))
+	var dir bytes.Buffer
+	for _, v := range []uint32{
+		4,                           // NumStreams
+		0, 28, msfNilStreamSize, 12, // StreamSizes
+		3, // Stream 1 blocks
+		4, // Stream 3 blocks
+	} {
+		binary.Write(&dir, le, v)
+	}
+	le.PutUint32(fields[12:], uint32(dir.Len()))
+	le.PutUint32(fields[20:], 1)
+
+	// Block 1: block map. Block 2: stream directory.
+	le.PutUint32(blocks[1], 2)
+	copy(blocks[2], dir.Bytes())
+
+	// Block 3: PDB info stream. Block 4: DBI stream.
+	le.PutUint32(blocks[3][8:], infoAge)
+	copy(blocks[3][12:], guid[:])
+	le.PutUint32(blocks[4][8:], dbiAge)
+
+	p := filepath.Join(t.TempDir(), "test.pdb")
+	if err := os.WriteFile(p, bytes.Join(blocks, nil), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestReadPDBIdentity(t *testing.T) {
+	guid := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	p := writeTestPDB(t, guid, 1, 3)
+	id, err := readPDBIdentity(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.guid != guid {
+		t.Errorf("guid = %x, want %x", id.guid, guid)
+	}
+	// The DBI stream age takes priority.
+	if id.age != 3 {
+		t.Errorf("age = %v, want 3", id.age)
+	}
+}
+
+func TestReadPDBIdentityNotMSF(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "bad.pdb")
+	if err := os.WriteFile(p, bytes.Repeat([]byte{'x'}, 1024), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPDBIdentity(p); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestReadPECodeView(t *testing.T) {
+	guid := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	id, err := readPECodeView(writeTestPE(t, testPEOptions{machine: pe.IMAGE_FILE_MACHINE_AMD64, debugType: 2, guid: guid, age: 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.guid != guid || id.age != 3 {
+		t.Errorf("got %x age %v, want %x age 3", id.guid, id.age, guid)
+	}
+
+	notPE := filepath.Join(t.TempDir(), "notpe.exe")
+	if err := os.WriteFile(notPE, []byte("not a PE file"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	for name, path := range map[string]string{
+		"no debug directory": writeTestPE(t, testPEOptions{machine: pe.IMAGE_FILE_MACHINE_AMD64}),
+		// Type 1 is COFF debug info, not CodeView.
+		"no CodeView entry": writeTestPE(t, testPEOptions{machine: pe.IMAGE_FILE_MACHINE_AMD64, debugType: 1}),
+		"not PE":            notPE,
+	} {
+		if _, err := readPECodeView(path); err == nil {
+			t.Errorf("%v: got no error", name)
+		}
+	}
+}
+
+func TestCheckPDBInput(t *testing.T) {
+	if err := checkPDBInput(writeTestPE(t, testPDBInput()), "amd64"); err != nil {
+		t.Errorf("valid input: %v", err)
+	}
+	noDWARF, noSymbols := testPDBInput(), testPDBInput()
+	noDWARF.dwarf = false
+	noSymbols.symbols = false
+	notPE := filepath.Join(t.TempDir(), "notpe.exe")
+	if err := os.WriteFile(notPE, []byte("not a PE file"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, path, arch, wantErr string
+	}{
+		{"wrong arch", writeTestPE(t, testPDBInput()), "arm64", "PE machine type"},
+		{"unknown arch", writeTestPE(t, testPDBInput()), "riscv64", "no known PE machine type"},
+		{"no DWARF", writeTestPE(t, noDWARF), "amd64", "no DWARF"},
+		{"no symbols", writeTestPE(t, noSymbols), "amd64", "no COFF symbols"},
+		{"not PE", notPE, "amd64", ""},
+	}
+	for _, tt := range tests {
+		err := checkPDBInput(tt.path, tt.arch)
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%v: got %v, want error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestCheckPDBMatch(t *testing.T) {
+	guid := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+	otherGUID := guid
+	otherGUID[0] = 0xff
+	bin := writeTestPE(t, testPEOptions{machine: pe.IMAGE_FILE_MACHINE_AMD64, debugType: 2, guid: guid, age: 3})
+	if err := checkPDBMatch(bin, writeTestPDB(t, guid, 1, 3)); err != nil {
+		t.Errorf("matching PDB: %v", err)
+	}
+	if err := checkPDBMatch(bin, writeTestPDB(t, otherGUID, 1, 3)); err == nil || !strings.Contains(err.Error(), "GUID") {
+		t.Errorf("GUID mismatch: got %v", err)
+	}
+	if err := checkPDBMatch(bin, writeTestPDB(t, guid, 3, 4)); err == nil || !strings.Contains(err.Error(), "age") {
+		t.Errorf("age mismatch: got %v", err)
+	}
+	if err := checkPDBOutputs([]string{bin}, nil); err == nil {
+		t.Error("checkPDBOutputs with a missing PDB: got no error")
+	}
+}
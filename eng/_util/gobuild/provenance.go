@@ -0,0 +1,112 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/provenance"
+	"github.com/microsoft/go/_util/internal/sbom"
+)
+
+const buildType = "https://github.com/microsoft/go/eng/_util/cmd/build@v1"
+
+// buildProvenance records the inputs of a build so a provenance statement can be written for each
+// of its outputs.
+type buildProvenance struct {
+	options      map[string]any
+	env          map[string]any
+	dependencies []*provenance.ResourceDescriptor
+	startedOn    time.Time
+}
+
+// newBuildProvenance collects the options, environment, and materials of the build of the repo at
+// rootDir. Call it after the environment is set up for the build.
+func newBuildProvenance(o *Options, rootDir, submoduleCommit string, patches []*sbom.Patch, startedOn time.Time) (*buildProvenance, error) {
+	// Record the options using their Go field names.
+	data, err := json.Marshal(o)
+	if err != nil {
+		return nil, err
+	}
+	var options map[string]any
+	if err := json.Unmarshal(data, &options); err != nil {
+		return nil, err
+	}
+
+	env := make(map[string]any)
+	for k, v := range buildEnv() {
+		env[k] = v
+	}
+	if v := stage0Version(); v != "" {
+		env["stage0Version"] = v
+	}
+
+	repoCommit, err := gitOutput(rootDir, "rev-parse", "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	deps := []*provenance.ResourceDescriptor{
+		provenance.GitCommitDescriptor("microsoft/go", "https://github.com/microsoft/go", strings.TrimSpace(repoCommit)),
+		provenance.GitCommitDescriptor("go", "https://go.googlesource.com/go", submoduleCommit),
+	}
+	for _, p := range patches {
+		deps = append(deps, &provenance.ResourceDescriptor{
+			Name:   "patches/" + p.Name,
+			Digest: map[string]string{"sha256": p.SHA256},
+		})
+	}
+
+	return &buildProvenance{
+		options:      options,
+		env:          env,
+		dependencies: deps,
+		startedOn:    startedOn,
+	}, nil
+}
+
+// write writes a provenance statement for archivePath next to it, listing byproducts such as the
+// archive's SBOM. Returns the path of the statement.
+func (b *buildProvenance) write(archivePath string, byproducts ...string) (string, error) {
+	subject, err := provenance.FileDescriptor(archivePath)
+	if err != nil {
+		return "", err
+	}
+	var bps []*provenance.ResourceDescriptor
+	for _, p := range byproducts {
+		d, err := provenance.FileDescriptor(p)
+		if err != nil {
+			return "", err
+		}
+		bps = append(bps, d)
+	}
+	finishedOn := time.Now().UTC()
+	startedOn := b.startedOn.UTC()
+	s := provenance.NewStatement([]*provenance.ResourceDescriptor{subject}, &provenance.Provenance{
+		BuildDefinition: &provenance.BuildDefinition{
+			BuildType:            buildType,
+			ExternalParameters:   b.options,
+			InternalParameters:   b.env,
+			ResolvedDependencies: b.dependencies,
+		},
+		RunDetails: &provenance.RunDetails{
+			Builder: &provenance.Builder{ID: provenance.BuilderID("build")},
+			Metadata: &provenance.BuildMetadata{
+				InvocationID: provenance.InvocationID(),
+				StartedOn:    &startedOn,
+				FinishedOn:   &finishedOn,
+			},
+			Byproducts: bps,
+		},
+	})
+	path := archivePath + provenance.FileSuffix
+	fmt.Printf("---- Writing provenance statement %v\n", path)
+	if err := s.WriteFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"fmt"
+	"os"
+)
+
+// Values of Options.Race.
+const (
+	// RaceAuto builds the race runtime if the target platform supports it and the official
+	// distribution for that platform includes it.
+	RaceAuto = "auto"
+	// RaceOn always builds the race runtime. Build fails if the target platform doesn't support it.
+	RaceOn = "on"
+	// RaceOff never builds the race runtime.
+	RaceOff = "off"
+)
+
+func validateRaceMode(mode string) error {
+	switch mode {
+	case "", RaceAuto, RaceOn, RaceOff:
+		return nil
+	}
+	return fmt.Errorf("invalid race mode %q: must be %q, %q, or %q", mode, RaceAuto, RaceOn, RaceOff)
+}
+
+// raceDetectorSupported reports whether goos/goarch supports the race detector. This matches
+// upstream's internal/platform.RaceDetectorSupported.
+func raceDetectorSupported(goos, goarch string) bool {
+	switch goos {
+	case "linux":
+		return goarch == "amd64" || goarch == "ppc64le" || goarch == "arm64" || goarch == "s390x"
+	case "darwin":
+		return goarch == "amd64" || goarch == "arm64"
+	case "freebsd", "netbsd", "windows":
+		return goarch == "amd64"
+	}
+	return false
+}
+
+// buildRaceRuntime decides whether to build the race runtime for goos/goarch given the race mode
+// and the current environment. Returns an error if mode is RaceOn and the race runtime can't be
+// built.
+func buildRaceRuntime(mode, goos, goarch string) (bool, error) {
+	cgo := os.Getenv("CGO_ENABLED") != "0"
+	switch mode {
+	case RaceOff:
+		return false, nil
+	case RaceOn:
+		if !cgo {
+			return false, fmt.Errorf("race runtime requested, but it requires cgo and CGO_ENABLED=0")
+		}
+		if !raceDetectorSupported(goos, goarch) {
+			return false, fmt.Errorf("race runtime requested, but %v/%v doesn't support the race detector", goos, goarch)
+		}
+		return true, nil
+	case "", RaceAuto:
+		// The official arm64 distributions don't include the race runtime, although linux/arm64
+		// and darwin/arm64 support it. Use RaceOn to build it.
+		return cgo && goarch != "arm64" && raceDetectorSupported(goos, goarch), nil
+	}
+	return false, validateRaceMode(mode)
+}
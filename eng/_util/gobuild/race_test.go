@@ -0,0 +1,45 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import "testing"
+
+func TestBuildRaceRuntime(t *testing.T) {
+	tests := []struct {
+		mode, goos, goarch string
+		cgoDisabled        bool
+		want               bool
+		wantErr            bool
+	}{
+		{mode: RaceAuto, goos: "linux", goarch: "amd64", want: true},
+		{mode: "", goos: "windows", goarch: "amd64", want: true},
+		{mode: RaceAuto, goos: "linux", goarch: "arm64", want: false},
+		{mode: RaceAuto, goos: "linux", goarch: "arm", want: false},
+		{mode: RaceAuto, goos: "linux", goarch: "386", want: false},
+		{mode: RaceAuto, goos: "linux", goarch: "amd64", cgoDisabled: true, want: false},
+		{mode: RaceOn, goos: "linux", goarch: "arm64", want: true},
+		{mode: RaceOn, goos: "linux", goarch: "arm", wantErr: true},
+		{mode: RaceOn, goos: "windows", goarch: "arm64", wantErr: true},
+		{mode: RaceOn, goos: "linux", goarch: "amd64", cgoDisabled: true, wantErr: true},
+		{mode: RaceOff, goos: "linux", goarch: "amd64", want: false},
+		{mode: "yes", goos: "linux", goarch: "amd64", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode+"-"+tt.goos+"-"+tt.goarch, func(t *testing.T) {
+			if tt.cgoDisabled {
+				t.Setenv("CGO_ENABLED", "0")
+			} else {
+				t.Setenv("CGO_ENABLED", "1")
+			}
+			got, err := buildRaceRuntime(tt.mode, tt.goos, tt.goarch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/microsoft/go/_util/internal/archivediff"
+)
+
+// VerifyReproducible builds and packs Go twice according to o, then compares the two archives
+// entry-by-entry and prints the differences. Returns the diff, and an error if the archives
+// differ.
+//
+// Each build starts without the outputs of any earlier build, doesn't use the build cache, and
+// uses a fresh Go build cache, so the second build can't reuse the first build's results. Tests,
+// PDB creation, and source packing are not part of the comparison and are skipped.
+func VerifyReproducible(o *Options) (*archivediff.Diff, error) {
+	if o.SkipBuild {
+		return nil, errors.New("can't verify reproducibility without building")
+	}
+	if len(o.Targets) > 0 {
+		return nil, errors.New("can't verify reproducibility of multiple targets")
+	}
+	bo := *o
+	bo.PackBuild = true
+	bo.PackSource = false
+	bo.Test = false
+	bo.CreatePDB = false
+	// A cache hit would make the second build a copy of the first.
+	bo.NoCache = true
+
+	rootDir := bo.RootDir
+	if rootDir == "" {
+		var err error
+		if rootDir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	goRootDir := filepath.Join(rootDir, "go")
+
+	tempDir, err := os.MkdirTemp("", "go-reproducible-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	// Restore the caller's GOCACHE when done.
+	if oldCache, ok := os.LookupEnv("GOCACHE"); ok {
+		defer os.Setenv("GOCACHE", oldCache)
+	} else {
+		defer os.Unsetenv("GOCACHE")
+	}
+
+	var archives [2]string
+	for i := range archives {
+		fmt.Printf("---- Reproducibility check: build %v of %v\n", i+1, len(archives))
+		for _, dir := range []string{
+			filepath.Join(goRootDir, "bin"),
+			filepath.Join(goRootDir, "pkg", "tool"),
+			filepath.Join(goRootDir, "pkg", "distpack"),
+		} {
+			fmt.Printf("---- Removing %v\n", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+		}
+		if err := os.Setenv("GOCACHE", filepath.Join(tempDir, fmt.Sprintf("gocache-%v", i+1))); err != nil {
+			return nil, err
+		}
+
+		result, err := Build(&bo)
+		if err != nil {
+			return nil, fmt.Errorf("reproducibility build %v failed: %v", i+1, err)
+		}
+		if len(result.Archives) != 1 {
+			return nil, fmt.Errorf("expected 1 archive from reproducibility build %v, got %v", i+1, len(result.Archives))
+		}
+		archives[i] = filepath.Join(tempDir, fmt.Sprintf("build-%v-%v", i+1, filepath.Base(result.Archives[0])))
+		if err := copyFile(archives[i], result.Archives[0]); err != nil {
+			return nil, err
+		}
+
+		// The environment is already set up by the first build. Don't refresh the submodule again,
+		// and don't append the experiment to GOEXPERIMENT twice.
+		bo.Refresh = false
+		bo.Experiment = ""
+	}
+
+	diff, err := archivediff.Compare(archives[0], archives[1])
+	if err != nil {
+		return nil, err
+	}
+	diff.Print(os.Stdout)
+	if !diff.Empty() {
+		return diff, fmt.Errorf("build is not reproducible: %v added, %v removed, %v modified entries",
+			len(diff.Added), len(diff.Removed), len(diff.Modified))
+	}
+	fmt.Println("---- Build is reproducible.")
+	return diff, nil
+}
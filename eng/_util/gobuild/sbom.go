@@ -0,0 +1,33 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/sbom"
+)
+
+// writeSBOM creates an SPDX SBOM for the archive at archivePath and writes it next to the archive.
+// Returns the path of the SBOM.
+func writeSBOM(archivePath, version, submoduleCommit string, patches []*sbom.Patch) (string, error) {
+	doc, err := sbom.Generate(&sbom.Input{
+		ArchivePath:     archivePath,
+		Version:         version,
+		SubmoduleCommit: submoduleCommit,
+		Patches:         patches,
+		Created:         time.Now(),
+	})
+	if err != nil {
+		return "", err
+	}
+	path := archivePath + sbom.FileSuffix
+	fmt.Printf("---- Writing SBOM %v\n", path)
+	if err := doc.WriteFile(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"cmp"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+)
+
+// Target is a GOOS/GOARCH pair to pack.
+type Target struct {
+	OS   string
+	Arch string
+}
+
+func (t Target) String() string {
+	return t.OS + "/" + t.Arch
+}
+
+func (t Target) isHost() bool {
+	return t.OS == runtime.GOOS && t.Arch == runtime.GOARCH
+}
+
+// toolEnv returns the environment that cmd/dist's toolenv uses to build the toolchain's commands
+// for t, so a toolchain cross-compiled with "go install cmd" matches the one that
+// "GOOS=x GOARCH=y ./make.bash -distpack" builds. version is the content of the VERSION file.
+func (t Target) toolEnv(version string) []string {
+	var env []string
+	// Build static commands unless the platform requires external linking. See
+	// internal/platform.MustLinkExternal with cgo disabled.
+	if !(t.OS == "android" && t.Arch != "arm64") && !(t.OS == "ios" && t.Arch == "arm64") {
+		env = append(env, "CGO_ENABLED=0")
+	}
+	// dist defaults to GOARM=7 when cross-compiling, but the official arm archive ("armv6l") is
+	// built for GOARM=6, like the pipeline does.
+	if t.Arch == "arm" {
+		env = append(env, "GOARM="+cmp.Or(os.Getenv("GOARM"), "6"))
+	}
+	// Release builds and builders leave local paths and DWARF out of the commands.
+	isRelease := (strings.HasPrefix(version, "release.") || strings.HasPrefix(version, "go")) && !strings.Contains(version, "devel")
+	if isRelease || os.Getenv("GO_BUILDER_NAME") != "" {
+		env = append(env, "GOFLAGS=-trimpath -ldflags=-w -gcflags=cmd/...=-dwarf=false")
+	}
+	return env
+}
+
+// ParseTargets parses a comma-separated list of GOOS/GOARCH pairs, such as
+// "linux/amd64,windows/amd64".
+func ParseTargets(s string) ([]Target, error) {
+	var targets []Target
+	seen := make(map[Target]struct{})
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		goos, goarch, ok := strings.Cut(part, "/")
+		if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") {
+			return nil, fmt.Errorf("invalid target %q: expected GOOS/GOARCH", part)
+		}
+		t := Target{OS: goos, Arch: goarch}
+		if _, ok := seen[t]; ok {
+			return nil, fmt.Errorf("duplicate target %q", part)
+		}
+		seen[t] = struct{}{}
+		targets = append(targets, t)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no targets in %q", s)
+	}
+	return targets, nil
+}
+
+// artifactArchiveName returns the name of the binary archive for t in eng/artifacts/bin. It
+// includes the build ID to make sure the name is unique: we might change patches but build the
+// same submodule commit multiple times.
+func artifactArchiveName(version, buildID string, t Target) string {
+	// distpack calls GOARCH=arm "arm" in its tar.gz filename, but the upstream release process
+	// changes it to "armv6l" on https://go.dev/dl/ to match the historical name. Do the same here.
+	brandingArch := t.Arch
+	if brandingArch == "arm" {
+		brandingArch = "armv6l"
+	}
+	return version + "-" + buildID + "." + t.OS + "-" + brandingArch + archiveExtension(t.OS)
+}
+
+// archiveExtension returns the extension distpack uses for binary archives for goos.
+func archiveExtension(goos string) string {
+	if goos == "windows" {
+		return ".zip"
+	}
+	return ".tar.gz"
+}
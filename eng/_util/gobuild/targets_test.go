@@ -0,0 +1,74 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	got, err := ParseTargets("linux/amd64, linux/arm,windows/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Target{{"linux", "amd64"}, {"linux", "arm"}, {"windows", "amd64"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, s := range []string{"", "linux", "linux/", "/amd64", "linux/amd64/v3", "linux/amd64,linux/amd64"} {
+		if _, err := ParseTargets(s); err == nil {
+			t.Errorf("ParseTargets(%q) succeeded, want error", s)
+		}
+	}
+}
+
+func TestArtifactArchiveName(t *testing.T) {
+	tests := []struct {
+		target Target
+		want   string
+	}{
+		{Target{"linux", "amd64"}, "go1.23.1-123.linux-amd64.tar.gz"},
+		{Target{"linux", "arm"}, "go1.23.1-123.linux-armv6l.tar.gz"},
+		{Target{"windows", "amd64"}, "go1.23.1-123.windows-amd64.zip"},
+	}
+	for _, tt := range tests {
+		if got := artifactArchiveName("go1.23.1", "123", tt.target); got != tt.want {
+			t.Errorf("artifactArchiveName(%v) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestToolEnv(t *testing.T) {
+	t.Setenv("GO_BUILDER_NAME", "")
+	t.Setenv("GOARM", "")
+	const releaseFlags = "GOFLAGS=-trimpath -ldflags=-w -gcflags=cmd/...=-dwarf=false"
+	tests := []struct {
+		target  Target
+		version string
+		want    []string
+	}{
+		{Target{"linux", "arm64"}, "go1.24.1", []string{"CGO_ENABLED=0", releaseFlags}},
+		{Target{"windows", "amd64"}, "go1.25-abcde1234", []string{"CGO_ENABLED=0", releaseFlags}},
+		{Target{"linux", "amd64"}, "devel go1.25-abcde1234", []string{"CGO_ENABLED=0"}},
+		{Target{"linux", "arm"}, "go1.24.1", []string{"CGO_ENABLED=0", "GOARM=6", releaseFlags}},
+		{Target{"android", "arm"}, "go1.24.1", []string{"GOARM=6", releaseFlags}},
+		{Target{"ios", "arm64"}, "go1.24.1", []string{releaseFlags}},
+	}
+	for _, tt := range tests {
+		if got := tt.target.toolEnv(tt.version); !slices.Equal(got, tt.want) {
+			t.Errorf("toolEnv(%v, %q) = %q, want %q", tt.target, tt.version, got, tt.want)
+		}
+	}
+
+	// GOARM from the environment takes precedence over the default.
+	t.Setenv("GOARM", "7")
+	want := []string{"CGO_ENABLED=0", "GOARM=7", releaseFlags}
+	if got := (Target{"linux", "arm"}).toolEnv("go1.24.1"); !slices.Equal(got, want) {
+		t.Errorf("toolEnv with GOARM=7 = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+
+	"github.com/microsoft/go-infra/json2junit"
+)
+
+// DistTestRun runs dist tests with JSON output, converts the results to a JUnit file, and
+// optionally reruns the dist test units that failed.
+//
+// When a unit fails and then passes on a retry, it is considered flaky. The JUnit file includes
+// the passing attempt as the result for that unit, and the earlier attempts as separate suites
+// with their failures marked as skipped. When a unit fails every attempt, every attempt is
+// included as a failure.
+type DistTestRun struct {
+	// CommandLine runs "go tool dist test -json", directly or through a script such as run.bash.
+	// When retrying, dist test unit names are appended to it.
+	CommandLine []string
+	// Args are appended to CommandLine for the first attempt only, e.g. to select tests.
+	Args []string
+	// Dir is the working directory for the command. If empty, the current directory is used.
+	Dir string
+	// GoBin is the path to the built "go" binary, used to list the dist test units.
+	GoBin string
+
+	JUnitOutFile string
+	// Retries is the maximum number of times to rerun failed units. If zero, tests run once and
+	// their output is streamed directly to the JUnit file.
+	Retries int
+}
+
+// Run runs the tests. Returns an error if any test unit failed on every attempt, or if the first
+// attempt had a failure that isn't a test package's result, such as a failed build.
+func (r *DistTestRun) Run() error {
+	commandLine := append(slices.Clip(r.CommandLine), r.Args...)
+	if r.Retries < 1 {
+		return runTestsToJUnit(r.Dir, commandLine, r.JUnitOutFile)
+	}
+
+	units, err := listDistTests(r.GoBin, r.Dir)
+	if err != nil {
+		return err
+	}
+	knownUnits := make(map[string]struct{}, len(units))
+	for _, u := range units {
+		knownUnits[u] = struct{}{}
+	}
+
+	// firstErr is the error of the first attempt, if it had failures that retries can't fix.
+	var firstErr error
+	first := &testEventRecorder{}
+	err = runCmdMultiWriter(r.Dir, commandLine, first, os.Stdout)
+	first.flush()
+	attempts := [][]*testEvent{first.events}
+	history := make(map[string]*packageHistory)
+
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			// The tests didn't run to completion, so there's nothing to retry.
+			return err
+		}
+		var retrying []string
+		var unretryable []string
+		for _, pkg := range failedPackages(first.events) {
+			history[pkg] = &packageHistory{attempts: []int{0}}
+			if _, ok := knownUnits[distTestUnit(pkg)]; ok {
+				retrying = append(retrying, pkg)
+			} else {
+				unretryable = append(unretryable, pkg)
+			}
+		}
+		if len(history) == 0 {
+			// Something failed, but not a test package we can identify and rerun.
+			return cmp.Or(writeRetryJUnit(r.JUnitOutFile, attempts, history), err)
+		}
+		// Retrying the failed packages doesn't fix other failures, so keep the error for them.
+		if other := otherFailures(first.events); len(other) > 0 {
+			for _, f := range other {
+				fmt.Printf("---- Unable to retry: %v.\n", f)
+			}
+			firstErr = err
+		}
+		for _, pkg := range unretryable {
+			fmt.Printf("---- Unable to retry %q: no dist test unit named %q.\n", pkg, distTestUnit(pkg))
+		}
+
+		for i := 1; i <= r.Retries && len(retrying) > 0; i++ {
+			fmt.Printf("---- Retry %v of %v: rerunning %v failed dist test units...\n", i, r.Retries, len(retrying))
+			retryCommandLine := slices.Clip(r.CommandLine)
+			for _, pkg := range retrying {
+				retryCommandLine = append(retryCommandLine, distTestUnit(pkg))
+			}
+			rec := &testEventRecorder{}
+			// Ignore the error: we look at the results of each package instead.
+			_ = runCmdMultiWriter(r.Dir, retryCommandLine, rec, os.Stdout)
+			rec.flush()
+			attempts = append(attempts, rec.events)
+
+			results := packageResults(rec.events)
+			var stillFailing []string
+			for _, pkg := range retrying {
+				h := history[pkg]
+				h.attempts = append(h.attempts, i)
+				if results[pkg] == "pass" {
+					h.flaky = true
+				} else {
+					stillFailing = append(stillFailing, pkg)
+				}
+			}
+			retrying = stillFailing
+		}
+	}
+
+	if err := writeRetryJUnit(r.JUnitOutFile, attempts, history); err != nil {
+		return err
+	}
+
+	var flaky, failed []string
+	for pkg, h := range history {
+		if h.flaky {
+			flaky = append(flaky, pkg)
+		} else {
+			failed = append(failed, pkg)
+		}
+	}
+	slices.Sort(flaky)
+	slices.Sort(failed)
+	for _, pkg := range flaky {
+		fmt.Printf("---- Flaky: %v passed on attempt %v.\n", pkg, history[pkg].final()+1)
+	}
+	for _, pkg := range failed {
+		fmt.Printf("---- Failed consistently: %v failed %v attempt(s).\n", pkg, len(history[pkg].attempts))
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("dist tests failed on every attempt: %v", strings.Join(failed, ", "))
+	}
+	if firstErr != nil {
+		return fmt.Errorf("dist tests failed outside of the retried test packages: %v", firstErr)
+	}
+	return nil
+}
+
+// distTestUnit returns the name of the dist test unit that runs the tests reported under the
+// given test2json package name. Dist includes any variant in the package name, e.g.
+// "runtime:cpu124" for the "go_test:runtime:cpu124" unit.
+func distTestUnit(pkg string) string {
+	return "go_test:" + pkg
+}
+
+// packageHistory tracks the attempts made to run a package that failed at least once.
+type packageHistory struct {
+	// attempts are the indexes of the attempts that ran this package.
+	attempts []int
+	// flaky is true if the final attempt passed.
+	flaky bool
+}
+
+func (h *packageHistory) final() int {
+	return h.attempts[len(h.attempts)-1]
+}
+
+// testEvent is one line of "go test -json" style output. Lines that aren't JSON are kept as-is.
+type testEvent struct {
+	line []byte
+	// fields is nil if line isn't a JSON object. Keeping the raw fields lets us rewrite events
+	// without losing any fields we don't know about.
+	fields map[string]json.RawMessage
+
+	Package string
+	Test    string
+	Action  string
+	// ImportPath is the package a "build-output" or "build-fail" event is about.
+	ImportPath string
+}
+
+// testEventRecorder is an io.Writer that parses a stream of test events.
+type testEventRecorder struct {
+	buf    []byte
+	events []*testEvent
+}
+
+func (r *testEventRecorder) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	for {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			break
+		}
+		r.add(r.buf[:i+1])
+		r.buf = r.buf[i+1:]
+	}
+	return len(p), nil
+}
+
+// flush records any incomplete final line.
+func (r *testEventRecorder) flush() {
+	if len(r.buf) > 0 {
+		r.add(append(r.buf, '\n'))
+		r.buf = nil
+	}
+}
+
+func (r *testEventRecorder) add(line []byte) {
+	e := &testEvent{line: bytes.Clone(line)}
+	if json.Unmarshal(line, &e.fields) == nil {
+		// Ignore errors: a line that's valid JSON but has unexpected types is passed through.
+		_ = json.Unmarshal(line, e)
+	} else {
+		e.fields = nil
+	}
+	r.events = append(r.events, e)
+}
+
+// packageResults returns the last package-level action ("pass", "fail", "skip") reported for
+// each package.
+func packageResults(events []*testEvent) map[string]string {
+	results := make(map[string]string)
+	for _, e := range events {
+		if e.fields == nil || e.Test != "" {
+			continue
+		}
+		switch e.Action {
+		case "pass", "fail", "skip":
+			results[e.Package] = e.Action
+		}
+	}
+	return results
+}
+
+// failedPackages returns the sorted names of the packages that failed.
+func failedPackages(events []*testEvent) []string {
+	var failed []string
+	for pkg, result := range packageResults(events) {
+		if result == "fail" {
+			failed = append(failed, pkg)
+		}
+	}
+	slices.Sort(failed)
+	return failed
+}
+
+// otherFailures returns a description of each failure in events that isn't a test package's
+// result, such as a failed build, or a failure without a package.
+func otherFailures(events []*testEvent) []string {
+	var failures []string
+	for _, e := range events {
+		switch {
+		case e.fields == nil:
+		case e.Action == "build-fail":
+			failures = append(failures, fmt.Sprintf("build of %v failed", e.ImportPath))
+		case e.Action == "fail" && e.Package == "":
+			failures = append(failures, "failure without a package")
+		}
+	}
+	return failures
+}
+
+// writeRetryJUnit converts the events from all attempts into a JUnit file at path. See
+// retryJUnitEvents.
+func writeRetryJUnit(path string, attempts [][]*testEvent, history map[string]*packageHistory) (err error) {
+	events, err := retryJUnitEvents(attempts, history)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	conv := json2junit.NewConverter(f)
+	defer func() {
+		if closeErr := conv.Close(); err == nil {
+			err = closeErr
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	for _, e := range events {
+		if _, err := conv.Write(e.line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// retryJUnitEvents returns the events from all attempts to convert into a JUnit file. See
+// DistTestRun for how retried packages are represented.
+func retryJUnitEvents(attempts [][]*testEvent, history map[string]*packageHistory) ([]*testEvent, error) {
+	var events []*testEvent
+	// Packages that passed the first time, and any other output.
+	for _, e := range attempts[0] {
+		if _, ok := history[e.Package]; ok && e.fields != nil {
+			continue
+		}
+		events = append(events, e)
+	}
+
+	retried := make([]string, 0, len(history))
+	for pkg := range history {
+		retried = append(retried, pkg)
+	}
+	slices.Sort(retried)
+	for _, pkg := range retried {
+		h := history[pkg]
+		// The final attempt is the result for the package.
+		for _, e := range attempts[h.final()] {
+			if e.fields != nil && e.Package == pkg {
+				events = append(events, e)
+			}
+		}
+		// Earlier attempts are recorded as their own suites.
+		for _, a := range h.attempts[:len(h.attempts)-1] {
+			suite := fmt.Sprintf("%v (attempt %v)", pkg, a+1)
+			if h.flaky {
+				note, err := newOutputEvent(suite, fmt.Sprintf(
+					"FLAKY: failed on attempt %v, passed on attempt %v. Failures in this attempt are reported as skipped.\n",
+					a+1, h.final()+1))
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, note)
+			}
+			for _, e := range attempts[a] {
+				if e.fields == nil || e.Package != pkg {
+					continue
+				}
+				action := e.Action
+				if h.flaky && action == "fail" {
+					action = "skip"
+				}
+				renamed, err := e.rewrite(suite, action)
+				if err != nil {
+					return nil, err
+				}
+				events = append(events, renamed)
+			}
+		}
+	}
+	return events, nil
+}
+
+// rewrite returns a copy of e with a different package and action.
+func (e *testEvent) rewrite(pkg, action string) (*testEvent, error) {
+	fields := make(map[string]json.RawMessage, len(e.fields))
+	for k, v := range e.fields {
+		fields[k] = v
+	}
+	var err error
+	if fields["Package"], err = json.Marshal(pkg); err != nil {
+		return nil, err
+	}
+	if fields["Action"], err = json.Marshal(action); err != nil {
+		return nil, err
+	}
+	return newTestEvent(fields)
+}
+
+func newOutputEvent(pkg, output string) (*testEvent, error) {
+	fields := make(map[string]json.RawMessage)
+	var err error
+	if fields["Action"], err = json.Marshal("output"); err != nil {
+		return nil, err
+	}
+	if fields["Package"], err = json.Marshal(pkg); err != nil {
+		return nil, err
+	}
+	if fields["Output"], err = json.Marshal(output); err != nil {
+		return nil, err
+	}
+	return newTestEvent(fields)
+}
+
+func newTestEvent(fields map[string]json.RawMessage) (*testEvent, error) {
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return nil, err
+	}
+	r := &testEventRecorder{}
+	r.add(append(line, '\n'))
+	return r.events[0], nil
+}
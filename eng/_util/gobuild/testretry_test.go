@@ -0,0 +1,203 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package gobuild
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeDistEnv is set to a scenario name when the test binary runs as a fake "go tool dist test".
+const fakeDistEnv = "GOBUILD_TEST_FAKE_DIST"
+
+func TestMain(m *testing.M) {
+	if scenario := os.Getenv(fakeDistEnv); scenario != "" {
+		os.Exit(fakeDist(scenario, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeDist acts like "go tool dist test" with the given args. With "-list", it lists the units.
+// Otherwise, it prints the JSON results of the given scenario and returns the exit code. The
+// "flaky" package fails unless the run is a retry, which names the units to run.
+func fakeDist(scenario string, args []string) int {
+	if slices.Contains(args, "-list") {
+		fmt.Println("go_test:os go_test:flaky go_test:broken")
+		return 0
+	}
+	retry := slices.ContainsFunc(args, func(a string) bool { return strings.HasPrefix(a, "go_test:") })
+	code := 0
+	result := func(pkg string, pass bool) {
+		action := "pass"
+		if !pass {
+			action, code = "fail", 1
+			fmt.Printf(`{"Action":"run","Package":%q,"Test":"TestX"}`+"\n", pkg)
+			fmt.Printf(`{"Action":"fail","Package":%q,"Test":"TestX"}`+"\n", pkg)
+		}
+		fmt.Printf(`{"Action":%q,"Package":%q}`+"\n", action, pkg)
+	}
+	if !retry {
+		result("os", true)
+	}
+	if retry == slices.Contains(args, "go_test:flaky") {
+		result("flaky", retry)
+	}
+	switch scenario {
+	case "build-fail":
+		if !retry {
+			fmt.Println(`{"ImportPath":"cmd/internal/broken","Action":"build-fail"}`)
+			code = 1
+		}
+	case "consistent":
+		if !retry || slices.Contains(args, "go_test:broken") {
+			result("broken", false)
+		}
+	}
+	return code
+}
+
+func TestDistTestRun(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		scenario string
+		wantErr  string
+	}{
+		{"flaky", ""},
+		// The retry passes, but the build failure isn't fixed by it.
+		{"build-fail", "failed outside of the retried test packages"},
+		{"consistent", "failed on every attempt: broken"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.scenario, func(t *testing.T) {
+			t.Setenv(fakeDistEnv, tt.scenario)
+			r := &DistTestRun{
+				CommandLine:  []string{self},
+				GoBin:        self,
+				JUnitOutFile: filepath.Join(t.TempDir(), "junit.xml"),
+				Retries:      2,
+			}
+			err := r.Run()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Run() = %v, want nil", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Run() = %v, want error containing %q", err, tt.wantErr)
+			}
+			if _, err := os.Stat(r.JUnitOutFile); err != nil {
+				t.Errorf("JUnit file not written: %v", err)
+			}
+		})
+	}
+}
+
+const testStream = `{"Action":"start","Package":"runtime:cpu124"}
+{"Action":"run","Package":"runtime:cpu124","Test":"TestA"}
+{"Action":"fail","Package":"runtime:cpu124","Test":"TestA"}
+{"Action":"fail","Package":"runtime:cpu124","Elapsed":1.5}
+##### Not JSON
+{"Action":"pass","Package":"os"}
+{"Action":"skip","Package":"plugin"}`
+
+func TestTestEventRecorder(t *testing.T) {
+	r := &testEventRecorder{}
+	// Write in uneven chunks to make sure lines are reassembled.
+	for i := 0; i < len(testStream); i += 7 {
+		r.Write([]byte(testStream[i:min(i+7, len(testStream))]))
+	}
+	r.flush()
+
+	if len(r.events) != 7 {
+		t.Fatalf("got %v events, want 7", len(r.events))
+	}
+	if r.events[4].fields != nil {
+		t.Errorf("non-JSON line parsed as JSON: %q", r.events[4].line)
+	}
+	if got, want := failedPackages(r.events), []string{"runtime:cpu124"}; !slices.Equal(got, want) {
+		t.Errorf("failedPackages() = %v, want %v", got, want)
+	}
+	results := packageResults(r.events)
+	if results["os"] != "pass" || results["plugin"] != "skip" {
+		t.Errorf("unexpected package results: %v", results)
+	}
+	if got := distTestUnit("runtime:cpu124"); got != "go_test:runtime:cpu124" {
+		t.Errorf("distTestUnit() = %q", got)
+	}
+}
+
+func TestTestEventRewrite(t *testing.T) {
+	r := &testEventRecorder{}
+	r.Write([]byte(`{"Action":"fail","Package":"os","Elapsed":2,"Extra":true}` + "\n"))
+	e, err := r.events[0].rewrite("os (attempt 1)", "skip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Package != "os (attempt 1)" || e.Action != "skip" {
+		t.Errorf("rewrite() = %q %q", e.Package, e.Action)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(e.line, &fields); err != nil {
+		t.Fatal(err)
+	}
+	if fields["Elapsed"] != 2.0 || fields["Extra"] != true {
+		t.Errorf("rewrite() lost fields: %s", e.line)
+	}
+}
+
+func TestRetryJUnitEvents(t *testing.T) {
+	record := func(stream string) []*testEvent {
+		r := &testEventRecorder{}
+		r.Write([]byte(stream))
+		r.flush()
+		return r.events
+	}
+	attempts := [][]*testEvent{
+		record(`{"Action":"pass","Package":"os"}
+{"Action":"fail","Package":"flaky","Test":"TestX"}
+{"Action":"fail","Package":"flaky"}
+{"Action":"fail","Package":"broken"}
+`),
+		record(`{"Action":"pass","Package":"flaky"}
+{"Action":"fail","Package":"broken"}
+`),
+		record(`{"Action":"fail","Package":"broken"}
+`),
+	}
+	history := map[string]*packageHistory{
+		"flaky":  {attempts: []int{0, 1}, flaky: true},
+		"broken": {attempts: []int{0, 1, 2}},
+	}
+	events, err := retryJUnitEvents(attempts, history)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range events {
+		got = append(got, e.Package+" "+e.Test+" "+e.Action)
+	}
+	want := []string{
+		"os  pass",
+		// A consistent failure has every attempt as a failure.
+		"broken  fail",
+		"broken (attempt 1)  fail",
+		"broken (attempt 2)  fail",
+		// A flaky package passes, and its earlier failures are skipped.
+		"flaky  pass",
+		"flaky (attempt 1)  output",
+		"flaky (attempt 1) TestX skip",
+		"flaky (attempt 1)  skip",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package archiveaudit checks the content of a Go distribution archive against a policy.
+package archiveaudit
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+// Rules that an archive entry can violate.
+const (
+	// RulePath: entry paths must be relative and must not contain "..".
+	RulePath = "path"
+	// RuleMode: entries must be directories or regular files with the expected permissions.
+	RuleMode = "mode"
+	// RuleSetuid: entries must not have the setuid, setgid, or sticky bits.
+	RuleSetuid = "setuid"
+	// RuleVersionCache: the archive must not contain VERSION.cache, a file dist creates in a dev
+	// build that would override the VERSION file.
+	RuleVersionCache = "version-cache"
+	// RuleTestBinary: the archive must not contain compiled test binaries or executables left in
+	// testdata dirs, e.g. by running the tests before packing. A ".test" file is only a test
+	// binary if it's an executable: Go's source has text fixtures with that extension.
+	RuleTestBinary = "test-binary"
+	// RuleGoMod: the archive must not contain go.mod or go.sum files other than the ones of the
+	// std, cmd, and misc modules. Others, such as the modules of codegen tools in "_asm" dirs,
+	// cause false positives in dependency scanners: the patches rename them.
+	RuleGoMod = "go-mod"
+	// RuleExecutableFormat: files in bin and pkg/tool must be executables for the archive's
+	// GOOS and GOARCH.
+	RuleExecutableFormat = "executable-format"
+)
+
+// Policy configures an audit.
+type Policy struct {
+	// GOOS and GOARCH are the platform the archive is for. If empty, executable formats aren't
+	// checked.
+	GOOS   string
+	GOARCH string
+	// FileModes are the allowed permissions for regular files.
+	FileModes []fs.FileMode
+	// DirModes are the allowed permissions for directories.
+	DirModes []fs.FileMode
+	// AllowedGoMods are the paths of the go.mod and go.sum files allowed in the archive, relative
+	// to the top-level "go" dir. go.mod and go.sum files in testdata dirs are always allowed.
+	AllowedGoMods []string
+}
+
+// DefaultPolicy returns the policy for a Go distribution archive built for goos/goarch. It
+// matches the file modes distpack uses.
+func DefaultPolicy(goos, goarch string) *Policy {
+	return &Policy{
+		GOOS:      goos,
+		GOARCH:    goarch,
+		FileModes: []fs.FileMode{0o644, 0o755},
+		DirModes:  []fs.FileMode{0o755},
+		AllowedGoMods: []string{
+			"src/go.mod",
+			"src/go.sum",
+			"src/cmd/go.mod",
+			"src/cmd/go.sum",
+			"misc/go.mod",
+		},
+	}
+}
+
+// Violation is a policy violation found in an archive.
+type Violation struct {
+	Entry   string `json:"entry"`
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// Report is the result of auditing an archive.
+type Report struct {
+	Archive    string       `json:"archive"`
+	GOOS       string       `json:"goos,omitempty"`
+	GOARCH     string       `json:"goarch,omitempty"`
+	Entries    int          `json:"entries"`
+	Violations []*Violation `json:"violations"`
+}
+
+// Passed returns true if the archive has no violations.
+func (r *Report) Passed() bool {
+	return len(r.Violations) == 0
+}
+
+// Audit checks every entry of the zip or tar.gz archive at archivePath against p. Returns an
+// error only if the archive can't be read: violations are listed in the report.
+func Audit(archivePath string, p *Policy) (*Report, error) {
+	r := &Report{
+		Archive:    archivePath,
+		GOOS:       p.GOOS,
+		GOARCH:     p.GOARCH,
+		Violations: []*Violation{},
+	}
+	err := archiveutil.InspectArchiveEntries(archivePath, func(e *archiveutil.Entry, content io.Reader) error {
+		r.Entries++
+		return p.checkEntry(r, e, content)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", archivePath, err)
+	}
+	return r, nil
+}
+
+func (r *Report) add(entry, rule, format string, args ...any) {
+	r.Violations = append(r.Violations, &Violation{
+		Entry:   entry,
+		Rule:    rule,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (p *Policy) checkEntry(r *Report, e *archiveutil.Entry, content io.Reader) error {
+	name := e.Name
+	if !isLocal(name) {
+		r.add(name, RulePath, "path is absolute or escapes the archive root")
+		// The rest of the checks depend on where the entry is, so they'd be meaningless.
+		return nil
+	}
+
+	if e.Mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) != 0 {
+		r.add(name, RuleSetuid, "mode %v has setuid, setgid, or sticky bit", e.Mode)
+	}
+	perm := e.Mode.Perm()
+	switch {
+	case e.Mode.IsDir():
+		if !slices.Contains(p.DirModes, perm) {
+			r.add(name, RuleMode, "directory permissions %v, expected one of %v", perm, p.DirModes)
+		}
+		return nil
+	case e.Mode.IsRegular():
+		if !slices.Contains(p.FileModes, perm) {
+			r.add(name, RuleMode, "file permissions %v, expected one of %v", perm, p.FileModes)
+		}
+	default:
+		r.add(name, RuleMode, "unexpected entry type %v", e.Mode.Type())
+		return nil
+	}
+
+	// Paths relative to the top-level "go" dir, as they would be in GOROOT.
+	rel, _ := strings.CutPrefix(strings.TrimSuffix(name, "/"), "go/")
+	base := path.Base(rel)
+	inTestdata := strings.HasPrefix(rel, "testdata/") || strings.Contains(rel, "/testdata/")
+
+	// Read the content at most once, and only if a check needs it.
+	var data []byte
+	readContent := func() ([]byte, error) {
+		if data == nil {
+			b, err := io.ReadAll(content)
+			if err != nil {
+				return nil, err
+			}
+			data = b
+		}
+		return data, nil
+	}
+
+	if base == "VERSION.cache" {
+		r.add(name, RuleVersionCache, "VERSION.cache is created by dev builds and must not be distributed")
+	}
+	if strings.HasSuffix(base, ".test") || strings.HasSuffix(base, ".test.exe") {
+		data, err := readContent()
+		if err != nil {
+			return err
+		}
+		if format, _, _ := identifyExecutable(data); format != "" {
+			r.add(name, RuleTestBinary, "compiled test binary (%v executable)", format)
+		}
+	} else if inTestdata && perm&0o111 != 0 {
+		r.add(name, RuleTestBinary, "executable file in testdata")
+	}
+	if (base == "go.mod" || base == "go.sum") && !inTestdata && !slices.Contains(p.AllowedGoMods, rel) {
+		r.add(name, RuleGoMod, "internal %v file", base)
+	}
+
+	if p.GOOS != "" && p.GOARCH != "" && (strings.HasPrefix(rel, "bin/") || strings.HasPrefix(rel, "pkg/tool/")) {
+		data, err := readContent()
+		if err != nil {
+			return err
+		}
+		if msg := checkExecutable(data, p.GOOS, p.GOARCH); msg != "" {
+			r.add(name, RuleExecutableFormat, "%v", msg)
+		}
+	}
+	return nil
+}
+
+// isLocal reports whether the slash-separated archive path name is relative and stays inside the
+// archive root. Unlike filepath.IsLocal, the result doesn't depend on the OS running the audit.
+func isLocal(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, `\`) {
+		return false
+	}
+	// Windows drive letter, e.g. "C:".
+	if len(name) >= 2 && name[1] == ':' {
+		return false
+	}
+	for _, elem := range strings.Split(name, "/") {
+		if elem == ".." {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,236 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package archiveaudit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+type testEntry struct {
+	name    string
+	mode    int64
+	typ     byte
+	content []byte
+}
+
+func writeTestTarGz(t *testing.T, entries []testEntry) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "test.tar.gz")
+	err := archiveutil.WithTarGzCreate(path, func(tw *tar.Writer) error {
+		for _, e := range entries {
+			typ := e.typ
+			if typ == 0 {
+				typ = tar.TypeReg
+			}
+			hdr := &tar.Header{Name: e.name, Mode: e.mode, Typeflag: typ, Size: int64(len(e.content))}
+			if typ != tar.TypeReg {
+				hdr.Size = 0
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write(e.content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAudit(t *testing.T) {
+	// Use the test binary itself as an executable for the current platform.
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, err := os.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := writeTestTarGz(t, []testEntry{
+		{name: "go/", mode: 0o755, typ: tar.TypeDir},
+		{name: "go/VERSION", mode: 0o644},
+		{name: "go/bin/go", mode: 0o755, content: exe},
+		{name: "go/src/go.mod", mode: 0o644},
+		{name: "go/src/cmd/go/testdata/mod/go.mod", mode: 0o644},
+		{name: "go/misc/go.mod", mode: 0o644},
+		{name: "go/src/internal/trace/testdata/tests/go122-gc-stress.test", mode: 0o644, content: []byte("-- expect --\nSUCCESS\n")},
+		// Violations:
+		{name: "../escape", mode: 0o644},
+		{name: "/abs", mode: 0o644},
+		{name: "go/writable", mode: 0o666},
+		{name: "go/suid", mode: 0o4755},
+		{name: "go/link", mode: 0o777, typ: tar.TypeSymlink},
+		{name: "go/VERSION.cache", mode: 0o644},
+		{name: "go/src/fmt/fmt.test", mode: 0o755, content: exe},
+		{name: "go/src/debug/elf/testdata/built", mode: 0o755},
+		{name: "go/src/internal/tool/go.mod", mode: 0o644},
+		{name: "go/src/crypto/internal/fips140/bigmod/_asm/go.mod", mode: 0o644},
+		{name: "go/pkg/tool/" + runtime.GOOS + "_" + runtime.GOARCH + "/notexe", mode: 0o755, content: []byte("#!/bin/sh\n")},
+	})
+
+	r, err := Audit(path, DefaultPolicy(runtime.GOOS, runtime.GOARCH))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type found struct{ entry, rule string }
+	var got []found
+	for _, v := range r.Violations {
+		got = append(got, found{v.Entry, v.Rule})
+	}
+	want := []found{
+		{"../escape", RulePath},
+		{"/abs", RulePath},
+		{"go/writable", RuleMode},
+		{"go/suid", RuleSetuid},
+		{"go/link", RuleMode},
+		{"go/VERSION.cache", RuleVersionCache},
+		{"go/src/fmt/fmt.test", RuleTestBinary},
+		{"go/src/debug/elf/testdata/built", RuleTestBinary},
+		{"go/src/internal/tool/go.mod", RuleGoMod},
+		{"go/src/crypto/internal/fips140/bigmod/_asm/go.mod", RuleGoMod},
+		{"go/pkg/tool/" + runtime.GOOS + "_" + runtime.GOARCH + "/notexe", RuleExecutableFormat},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("violations:\n%v\nwant:\n%v", got, want)
+	}
+	if r.Entries != 18 {
+		t.Errorf("entries = %v, want 18", r.Entries)
+	}
+}
+
+func TestAuditWrongPlatform(t *testing.T) {
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, err := os.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := writeTestTarGz(t, []testEntry{
+		{name: "go/bin/go", mode: 0o755, content: exe},
+	})
+
+	otherArch := "arm64"
+	if runtime.GOARCH == "arm64" {
+		otherArch = "amd64"
+	}
+	r, err := Audit(path, DefaultPolicy(runtime.GOOS, otherArch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Violations) != 1 || r.Violations[0].Rule != RuleExecutableFormat {
+		t.Errorf("violations = %v, want one %v violation", r.Violations, RuleExecutableFormat)
+	}
+}
+
+// TestAuditGOROOT audits an archive of the GOROOT of the go command running the test, which is a
+// real distribution with the layout distpack creates. The default policy must accept all of it
+// except the go.mod and go.sum files of codegen modules, which the patches rename.
+func TestAuditGOROOT(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping in short mode: archives the whole GOROOT")
+	}
+	out, err := exec.Command("go", "env", "GOROOT", "GOHOSTOS", "GOHOSTARCH").Output()
+	if err != nil {
+		t.Skipf("go env failed: %v", err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 3 {
+		t.Fatalf("unexpected go env output %q", out)
+	}
+	goroot, goos, goarch := fields[0], fields[1], fields[2]
+	if _, err := os.Stat(filepath.Join(goroot, "VERSION")); err != nil {
+		t.Skipf("GOROOT %v isn't a distribution: %v", goroot, err)
+	}
+
+	// Pack GOROOT the way distpack does: in a top-level "go" dir, with fixed permissions, and
+	// without the pkg/obj build cache.
+	archivePath := filepath.Join(t.TempDir(), "go.zip")
+	err = archiveutil.WithZipCreate(archivePath, func(zw *zip.Writer) error {
+		return filepath.WalkDir(goroot, func(p string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(goroot, p)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if rel == "pkg/obj" {
+				return fs.SkipDir
+			}
+			// A GOROOT downloaded as a toolchain module has the module's go.mod at the root.
+			if rel == "." || rel == "go.mod" || d.Type()&fs.ModeSymlink != 0 {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			fh := &zip.FileHeader{Name: "go/" + rel, Method: zip.Store}
+			switch {
+			case d.IsDir():
+				fh.Name += "/"
+				fh.SetMode(fs.ModeDir | 0o755)
+			case info.Mode()&0o111 != 0:
+				fh.SetMode(0o755)
+			default:
+				fh.SetMode(0o644)
+			}
+			w, err := zw.CreateHeader(fh)
+			if err != nil || d.IsDir() {
+				return err
+			}
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = io.Copy(w, f)
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Audit(archivePath, DefaultPolicy(goos, goarch))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var codegenGoMods []string
+	for _, v := range r.Violations {
+		if v.Rule == RuleGoMod && strings.Contains(v.Entry, "/_") {
+			codegenGoMods = append(codegenGoMods, v.Entry)
+			continue
+		}
+		t.Errorf("%v: [%v] %v", v.Entry, v.Rule, v.Message)
+	}
+	// Upstream has this file, and the patches rename it. Make sure the audit catches it.
+	const bigmodGoMod = "src/crypto/internal/fips140/bigmod/_asm/go.mod"
+	if _, err := os.Stat(filepath.Join(goroot, bigmodGoMod)); err == nil && !slices.Contains(codegenGoMods, "go/"+bigmodGoMod) {
+		t.Errorf("%v isn't reported, want a %v violation", bigmodGoMod, RuleGoMod)
+	}
+	t.Logf("audited %v entries of %v", r.Entries, goroot)
+}
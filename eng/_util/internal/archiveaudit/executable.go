@@ -0,0 +1,136 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package archiveaudit
+
+import (
+	"bytes"
+	"debug/elf"
+	"debug/macho"
+	"debug/pe"
+	"encoding/binary"
+	"fmt"
+)
+
+var (
+	elfArches = map[elf.Machine]string{
+		elf.EM_386:       "386",
+		elf.EM_X86_64:    "amd64",
+		elf.EM_ARM:       "arm",
+		elf.EM_AARCH64:   "arm64",
+		elf.EM_S390:      "s390x",
+		elf.EM_RISCV:     "riscv64",
+		elf.EM_LOONGARCH: "loong64",
+	}
+	peArches = map[uint16]string{
+		pe.IMAGE_FILE_MACHINE_I386:  "386",
+		pe.IMAGE_FILE_MACHINE_AMD64: "amd64",
+		pe.IMAGE_FILE_MACHINE_ARMNT: "arm",
+		pe.IMAGE_FILE_MACHINE_ARM64: "arm64",
+	}
+	machoArches = map[macho.Cpu]string{
+		macho.Cpu386:   "386",
+		macho.CpuAmd64: "amd64",
+		macho.CpuArm64: "arm64",
+	}
+)
+
+// checkExecutable returns a description of the problem if data isn't an executable for
+// goos/goarch, or "" if it is. If the executable format of goos isn't known, only checks that
+// data is some kind of executable.
+func checkExecutable(data []byte, goos, goarch string) string {
+	format, arch, err := identifyExecutable(data)
+	if err != nil {
+		return err.Error()
+	}
+	if format == "" {
+		return "not an executable"
+	}
+	if want := executableFormat(goos); want != "" && format != want {
+		return fmt.Sprintf("%v executable, expected %v for %v", format, want, goos)
+	}
+	if arch != goarch {
+		return fmt.Sprintf("%v executable for %v, expected %v", format, arch, goarch)
+	}
+	return ""
+}
+
+// executableFormat returns the executable format used by goos, or "" if it isn't one this package
+// can identify.
+func executableFormat(goos string) string {
+	switch goos {
+	case "windows":
+		return "PE"
+	case "darwin", "ios":
+		return "Mach-O"
+	case "linux", "android", "freebsd", "netbsd", "openbsd", "dragonfly", "illumos", "solaris":
+		return "ELF"
+	}
+	return ""
+}
+
+// identifyExecutable returns the format and GOARCH of the executable in data. Returns an empty
+// format if data doesn't look like an executable, and an error if it looks like one but can't be
+// parsed.
+func identifyExecutable(data []byte) (format, arch string, err error) {
+	r := bytes.NewReader(data)
+	switch {
+	case bytes.HasPrefix(data, []byte(elf.ELFMAG)):
+		f, err := elf.NewFile(r)
+		if err != nil {
+			return "ELF", "", fmt.Errorf("invalid ELF file: %v", err)
+		}
+		arch = elfArches[f.Machine]
+		switch f.Machine {
+		case elf.EM_PPC64:
+			arch = "ppc64"
+			if f.Data == elf.ELFDATA2LSB {
+				arch = "ppc64le"
+			}
+		case elf.EM_MIPS:
+			arch = "mips"
+			if f.Class == elf.ELFCLASS64 {
+				arch = "mips64"
+			}
+			if f.Data == elf.ELFDATA2LSB {
+				arch += "le"
+			}
+		}
+		if arch == "" {
+			arch = f.Machine.String()
+		}
+		return "ELF", arch, nil
+	case bytes.HasPrefix(data, []byte("MZ")):
+		f, err := pe.NewFile(r)
+		if err != nil {
+			return "PE", "", fmt.Errorf("invalid PE file: %v", err)
+		}
+		if arch = peArches[f.Machine]; arch == "" {
+			arch = fmt.Sprintf("machine %#x", f.Machine)
+		}
+		return "PE", arch, nil
+	case isMachO(data):
+		f, err := macho.NewFile(r)
+		if err != nil {
+			return "Mach-O", "", fmt.Errorf("invalid Mach-O file: %v", err)
+		}
+		if arch = machoArches[f.Cpu]; arch == "" {
+			arch = f.Cpu.String()
+		}
+		return "Mach-O", arch, nil
+	}
+	return "", "", nil
+}
+
+func isMachO(data []byte) bool {
+	if len(data) < 4 {
+		return false
+	}
+	for _, magic := range []uint32{macho.Magic32, macho.Magic64} {
+		if binary.LittleEndian.Uint32(data) == magic || binary.BigEndian.Uint32(data) == magic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,177 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package archivediff compares the content of two Go distribution archives.
+package archivediff
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"slices"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+// Entry is the metadata and content hash of one entry in an archive.
+type Entry struct {
+	Name     string      `json:"name"`
+	Linkname string      `json:"linkname,omitempty"`
+	Mode     fs.FileMode `json:"mode"`
+	Size     int64       `json:"size"`
+	ModTime  time.Time   `json:"modTime"`
+	// SHA256 is the hash of the content of a regular file.
+	SHA256 string `json:"sha256,omitempty"`
+}
+
+// Change describes an entry that is in both archives but differs.
+type Change struct {
+	Name string `json:"name"`
+	Old  *Entry `json:"old"`
+	New  *Entry `json:"new"`
+
+	ContentChanged  bool `json:"contentChanged,omitempty"`
+	ModeChanged     bool `json:"modeChanged,omitempty"`
+	ModTimeChanged  bool `json:"modTimeChanged,omitempty"`
+	LinknameChanged bool `json:"linknameChanged,omitempty"`
+
+	// Binary compares the Go build information of the old and new content, if the entry is a
+	// Go binary whose content changed.
+	Binary *BinaryDiff `json:"binary,omitempty"`
+}
+
+// Diff is the result of comparing two archives.
+type Diff struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+
+	Added    []*Entry  `json:"added,omitempty"`
+	Removed  []*Entry  `json:"removed,omitempty"`
+	Modified []*Change `json:"modified,omitempty"`
+}
+
+// Empty returns true if the archives have the same entries with the same content and metadata.
+func (d *Diff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0
+}
+
+// IgnoreModTime removes modification time changes from d, dropping entries that only differ by
+// modification time. Archives built at different times always have different times.
+func (d *Diff) IgnoreModTime() {
+	d.Modified = slices.DeleteFunc(d.Modified, func(c *Change) bool {
+		c.ModTimeChanged = false
+		return !c.ContentChanged && !c.ModeChanged && !c.LinknameChanged
+	})
+}
+
+// Compare compares the archives at oldPath and newPath entry-by-entry.
+func Compare(oldPath, newPath string) (*Diff, error) {
+	oldEntries, err := readEntries(oldPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", oldPath, err)
+	}
+	newEntries, err := readEntries(newPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %q: %v", newPath, err)
+	}
+
+	d := &Diff{Old: oldPath, New: newPath}
+	for name, n := range newEntries {
+		o, ok := oldEntries[name]
+		if !ok {
+			d.Added = append(d.Added, n)
+			continue
+		}
+		c := &Change{
+			Name:            name,
+			Old:             o,
+			New:             n,
+			ContentChanged:  o.SHA256 != n.SHA256 || o.Size != n.Size,
+			ModeChanged:     o.Mode != n.Mode,
+			ModTimeChanged:  !o.ModTime.Equal(n.ModTime),
+			LinknameChanged: o.Linkname != n.Linkname,
+		}
+		if c.ContentChanged || c.ModeChanged || c.ModTimeChanged || c.LinknameChanged {
+			d.Modified = append(d.Modified, c)
+		}
+	}
+	for name, o := range oldEntries {
+		if _, ok := newEntries[name]; !ok {
+			d.Removed = append(d.Removed, o)
+		}
+	}
+	slices.SortFunc(d.Added, func(a, b *Entry) int { return cmp.Compare(a.Name, b.Name) })
+	slices.SortFunc(d.Removed, func(a, b *Entry) int { return cmp.Compare(a.Name, b.Name) })
+	slices.SortFunc(d.Modified, func(a, b *Change) int { return cmp.Compare(a.Name, b.Name) })
+
+	if err := compareBinaries(oldPath, newPath, d.Modified); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// readEntries reads the metadata of every entry in the archive at path, hashing file content.
+func readEntries(path string) (map[string]*Entry, error) {
+	entries := make(map[string]*Entry)
+	err := archiveutil.EachArchiveEntry(path, func(e *archiveutil.Entry, r io.Reader) error {
+		if _, ok := entries[e.Name]; ok {
+			return fmt.Errorf("duplicate entry %q", e.Name)
+		}
+		entry := &Entry{
+			Name:     e.Name,
+			Linkname: e.Linkname,
+			Mode:     e.Mode,
+			Size:     e.Size,
+			ModTime:  e.ModTime,
+		}
+		if r != nil {
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return err
+			}
+			entry.SHA256 = hex.EncodeToString(h.Sum(nil))
+		}
+		entries[e.Name] = entry
+		return nil
+	})
+	return entries, err
+}
+
+// Print writes a human-readable summary of d to w.
+func (d *Diff) Print(w io.Writer) {
+	fmt.Fprintf(w, "Comparing %v -> %v\n", d.Old, d.New)
+	if d.Empty() {
+		fmt.Fprintf(w, "No differences.\n")
+		return
+	}
+	for _, e := range d.Added {
+		fmt.Fprintf(w, "+ %v\n", e.Name)
+	}
+	for _, e := range d.Removed {
+		fmt.Fprintf(w, "- %v\n", e.Name)
+	}
+	for _, c := range d.Modified {
+		fmt.Fprintf(w, "M %v\n", c.Name)
+		if c.ContentChanged {
+			fmt.Fprintf(w, "    content: %v (%v bytes) -> %v (%v bytes)\n", c.Old.SHA256, c.Old.Size, c.New.SHA256, c.New.Size)
+		}
+		if c.ModeChanged {
+			fmt.Fprintf(w, "    mode: %v -> %v\n", c.Old.Mode, c.New.Mode)
+		}
+		if c.ModTimeChanged {
+			fmt.Fprintf(w, "    mtime: %v -> %v\n", c.Old.ModTime.UTC(), c.New.ModTime.UTC())
+		}
+		if c.LinknameChanged {
+			fmt.Fprintf(w, "    link: %q -> %q\n", c.Old.Linkname, c.New.Linkname)
+		}
+		if c.Binary != nil {
+			c.Binary.print(w)
+		}
+	}
+	fmt.Fprintf(w, "%v added, %v removed, %v modified.\n", len(d.Added), len(d.Removed), len(d.Modified))
+}
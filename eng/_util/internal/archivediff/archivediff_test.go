@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package archivediff
+
+import (
+	"archive/tar"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+type testFile struct {
+	name    string
+	mode    int64
+	content string
+}
+
+func writeTestTarGz(t *testing.T, name string, files []testFile) string {
+	p := filepath.Join(t.TempDir(), name)
+	err := archiveutil.WithTarGzCreate(p, func(tw *tar.Writer) error {
+		for _, f := range files {
+			if err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     f.name,
+				Mode:     f.mode,
+				Size:     int64(len(f.content)),
+				ModTime:  time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+			}); err != nil {
+				return err
+			}
+			if _, err := tw.Write([]byte(f.content)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCompare(t *testing.T) {
+	oldPath := writeTestTarGz(t, "old.tar.gz", []testFile{
+		{"go/VERSION", 0o644, "go1.24.1"},
+		{"go/bin/go", 0o755, "binary"},
+		{"go/removed", 0o644, "x"},
+		{"go/same", 0o644, "same"},
+	})
+	newPath := writeTestTarGz(t, "new.tar.gz", []testFile{
+		{"go/VERSION", 0o644, "go1.24.2"},
+		{"go/bin/go", 0o777, "binary"},
+		{"go/added", 0o644, "y"},
+		{"go/same", 0o644, "same"},
+	})
+	d, err := Compare(oldPath, newPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Empty() {
+		t.Fatal("expected differences")
+	}
+	if len(d.Added) != 1 || d.Added[0].Name != "go/added" {
+		t.Errorf("Added = %v", d.Added)
+	}
+	if len(d.Removed) != 1 || d.Removed[0].Name != "go/removed" {
+		t.Errorf("Removed = %v", d.Removed)
+	}
+	if len(d.Modified) != 2 {
+		t.Fatalf("Modified = %v", d.Modified)
+	}
+	if c := d.Modified[0]; c.Name != "go/VERSION" || !c.ContentChanged || c.ModeChanged {
+		t.Errorf("Modified[0] = %+v", c)
+	}
+	if c := d.Modified[1]; c.Name != "go/bin/go" || c.ContentChanged || !c.ModeChanged {
+		t.Errorf("Modified[1] = %+v", c)
+	}
+
+	same, err := Compare(oldPath, oldPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same.Empty() {
+		t.Errorf("comparing archive with itself: %+v", same)
+	}
+}
+
+func TestDiffLines(t *testing.T) {
+	got := diffLines("go\tgo1.24\nbuild\tA=1\nbuild\tB=2\n", "go\tgo1.24\nbuild\tA=1\nbuild\tB=3\n")
+	want := []string{"-build\tB=2", "+build\tB=3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("diffLines() = %q, want %q", got, want)
+	}
+}
+
+func TestIgnoreModTime(t *testing.T) {
+	d := &Diff{Modified: []*Change{
+		{Name: "mtime-only", ModTimeChanged: true},
+		{Name: "content", ContentChanged: true, ModTimeChanged: true},
+	}}
+	d.IgnoreModTime()
+	if len(d.Modified) != 1 || d.Modified[0].Name != "content" || d.Modified[0].ModTimeChanged {
+		t.Errorf("Modified = %+v", d.Modified)
+	}
+}
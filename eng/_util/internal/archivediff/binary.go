@@ -0,0 +1,205 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package archivediff
+
+import (
+	"bytes"
+	"debug/buildinfo"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+// BinaryDiff compares the Go build information embedded in two versions of a binary.
+type BinaryDiff struct {
+	OldBuildID string `json:"oldBuildID,omitempty"`
+	NewBuildID string `json:"newBuildID,omitempty"`
+
+	// OldBuildInfo and NewBuildInfo are in the format printed by "go version -m".
+	OldBuildInfo string `json:"oldBuildInfo,omitempty"`
+	NewBuildInfo string `json:"newBuildInfo,omitempty"`
+
+	// BuildInfoDiff lists the lines of build info only in the old ("-") or new ("+") binary.
+	BuildInfoDiff []string `json:"buildInfoDiff,omitempty"`
+}
+
+// maxBinarySize is the largest entry read into memory to inspect its build information.
+const maxBinarySize = 512 << 20
+
+// compareBinaries fills in the Binary field of each change whose old and new content are both Go
+// binaries.
+func compareBinaries(oldPath, newPath string, changes []*Change) error {
+	wanted := make(map[string]*Change)
+	for _, c := range changes {
+		if c.ContentChanged && c.Old.Mode.IsRegular() && c.New.Mode.IsRegular() {
+			wanted[c.Name] = c
+		}
+	}
+	if len(wanted) == 0 {
+		return nil
+	}
+	oldContent, err := readBinaries(oldPath, wanted)
+	if err != nil {
+		return err
+	}
+	newContent, err := readBinaries(newPath, wanted)
+	if err != nil {
+		return err
+	}
+	for name, c := range wanted {
+		o, n := oldContent[name], newContent[name]
+		if o == nil || n == nil {
+			continue
+		}
+		oldInfo, oldErr := buildinfo.Read(bytes.NewReader(o))
+		newInfo, newErr := buildinfo.Read(bytes.NewReader(n))
+		if oldErr != nil || newErr != nil {
+			// Not a Go binary.
+			continue
+		}
+		bd := &BinaryDiff{
+			OldBuildID:   readBuildID(o),
+			NewBuildID:   readBuildID(n),
+			OldBuildInfo: oldInfo.String(),
+			NewBuildInfo: newInfo.String(),
+		}
+		bd.BuildInfoDiff = diffLines(bd.OldBuildInfo, bd.NewBuildInfo)
+		c.Binary = bd
+	}
+	return nil
+}
+
+// readBinaries reads the content of the wanted entries that start with an executable header.
+func readBinaries(path string, wanted map[string]*Change) (map[string][]byte, error) {
+	content := make(map[string][]byte)
+	err := archiveutil.EachArchiveEntry(path, func(e *archiveutil.Entry, r io.Reader) error {
+		if _, ok := wanted[e.Name]; !ok || r == nil || e.Size > maxBinarySize {
+			return nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if isExecutable(data) {
+			content[e.Name] = data
+		}
+		return nil
+	})
+	return content, err
+}
+
+// isExecutable returns true if data starts with an ELF, PE, or Mach-O header.
+func isExecutable(data []byte) bool {
+	switch {
+	case bytes.HasPrefix(data, []byte("\x7fELF")):
+		return true
+	case bytes.HasPrefix(data, []byte("MZ")):
+		return true
+	case len(data) >= 4:
+		switch binary.LittleEndian.Uint32(data) {
+		case 0xfeedface, 0xfeedfacf, 0xcefaedfe, 0xcffaedfe:
+			return true
+		}
+	}
+	return false
+}
+
+// goBuildIDPrefix and goBuildIDSuffix surround the build ID in the text segment of non-ELF Go
+// binaries. See cmd/internal/buildid.
+const (
+	goBuildIDPrefix = "\xff Go build ID: \""
+	goBuildIDSuffix = "\"\n \xff"
+)
+
+// readBuildID returns the Go build ID of the binary, or empty string if none is found.
+func readBuildID(data []byte) string {
+	if f, err := elf.NewFile(bytes.NewReader(data)); err == nil {
+		if id, err := readELFBuildID(f); err == nil {
+			return id
+		}
+	}
+	// Go places the build ID near the start of the text segment. Search the same range as
+	// cmd/internal/buildid.
+	search := data[:min(len(data), 32*1024)]
+	i := bytes.Index(search, []byte(goBuildIDPrefix))
+	if i < 0 {
+		return ""
+	}
+	rest := search[i+len(goBuildIDPrefix):]
+	j := bytes.Index(rest, []byte(goBuildIDSuffix))
+	if j < 0 {
+		return ""
+	}
+	return string(rest[:j])
+}
+
+// readELFBuildID reads the Go build ID from the ".note.go.buildid" section.
+func readELFBuildID(f *elf.File) (string, error) {
+	s := f.Section(".note.go.buildid")
+	if s == nil {
+		return "", errors.New("no Go build ID note")
+	}
+	note, err := s.Data()
+	if err != nil {
+		return "", err
+	}
+	// An ELF note is namesz, descsz, type, then the 4-byte aligned name and desc.
+	if len(note) < 16 {
+		return "", errors.New("Go build ID note too short")
+	}
+	namesz := f.ByteOrder.Uint32(note)
+	descsz := f.ByteOrder.Uint32(note[4:])
+	nameEnd := 12 + (int(namesz)+3)&^3
+	if namesz != 4 || string(note[12:16]) != "Go\x00\x00" || nameEnd+int(descsz) > len(note) {
+		return "", fmt.Errorf("unexpected Go build ID note format")
+	}
+	return string(note[nameEnd : nameEnd+int(descsz)]), nil
+}
+
+// diffLines returns the lines only in a, prefixed with "-", and then the lines only in b,
+// prefixed with "+". Order is kept, but it isn't a minimal edit script: build info is a list of
+// mostly unique lines, so this is enough to see what changed.
+func diffLines(a, b string) []string {
+	aLines := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+	bLines := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+	count := func(lines []string) map[string]int {
+		m := make(map[string]int)
+		for _, l := range lines {
+			m[l]++
+		}
+		return m
+	}
+	aCount, bCount := count(aLines), count(bLines)
+	var diff []string
+	for _, l := range aLines {
+		if bCount[l] > 0 {
+			bCount[l]--
+			continue
+		}
+		diff = append(diff, "-"+l)
+	}
+	for _, l := range bLines {
+		if aCount[l] > 0 {
+			aCount[l]--
+			continue
+		}
+		diff = append(diff, "+"+l)
+	}
+	return diff
+}
+
+func (bd *BinaryDiff) print(w io.Writer) {
+	if bd.OldBuildID != bd.NewBuildID {
+		fmt.Fprintf(w, "    build ID: %v -> %v\n", bd.OldBuildID, bd.NewBuildID)
+	}
+	for _, l := range bd.BuildInfoDiff {
+		fmt.Fprintf(w, "    build info: %v\n", l)
+	}
+}
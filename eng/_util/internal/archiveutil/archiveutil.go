@@ -0,0 +1,220 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package archiveutil contains helpers to safely read and write the zip and tar.gz archives
+// used to distribute Go.
+package archiveutil
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"cmp"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// EachZipEntry calls f for each file in r. Returns an error without calling f if a file has a
+// non-local path such as an absolute path or one that contains "..".
+func EachZipEntry(r *zip.ReadCloser, f func(*zip.File) error) error {
+	return eachZipEntry(r, true, f)
+}
+
+func eachZipEntry(r *zip.ReadCloser, checkLocal bool, f func(*zip.File) error) error {
+	for _, file := range r.File {
+		// Disallow absolute path, "..", etc.
+		if checkLocal && !filepath.IsLocal(file.Name) {
+			return fmt.Errorf("zip contains non-local path: %s", file.Name)
+		}
+		if err := f(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EachTarEntry calls f for each entry in r with a reader for its content. Returns an error
+// without calling f if an entry has a non-local path such as an absolute path or one that contains
+// "..".
+func EachTarEntry(r *tar.Reader, f func(*tar.Header, io.Reader) error) error {
+	return eachTarEntry(r, true, f)
+}
+
+func eachTarEntry(r *tar.Reader, checkLocal bool, f func(*tar.Header, io.Reader) error) error {
+	for {
+		header, err := r.Next()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		// Disallow absolute path, "..", etc.
+		if checkLocal && !filepath.IsLocal(header.Name) {
+			return fmt.Errorf("tar contains non-local path: %s", header.Name)
+		}
+		if err := f(header, r); err != nil {
+			return err
+		}
+	}
+}
+
+// WithFileOpen opens the file at path, calls f with it, then closes it.
+func WithFileOpen(path string, f func(*os.File) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return cmp.Or(f(file), file.Close())
+}
+
+// WithZipOpen opens the zip file at path, calls f with it, then closes it.
+func WithZipOpen(path string, f func(*zip.ReadCloser) error) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	return cmp.Or(f(r), r.Close())
+}
+
+// WithTarGzOpen opens the tar.gz file at path and calls f with a reader for its entries.
+func WithTarGzOpen(path string, f func(*tar.Reader) error) error {
+	return WithFileOpen(path, func(file *os.File) error {
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		r := tar.NewReader(gz)
+		return f(r)
+	})
+}
+
+// WithFileCreate creates the file at path and any missing parent dirs, calls f with it, then
+// closes it.
+func WithFileCreate(path string, f func(*os.File) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	return cmp.Or(f(file), file.Close())
+}
+
+// WithZipCreate creates a zip file at path, calls f to populate it, then closes it.
+func WithZipCreate(path string, f func(*zip.Writer) error) error {
+	return WithFileCreate(path, func(file *os.File) error {
+		w := zip.NewWriter(file)
+		return cmp.Or(f(w), w.Close())
+	})
+}
+
+// WithTarGzCreate creates a tar.gz file at path, calls f to populate it, then closes it.
+func WithTarGzCreate(path string, f func(*tar.Writer) error) error {
+	return WithFileCreate(path, func(file *os.File) error {
+		gzw, err := gzip.NewWriterLevel(file, gzip.BestCompression)
+		if err != nil {
+			return err
+		}
+		tw := tar.NewWriter(gzw)
+		return cmp.Or(f(tw), tw.Close(), gzw.Close())
+	})
+}
+
+// CopyFile copies the content of src to dst, creating dst's parent dirs if necessary.
+func CopyFile(dst, src string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	return cmp.Or(CopyToFile(dst, f), f.Close())
+}
+
+// CopyToFile writes the content of r to the file at path, creating parent dirs if necessary.
+func CopyToFile(path string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o777); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	return cmp.Or(err, f.Close())
+}
+
+// Entry describes a file, directory, or link in a zip or tar.gz archive.
+type Entry struct {
+	// Name is the slash-separated path of the entry in the archive.
+	Name string
+	// Linkname is the target of a tar link entry.
+	Linkname string
+	// Mode includes the type bits (e.g. fs.ModeDir) and permission bits, including setuid.
+	Mode    fs.FileMode
+	Size    int64
+	ModTime time.Time
+}
+
+// EachArchiveEntry calls f for each entry in the zip or tar.gz archive at path, choosing the
+// format based on the file extension. For regular files, r reads the entry's content. Returns an
+// error without calling f if an entry has a non-local path.
+func EachArchiveEntry(path string, f func(e *Entry, r io.Reader) error) error {
+	return eachArchiveEntry(path, true, f)
+}
+
+// InspectArchiveEntries is like EachArchiveEntry, but calls f for entries with non-local paths
+// rather than returning an error. Use it to inspect an untrusted archive, never to extract one.
+func InspectArchiveEntries(path string, f func(e *Entry, r io.Reader) error) error {
+	return eachArchiveEntry(path, false, f)
+}
+
+func eachArchiveEntry(path string, checkLocal bool, f func(e *Entry, r io.Reader) error) error {
+	switch {
+	case strings.HasSuffix(path, ".zip"):
+		return WithZipOpen(path, func(zr *zip.ReadCloser) error {
+			return eachZipEntry(zr, checkLocal, func(file *zip.File) error {
+				info := file.FileInfo()
+				e := &Entry{
+					Name:    file.Name,
+					Mode:    info.Mode(),
+					Size:    info.Size(),
+					ModTime: file.Modified,
+				}
+				if !e.Mode.IsRegular() {
+					return f(e, nil)
+				}
+				r, err := file.Open()
+				if err != nil {
+					return err
+				}
+				return cmp.Or(f(e, r), r.Close())
+			})
+		})
+	case strings.HasSuffix(path, ".tar.gz"):
+		return WithTarGzOpen(path, func(tr *tar.Reader) error {
+			return eachTarEntry(tr, checkLocal, func(hdr *tar.Header, r io.Reader) error {
+				info := hdr.FileInfo()
+				e := &Entry{
+					Name:     hdr.Name,
+					Linkname: hdr.Linkname,
+					Mode:     info.Mode(),
+					Size:     hdr.Size,
+					ModTime:  hdr.ModTime,
+				}
+				if !e.Mode.IsRegular() {
+					r = nil
+				}
+				return f(e, r)
+			})
+		})
+	}
+	return fmt.Errorf("unknown archive type, expected .zip or .tar.gz: %s", path)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checksum
+
+import (
+	"crypto/sha256"
+	"crypto/sha3"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Algorithm is a checksum algorithm and the names of the files that record its checksums.
+type Algorithm struct {
+	// Name is the name used on the command line, e.g. "sha256".
+	Name string
+	// Ext is the extension of a sidecar checksum file, e.g. ".sha256".
+	Ext string
+	// ManifestName is the name of a combined checksum manifest, e.g. "SHA256SUMS".
+	ManifestName string
+	// Size is the length of a checksum in bytes.
+	Size int
+	New  func() hash.Hash
+}
+
+var (
+	SHA256 = &Algorithm{
+		Name:         "sha256",
+		Ext:          ".sha256",
+		ManifestName: "SHA256SUMS",
+		Size:         sha256.Size,
+		New:          sha256.New,
+	}
+	SHA512 = &Algorithm{
+		Name:         "sha512",
+		Ext:          ".sha512",
+		ManifestName: "SHA512SUMS",
+		Size:         sha512.Size,
+		New:          sha512.New,
+	}
+	SHA3_256 = &Algorithm{
+		Name:         "sha3-256",
+		Ext:          ".sha3-256",
+		ManifestName: "SHA3-256SUMS",
+		Size:         32,
+		New:          func() hash.Hash { return sha3.New256() },
+	}
+)
+
+// Algorithms are the supported algorithms.
+var Algorithms = []*Algorithm{SHA256, SHA512, SHA3_256}
+
+// ParseAlgorithms parses a comma-separated list of algorithm names, such as "sha256,sha512".
+func ParseAlgorithms(s string) ([]*Algorithm, error) {
+	var algs []*Algorithm
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		a := algorithmByName(name)
+		if a == nil {
+			var names []string
+			for _, a := range Algorithms {
+				names = append(names, a.Name)
+			}
+			return nil, fmt.Errorf("unknown checksum algorithm %q, expected one of %v", name, strings.Join(names, ", "))
+		}
+		algs = append(algs, a)
+	}
+	if len(algs) == 0 {
+		return nil, fmt.Errorf("no checksum algorithms in %q", s)
+	}
+	return algs, nil
+}
+
+func algorithmByName(name string) *Algorithm {
+	for _, a := range Algorithms {
+		if strings.EqualFold(a.Name, name) {
+			return a
+		}
+	}
+	return nil
+}
+
+// HashFile reads the file at path once and returns its hex-encoded checksum for each of algs, in
+// the same order.
+func HashFile(path string, algs []*Algorithm) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return hashReader(f, algs)
+}
+
+func hashReader(r io.Reader, algs []*Algorithm) ([]string, error) {
+	hashes := make([]hash.Hash, len(algs))
+	writers := make([]io.Writer, len(algs))
+	for i, a := range algs {
+		hashes[i] = a.New()
+		writers[i] = hashes[i]
+	}
+	if _, err := io.Copy(io.MultiWriter(writers...), r); err != nil {
+		return nil, err
+	}
+	sums := make([]string, len(algs))
+	for i, h := range hashes {
+		sums[i] = hex.EncodeToString(h.Sum(nil))
+	}
+	return sums, nil
+}
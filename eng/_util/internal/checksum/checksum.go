@@ -1,32 +1,149 @@
 package checksum
 
 import (
-	"crypto/sha256"
-	"encoding/hex"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 )
 
+// FileSHA256 returns the hex-encoded SHA256 checksum of the file at path.
+func FileSHA256(path string) (string, error) {
+	sums, err := HashFile(path, []*Algorithm{SHA256})
+	if err != nil {
+		return "", err
+	}
+	return sums[0], nil
+}
+
 func WriteSHA256ChecksumFile(path string) error {
-	file, err := os.Open(path)
+	return Write([]string{path}, &WriteOptions{})
+}
+
+// WriteOptions configures Write.
+type WriteOptions struct {
+	// Algorithms to write checksums for. Defaults to SHA256.
+	Algorithms []*Algorithm
+	// NoSidecars disables writing a sidecar checksum file next to each file.
+	NoSidecars bool
+	// ManifestDir, if set, is the dir to write a combined manifest to for each algorithm, such as
+	// "SHA256SUMS". Each file is listed by its path relative to ManifestDir.
+	ManifestDir string
+}
+
+// Write reads each file in paths once, computing the checksums for all the algorithms at the
+// same time, then writes the sidecar checksum files and manifests specified by o.
+func Write(paths []string, o *WriteOptions) error {
+	algs := o.Algorithms
+	if len(algs) == 0 {
+		algs = []*Algorithm{SHA256}
+	}
+	// manifests[i] is the content of the manifest for algs[i].
+	manifests := make([]strings.Builder, len(algs))
+	for _, path := range paths {
+		sums, err := HashFile(path, algs)
+		if err != nil {
+			return err
+		}
+		for i, a := range algs {
+			if !o.NoSidecars {
+				// Use the base path of the file (not full path, not relative path) because then
+				// "sha256sum -c" automatically works when the file and the checksum file are
+				// downloaded to the same directory.
+				content := formatLine(sums[i], filepath.Base(path))
+				outputPath := path + a.Ext
+				if err := os.WriteFile(outputPath, []byte(content), 0o666); err != nil {
+					return err
+				}
+				fmt.Printf("Wrote checksum file %q with content: %v", outputPath, content)
+			}
+			if o.ManifestDir != "" {
+				rel, err := filepath.Rel(o.ManifestDir, path)
+				if err != nil {
+					return err
+				}
+				manifests[i].WriteString(formatLine(sums[i], filepath.ToSlash(rel)))
+			}
+		}
+	}
+	if o.ManifestDir == "" {
+		return nil
+	}
+	for i, a := range algs {
+		outputPath := filepath.Join(o.ManifestDir, a.ManifestName)
+		if err := os.WriteFile(outputPath, []byte(manifests[i].String()), 0o666); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote checksum manifest %q listing %v files\n", outputPath, len(paths))
+	}
+	return nil
+}
+
+// formatLine returns a line in the text format of "sha256sum". If name contains a backslash or
+// newline, it's escaped and the line starts with a backslash, like "sha256sum" does.
+func formatLine(sum, name string) string {
+	if strings.ContainsAny(name, "\\\n\r") {
+		name = strings.NewReplacer(`\`, `\\`, "\n", `\n`, "\r", `\r`).Replace(name)
+		return fmt.Sprintf("\\%v  %v\n", sum, name)
+	}
+	return fmt.Sprintf("%v  %v\n", sum, name)
+}
+
+// ManifestFiles returns the regular files in dir and its subdirs, sorted, excluding checksum
+// files.
+func ManifestFiles(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() && !IsChecksumFile(path) {
+			files = append(files, path)
+		}
+		return nil
+	})
 	if err != nil {
-		return err
-	}
-	defer file.Close()
-	checksum := sha256.New()
-	if _, err = io.Copy(checksum, file); err != nil {
-		return err
-	}
-	// Write the checksum in a format that "sha256sum -c" can work with. Use the base path of the
-	// tarball (not full path, not relative path) because then "sha256sum -c" automatically works
-	// when the file and the checksum file are downloaded to the same directory.
-	content := fmt.Sprintf("%v  %v\n", hex.EncodeToString(checksum.Sum(nil)), filepath.Base(path))
-	outputPath := path + ".sha256"
-	if err := os.WriteFile(outputPath, []byte(content), 0o666); err != nil {
-		return err
-	}
-	fmt.Printf("Wrote checksum file %q with content: %v", outputPath, content)
+		return nil, err
+	}
+	slices.Sort(files)
+	return files, nil
+}
+
+// IsChecksumFile returns true if path is named like a sidecar checksum file or a manifest of one
+// of the supported algorithms.
+func IsChecksumFile(path string) bool {
+	return algorithmForFile(path) != nil
+}
+
+// algorithmForFile returns the algorithm used by the checksum file at path based on its name, or
+// nil if it isn't named like a checksum file.
+func algorithmForFile(path string) *Algorithm {
+	base := filepath.Base(path)
+	for _, a := range Algorithms {
+		if base == a.ManifestName || strings.HasSuffix(base, a.Ext) {
+			return a
+		}
+	}
 	return nil
 }
+
+// ReadSHA256ChecksumFile returns the checksum recorded for path in the checksum file written by
+// WriteSHA256ChecksumFile.
+func ReadSHA256ChecksumFile(path string) (string, error) {
+	checksumPath := path + SHA256.Ext
+	entries, malformed, err := ReadChecksumFile(checksumPath)
+	if err != nil {
+		return "", err
+	}
+	if len(malformed) > 0 {
+		return "", malformed[0]
+	}
+	if len(entries) != 1 {
+		return "", fmt.Errorf("checksum file %q: expected one checksum, got %v", checksumPath, len(entries))
+	}
+	if name := entries[0].Name; name != filepath.Base(path) {
+		return "", fmt.Errorf("checksum file %q is for %q, not %q", checksumPath, name, filepath.Base(path))
+	}
+	return entries[0].Sum, nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checksum
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAndVerify(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.txt")
+	b := filepath.Join(dir, "sub", "b.txt")
+	if err := os.MkdirAll(filepath.Dir(b), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{a, b} {
+		if err := os.WriteFile(p, []byte(filepath.Base(p)), 0o666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ManifestFiles(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Write(files, &WriteOptions{Algorithms: Algorithms, ManifestDir: dir}); err != nil {
+		t.Fatal(err)
+	}
+
+	sum, err := ReadSHA256ChecksumFile(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The SHA256 of the content, "a.txt".
+	if want := "18b7cb099a9ea3f50ba899b5ba81e0d377a5f3b16f8f6eeb8b3e58cd4692b993"; sum != want {
+		t.Errorf("ReadSHA256ChecksumFile = %q, want %q", sum, want)
+	}
+
+	var entries []Entry
+	for _, a := range Algorithms {
+		e, malformed, err := ReadChecksumFile(filepath.Join(dir, a.ManifestName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(malformed) > 0 || len(e) != 2 {
+			t.Fatalf("%v: got %v entries and malformed lines %v, want 2 entries", a.ManifestName, len(e), malformed)
+		}
+		entries = append(entries, e...)
+	}
+	for _, r := range Verify(entries, 2) {
+		if r.Err != nil {
+			t.Errorf("%v (%v): %v", r.Path, r.Algorithm.Name, r.Err)
+		}
+	}
+
+	if err := os.WriteFile(b, []byte("changed"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(a); err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range Verify(entries, 2) {
+		switch r.Path {
+		case a:
+			if !errors.Is(r.Err, os.ErrNotExist) {
+				t.Errorf("%v (%v): got %v, want not exist", r.Path, r.Algorithm.Name, r.Err)
+			}
+		case b:
+			if r.Err != ErrMismatch || r.Actual == "" || r.Actual == r.Sum {
+				t.Errorf("%v (%v): got %v, actual %q, want mismatch", r.Path, r.Algorithm.Name, r.Err, r.Actual)
+			}
+		}
+	}
+}
+
+func TestParseLine(t *testing.T) {
+	const sum = "9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08"
+	tests := []struct {
+		line    string
+		alg     *Algorithm
+		name    string
+		wantErr bool
+	}{
+		{sum + "  go.zip", SHA256, "go.zip", false},
+		{sum + " *go.zip", SHA256, "go.zip", false},
+		{sum + "  dir/a b.zip", SHA256, "dir/a b.zip", false},
+		{`\` + sum + `  a\\b\nc`, SHA256, "a\\b\nc", false},
+		{"SHA256 (go.zip) = " + sum, SHA256, "go.zip", false},
+		{"SHA3-256 (go (1).zip) = " + sum, SHA3_256, "go (1).zip", false},
+		{sum + " go.zip", nil, "", true},
+		{sum + "  ", nil, "", true},
+		{sum[1:] + "  go.zip", nil, "", true},
+		{"SHA512 (go.zip) = " + sum, nil, "", true},
+		{"zz" + sum[2:] + "  go.zip", nil, "", true},
+	}
+	for _, tt := range tests {
+		e, err := parseLine(tt.line, nil)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseLine(%q) succeeded, want error", tt.line)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseLine(%q): %v", tt.line, err)
+			continue
+		}
+		if e.Algorithm != tt.alg || e.Name != tt.name || e.Sum != sum {
+			t.Errorf("parseLine(%q) = %v, %q, %q; want %v, %q, %q", tt.line, e.Algorithm.Name, e.Name, e.Sum, tt.alg.Name, tt.name, sum)
+		}
+	}
+}
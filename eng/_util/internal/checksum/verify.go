@@ -0,0 +1,249 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package checksum
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ErrMismatch is the error in a Result when a file's checksum doesn't match the checksum file.
+var ErrMismatch = errors.New("checksum mismatch")
+
+// Entry is one checksum listed in a checksum file.
+type Entry struct {
+	Algorithm *Algorithm
+	// Sum is the hex-encoded checksum, in lowercase.
+	Sum string
+	// Name is the file name as written in the checksum file.
+	Name string
+	// Path is the path of the file: Name resolved relative to the dir containing the checksum
+	// file.
+	Path string
+
+	// ChecksumFile and Line are the location of this entry.
+	ChecksumFile string
+	Line         int
+}
+
+// ReadChecksumFile reads the sidecar checksum file or manifest at path. It accepts lines in the
+// formats written by "sha256sum" and similar tools:
+//
+//	<hex>  <name>            text mode
+//	<hex> *<name>            binary mode
+//	\<hex>  <escaped name>   name containing "\\", "\n", or "\r"
+//	SHA256 (<name>) = <hex>  BSD style, "sha256sum --tag"
+//
+// The algorithm of a line without a tag comes from the checksum file's name, such as "x.sha512"
+// or "SHA512SUMS". If the name doesn't indicate an algorithm, it's inferred from the checksum
+// length, which only works for SHA256 and SHA512.
+//
+// Blank lines are skipped. Lines that can't be parsed are returned as malformed, and don't stop
+// the rest of the file from being read.
+func ReadChecksumFile(path string) (entries []Entry, malformed []error, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	fileAlg := algorithmForFile(path)
+	dir := filepath.Dir(path)
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		e, err := parseLine(text, fileAlg)
+		if err != nil {
+			malformed = append(malformed, fmt.Errorf("%v:%v: %v", path, line, err))
+			continue
+		}
+		e.Path = filepath.Join(dir, filepath.FromSlash(e.Name))
+		e.ChecksumFile = path
+		e.Line = line
+		entries = append(entries, e)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	return entries, malformed, nil
+}
+
+func parseLine(text string, fileAlg *Algorithm) (Entry, error) {
+	escaped := strings.HasPrefix(text, `\`)
+	if escaped {
+		text = text[1:]
+	}
+
+	var e Entry
+	if tag, rest, ok := strings.Cut(text, " ("); ok && algorithmByName(tag) != nil {
+		i := strings.LastIndex(rest, ") = ")
+		if i < 0 {
+			return e, errors.New("improperly formatted tagged checksum line")
+		}
+		e.Algorithm = algorithmByName(tag)
+		e.Name, e.Sum = rest[:i], rest[i+len(") = "):]
+	} else {
+		sum, rest, ok := strings.Cut(text, " ")
+		if !ok || rest == "" || (rest[0] != ' ' && rest[0] != '*') {
+			return e, errors.New("improperly formatted checksum line")
+		}
+		e.Sum, e.Name = sum, rest[1:]
+		e.Algorithm = fileAlg
+		if e.Algorithm == nil {
+			for _, a := range []*Algorithm{SHA256, SHA512} {
+				if len(e.Sum) == a.Size*2 {
+					e.Algorithm = a
+				}
+			}
+			if e.Algorithm == nil {
+				return e, fmt.Errorf("can't determine algorithm of %v-character checksum", len(e.Sum))
+			}
+		}
+	}
+
+	if len(e.Sum) != e.Algorithm.Size*2 {
+		return e, fmt.Errorf("%v checksum has %v characters, expected %v", e.Algorithm.Name, len(e.Sum), e.Algorithm.Size*2)
+	}
+	if _, err := hex.DecodeString(e.Sum); err != nil {
+		return e, fmt.Errorf("checksum is not hex: %v", err)
+	}
+	e.Sum = strings.ToLower(e.Sum)
+
+	if escaped {
+		name, err := unescapeName(e.Name)
+		if err != nil {
+			return e, err
+		}
+		e.Name = name
+	}
+	if e.Name == "" {
+		return e, errors.New("missing file name")
+	}
+	return e, nil
+}
+
+func unescapeName(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return "", errors.New("file name ends with an unfinished escape sequence")
+		}
+		switch s[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			return "", fmt.Errorf("unknown escape sequence \\%c in file name", s[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// Sidecars returns the sidecar checksum files that exist next to path, for any algorithm.
+func Sidecars(path string) ([]string, error) {
+	var sidecars []string
+	for _, a := range Algorithms {
+		p := path + a.Ext
+		if _, err := os.Stat(p); err == nil {
+			sidecars = append(sidecars, p)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+	}
+	return sidecars, nil
+}
+
+// Result is the outcome of checking one Entry.
+type Result struct {
+	Entry
+	// Actual is the checksum of the file, or "" if it couldn't be read.
+	Actual string
+	// Err is nil if the file's checksum matches, ErrMismatch if it doesn't, or the error that
+	// prevented the file from being read.
+	Err error
+}
+
+// Verify checks each entry against the file it refers to and returns the results in the same
+// order as entries. Each file is read once, even if multiple entries refer to it. Up to jobs files
+// are read at once. If jobs is less than 1, the number of CPUs is used.
+func Verify(entries []Entry, jobs int) []Result {
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+
+	// Group the algorithms needed for each file.
+	type fileJob struct {
+		path string
+		algs []*Algorithm
+		sums []string
+		err  error
+	}
+	var files []fileJob
+	fileIndex := make(map[string]int)
+	for _, e := range entries {
+		i, ok := fileIndex[e.Path]
+		if !ok {
+			i = len(files)
+			fileIndex[e.Path] = i
+			files = append(files, fileJob{path: e.Path})
+		}
+		if !slices.Contains(files[i].algs, e.Algorithm) {
+			files[i].algs = append(files[i].algs, e.Algorithm)
+		}
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(jobs, len(files)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				f := &files[i]
+				f.sums, f.err = HashFile(f.path, f.algs)
+			}
+		}()
+	}
+	for i := range files {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	results := make([]Result, len(entries))
+	for i, e := range entries {
+		results[i].Entry = e
+		f := &files[fileIndex[e.Path]]
+		if f.err != nil {
+			results[i].Err = f.err
+			continue
+		}
+		results[i].Actual = f.sums[slices.Index(f.algs, e.Algorithm)]
+		if results[i].Actual != e.Sum {
+			results[i].Err = ErrMismatch
+		}
+	}
+	return results
+}
@@ -0,0 +1,255 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxpkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const arMagic = "!<arch>\n"
+
+// WriteDeb writes a Debian package containing the Go distribution tar.gz at archivePath to w.
+func WriteDeb(w io.Writer, archivePath string, m *Metadata) error {
+	files, err := scanDistribution(archivePath, m.Prefix)
+	if err != nil {
+		return err
+	}
+	arch, ok := archs[m.GOARCH]
+	if !ok {
+		return fmt.Errorf("unsupported GOARCH %q", m.GOARCH)
+	}
+	modTime := buildTime(files)
+
+	// The ar header of each member includes its size, so write the data to a temp file first.
+	data, err := os.CreateTemp("", "linuxpkg-deb-data-*.tar.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(data.Name())
+	defer data.Close()
+	if err := writeGzipTar(data, func(tw *tar.Writer) error {
+		// Like dpkg-deb, include the parent dirs of the install prefix.
+		var parents []string
+		for p := path.Dir(m.Prefix); p != "/"; p = path.Dir(p) {
+			parents = append([]string{p}, parents...)
+		}
+		for _, p := range append([]string{"/"}, parents...) {
+			if err := writeDebTarEntry(tw, &file{path: p, mode: os.ModeDir | 0o755, modTime: modTime}, nil); err != nil {
+				return err
+			}
+		}
+		return eachContent(archivePath, files, func(f *file, r io.Reader) error {
+			return writeDebTarEntry(tw, f, r)
+		})
+	}); err != nil {
+		return err
+	}
+	dataSize, err := data.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := data.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var control bytes.Buffer
+	fmt.Fprintf(&control, "Package: %v\n", m.Name)
+	fmt.Fprintf(&control, "Version: %v-%v\n", m.packageVersion(), m.Release)
+	fmt.Fprintf(&control, "Architecture: %v\n", arch.deb)
+	fmt.Fprintf(&control, "Maintainer: %v\n", m.Maintainer)
+	fmt.Fprintf(&control, "Installed-Size: %v\n", (installedSize(files)+1023)/1024)
+	fmt.Fprintf(&control, "Section: devel\n")
+	fmt.Fprintf(&control, "Priority: optional\n")
+	fmt.Fprintf(&control, "Homepage: %v\n", m.URL)
+	fmt.Fprintf(&control, "Description: %v\n %v\n", m.Summary, m.Description)
+
+	var md5sums bytes.Buffer
+	for _, f := range files {
+		if f.mode.IsRegular() {
+			fmt.Fprintf(&md5sums, "%v  %v\n", f.md5, strings.TrimPrefix(f.path, "/"))
+		}
+	}
+
+	var controlTar bytes.Buffer
+	if err := writeGzipTar(&controlTar, func(tw *tar.Writer) error {
+		if err := writeDebTarEntry(tw, &file{path: "/", mode: os.ModeDir | 0o755, modTime: modTime}, nil); err != nil {
+			return err
+		}
+		for _, c := range []struct {
+			name string
+			data []byte
+		}{
+			{"/control", control.Bytes()},
+			{"/md5sums", md5sums.Bytes()},
+		} {
+			f := &file{path: c.name, mode: 0o644, modTime: modTime, size: int64(len(c.data))}
+			if err := writeDebTarEntry(tw, f, bytes.NewReader(c.data)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	bw := bufio.NewWriter(w)
+	if _, err := bw.WriteString(arMagic); err != nil {
+		return err
+	}
+	for _, member := range []struct {
+		name string
+		size int64
+		r    io.Reader
+	}{
+		{"debian-binary", 4, strings.NewReader("2.0\n")},
+		{"control.tar.gz", int64(controlTar.Len()), &controlTar},
+		{"data.tar.gz", dataSize, data},
+	} {
+		if err := writeArMember(bw, member.name, modTime, member.size, member.r); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+func writeGzipTar(w io.Writer, f func(tw *tar.Writer) error) error {
+	gw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gw)
+	if err := f(tw); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// writeDebTarEntry writes f to tw with a "./"-relative name, owned by root.
+func writeDebTarEntry(tw *tar.Writer, f *file, r io.Reader) error {
+	hdr := &tar.Header{
+		Name:    "." + f.path,
+		Mode:    int64(f.mode.Perm()),
+		ModTime: f.modTime,
+		Uname:   "root",
+		Gname:   "root",
+	}
+	switch {
+	case f.mode.IsDir():
+		hdr.Typeflag = tar.TypeDir
+		if !strings.HasSuffix(hdr.Name, "/") {
+			hdr.Name += "/"
+		}
+	case f.mode&os.ModeSymlink != 0:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = f.linkname
+	default:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = f.size
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		if _, err := io.Copy(tw, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeArMember(w io.Writer, name string, modTime time.Time, size int64, r io.Reader) error {
+	if len(name) > 16 {
+		return fmt.Errorf("ar member name %q is too long", name)
+	}
+	if _, err := fmt.Fprintf(w, "%-16s%-12d%-6d%-6d%-8o%-10d`\n", name, modTime.Unix(), 0, 0, 0o100644, size); err != nil {
+		return err
+	}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return fmt.Errorf("ar member %q: wrote %v bytes, expected %v", name, n, size)
+	}
+	// Each member starts on an even offset.
+	if size%2 != 0 {
+		if _, err := w.Write([]byte{'\n'}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Member describes a member of the ar archive that makes up a Debian package.
+type Member struct {
+	Name   string
+	Size   int64
+	SHA256 string
+}
+
+// ReadDebMembers returns the members of the Debian package at path, in order.
+func ReadDebMembers(path string) ([]Member, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(arMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != arMagic {
+		return nil, fmt.Errorf("%v is not an ar archive", path)
+	}
+	var members []Member
+	for {
+		var hdr [60]byte
+		if _, err := io.ReadFull(r, hdr[:]); err != nil {
+			if errors.Is(err, io.EOF) {
+				return members, nil
+			}
+			return nil, fmt.Errorf("%v: reading ar header: %v", path, err)
+		}
+		if string(hdr[58:]) != "`\n" {
+			return nil, fmt.Errorf("%v: invalid ar header %q", path, hdr)
+		}
+		name := strings.TrimSuffix(strings.TrimRight(string(hdr[:16]), " "), "/")
+		size, err := strconv.ParseInt(strings.TrimRight(string(hdr[48:58]), " "), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%v: ar member %q: invalid size: %v", path, name, err)
+		}
+		h := sha256.New()
+		if _, err := io.CopyN(h, r, size); err != nil {
+			return nil, fmt.Errorf("%v: ar member %q: %v", path, name, err)
+		}
+		members = append(members, Member{Name: name, Size: size, SHA256: hex.EncodeToString(h.Sum(nil))})
+		if size%2 != 0 {
+			if _, err := r.Discard(1); err != nil {
+				return nil, fmt.Errorf("%v: ar member %q: %v", path, name, err)
+			}
+		}
+	}
+}
+
+// IsDebSignatureMember returns true if name is the name of a member that holds a signature of the
+// package, such as "_gpgorigin" added by debsigs.
+func IsDebSignatureMember(name string) bool {
+	return strings.HasPrefix(name, "_gpg")
+}
@@ -0,0 +1,298 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package linuxpkg creates Debian (.deb) and RPM (.rpm) packages from a Go distribution tar.gz,
+// without depending on dpkg or rpm tooling.
+package linuxpkg
+
+import (
+	"archive/tar"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+// Metadata describes a package.
+type Metadata struct {
+	// Name is the name of the package, such as "msft-golang".
+	Name string
+	// Version is the upstream Go version, such as "1.24.1" or "1.25rc1".
+	Version string
+	// Release is the revision of the package, such as "1".
+	Release string
+	// GOARCH is the architecture of the Go distribution.
+	GOARCH string
+
+	Maintainer  string
+	Summary     string
+	Description string
+	License     string
+	URL         string
+
+	// Prefix is the absolute path the distribution's "go" dir is installed to.
+	Prefix string
+}
+
+// DefaultName is the name of the packages.
+const DefaultName = "msft-golang"
+
+// DefaultPrefix is the dir the packages install the Go distribution to.
+const DefaultPrefix = "/opt/microsoft/go"
+
+var archiveNameRegexp = regexp.MustCompile(`^go.*\.linux-([0-9a-z]+)\.tar\.gz$`)
+
+// versionRegexp matches the Go versions that can be package versions: a release or prerelease.
+// A development version like "1.25-abcde1234" can't, because RPM doesn't allow "-" in a version.
+var versionRegexp = regexp.MustCompile(`^[0-9]+\.[0-9]+(?:\.[0-9]+)?(?:(?:rc|beta)[0-9]+)?$`)
+
+// releaseRegexp matches the package releases allowed by both package managers.
+var releaseRegexp = regexp.MustCompile(`^[0-9A-Za-z.]+$`)
+
+// MetadataFromArchive returns the default metadata for a package of the Go distribution tar.gz at
+// archivePath, with the given package release, such as "1". The version comes from the go/VERSION
+// file in the archive. Only the architecture comes from the file name, such as
+// "go1.24.1-20241016.3.linux-amd64.tar.gz": the part after the version is the ID of the build that
+// created the archive, like a CI build number or "dev", and isn't part of the package version.
+func MetadataFromArchive(archivePath, release string) (*Metadata, error) {
+	name := filepath.Base(archivePath)
+	m := archiveNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return nil, fmt.Errorf("file name %q isn't a Linux Go distribution archive name like go1.24.1-20241016.3.linux-amd64.tar.gz", name)
+	}
+	arch := m[1]
+	// Go's download page calls GOARCH=arm "armv6l".
+	if arch == "armv6l" {
+		arch = "arm"
+	}
+	if _, ok := archs[arch]; !ok {
+		return nil, fmt.Errorf("unsupported architecture %q in %q", arch, name)
+	}
+	if !releaseRegexp.MatchString(release) {
+		return nil, fmt.Errorf("package release %q isn't made of letters, digits, and dots", release)
+	}
+	version, err := readVersion(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	if !versionRegexp.MatchString(version) {
+		return nil, fmt.Errorf("Go version %q of %q can't be a package version", version, archivePath)
+	}
+	return &Metadata{
+		Name:        DefaultName,
+		Version:     version,
+		Release:     release,
+		GOARCH:      arch,
+		Maintainer:  "Microsoft <gotoolkit@microsoft.com>",
+		Summary:     "The Microsoft build of Go",
+		Description: "The Microsoft build of Go, a fork of the Go programming language toolchain with additional features such as FIPS 140-2 support.",
+		License:     "BSD-3-Clause",
+		URL:         "https://github.com/microsoft/go",
+		Prefix:      DefaultPrefix,
+	}, nil
+}
+
+// readVersion returns the Go version in the first line of the go/VERSION file in the tar.gz at
+// archivePath, without the "go" prefix.
+func readVersion(archivePath string) (string, error) {
+	var version string
+	err := archiveutil.WithTarGzOpen(archivePath, func(tr *tar.Reader) error {
+		return archiveutil.EachTarEntry(tr, func(hdr *tar.Header, r io.Reader) error {
+			if version != "" || path.Clean(hdr.Name) != "go/VERSION" || hdr.Typeflag != tar.TypeReg {
+				return nil
+			}
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			line, _, _ := strings.Cut(string(data), "\n")
+			v, ok := strings.CutPrefix(strings.TrimSpace(line), "go")
+			if !ok || v == "" {
+				return fmt.Errorf("go/VERSION starts with %q, not a version like go1.24.1", line)
+			}
+			version = v
+			return nil
+		})
+	})
+	if err == nil && version == "" {
+		err = errors.New("no go/VERSION file")
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read the Go version of %q: %v", archivePath, err)
+	}
+	return version, nil
+}
+
+// archs maps each supported GOARCH to its Debian and RPM architecture names.
+var archs = map[string]struct{ deb, rpm string }{
+	"386":     {"i386", "i686"},
+	"amd64":   {"amd64", "x86_64"},
+	"arm":     {"armhf", "armv6hl"},
+	"arm64":   {"arm64", "aarch64"},
+	"ppc64le": {"ppc64el", "ppc64le"},
+	"s390x":   {"s390x", "s390x"},
+}
+
+// packageVersion returns the version in the form used by both package managers: "~" sorts a
+// prerelease before the release.
+func (m *Metadata) packageVersion() string {
+	v := m.Version
+	for _, pre := range []string{"rc", "beta"} {
+		if i := strings.Index(v, pre); i >= 0 {
+			return v[:i] + "~" + v[i:]
+		}
+	}
+	return v
+}
+
+// file is a file, dir, or symlink to install.
+type file struct {
+	// path is the absolute install path.
+	path     string
+	mode     fs.FileMode
+	linkname string
+	modTime  time.Time
+	// size, md5, and sha256 describe the content of a regular file.
+	size   int64
+	md5    string
+	sha256 string
+}
+
+// scanDistribution reads the entries of the Go distribution tar.gz at archivePath. Every entry
+// must be in the top-level "go" dir, which is installed to prefix. The returned files include the
+// dirs in prefix, and are in the same order as the archive. The content of the regular files is
+// hashed, but not kept: see eachContent.
+func scanDistribution(archivePath, prefix string) ([]*file, error) {
+	if !path.IsAbs(prefix) {
+		return nil, fmt.Errorf("install prefix %q isn't absolute", prefix)
+	}
+	prefix = path.Clean(prefix)
+	var files []*file
+	dirs := make(map[string]bool)
+	// addDir adds dir and its parents inside prefix, if they aren't already added.
+	var addDir func(dir string, modTime time.Time)
+	addDir = func(dir string, modTime time.Time) {
+		if dirs[dir] || !strings.HasPrefix(dir+"/", prefix+"/") {
+			return
+		}
+		addDir(path.Dir(dir), modTime)
+		dirs[dir] = true
+		files = append(files, &file{path: dir, mode: fs.ModeDir | 0o755, modTime: modTime})
+	}
+
+	err := archiveutil.WithTarGzOpen(archivePath, func(tr *tar.Reader) error {
+		return archiveutil.EachTarEntry(tr, func(hdr *tar.Header, r io.Reader) error {
+			rel, ok := strings.CutPrefix(path.Clean(hdr.Name), "go")
+			if !ok || (rel != "" && rel[0] != '/') {
+				return fmt.Errorf("entry %q is outside the top-level go dir", hdr.Name)
+			}
+			p := prefix + rel
+			switch hdr.Typeflag {
+			case tar.TypeDir:
+				addDir(p, hdr.ModTime)
+				return nil
+			case tar.TypeReg, tar.TypeSymlink:
+			default:
+				return fmt.Errorf("entry %q has unsupported type %q", hdr.Name, hdr.Typeflag)
+			}
+			addDir(path.Dir(p), hdr.ModTime)
+			f := &file{path: p, mode: hdr.FileInfo().Mode(), linkname: hdr.Linkname, modTime: hdr.ModTime}
+			if hdr.Typeflag == tar.TypeReg {
+				md5Hash, sha256Hash := md5.New(), sha256.New()
+				n, err := io.Copy(io.MultiWriter(md5Hash, sha256Hash), r)
+				if err != nil {
+					return err
+				}
+				f.size = n
+				f.md5 = hex.EncodeToString(md5Hash.Sum(nil))
+				f.sha256 = hex.EncodeToString(sha256Hash.Sum(nil))
+			}
+			files = append(files, f)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no files in %q", archivePath)
+	}
+	return files, nil
+}
+
+// eachContent reads the Go distribution tar.gz at archivePath again and calls f for each of
+// files, in order. For a regular file, r reads its content. files must be the result of
+// scanDistribution for the same archive.
+func eachContent(archivePath string, files []*file, f func(f *file, r io.Reader) error) error {
+	return archiveutil.WithTarGzOpen(archivePath, func(tr *tar.Reader) error {
+		for _, file := range files {
+			if !file.mode.IsRegular() {
+				if err := f(file, nil); err != nil {
+					return err
+				}
+				continue
+			}
+			// Skip to the next regular file: it's the one that corresponds to file.
+			for {
+				hdr, err := tr.Next()
+				if err != nil {
+					return fmt.Errorf("reading content of %q: %v", file.path, err)
+				}
+				if hdr.Typeflag == tar.TypeReg {
+					break
+				}
+			}
+			r := &countingReader{r: tr}
+			if err := f(file, r); err != nil {
+				return err
+			}
+			if r.n != file.size {
+				return fmt.Errorf("content of %q changed since it was scanned", file.path)
+			}
+		}
+		return nil
+	})
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// buildTime returns the latest modification time of the files, so packing the same archive always
+// produces the same package.
+func buildTime(files []*file) time.Time {
+	var t time.Time
+	for _, f := range files {
+		if f.modTime.After(t) {
+			t = f.modTime
+		}
+	}
+	return t.UTC()
+}
+
+// installedSize returns the total size of the regular files.
+func installedSize(files []*file) int64 {
+	var n int64
+	for _, f := range files {
+		n += f.size
+	}
+	return n
+}
@@ -0,0 +1,212 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxpkg
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+func writeTestDistribution(t *testing.T) string {
+	return writeTestDistributionNamed(t, "go1.25rc1-20250601.1.linux-amd64.tar.gz", "go1.25rc1\n")
+}
+
+// writeTestDistributionNamed writes a test distribution with the given archive name and go/VERSION
+// content. If version is empty, there is no go/VERSION file.
+func writeTestDistributionNamed(t *testing.T, name, version string) string {
+	p := filepath.Join(t.TempDir(), name)
+	modTime := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	if err := archiveutil.WithTarGzCreate(p, func(tw *tar.Writer) error {
+		for _, e := range []struct {
+			name, content, link string
+			mode                int64
+		}{
+			{name: "go/VERSION", content: version, mode: 0o644},
+			{name: "go/bin/go", content: "go binary", mode: 0o755},
+			{name: "go/src/odd.txt", content: "odd length", mode: 0o644},
+			{name: "go/misc/VERSION", link: "../VERSION", mode: 0o777},
+		} {
+			if e.name == "go/VERSION" && version == "" {
+				continue
+			}
+			hdr := &tar.Header{Name: e.name, Mode: e.mode, ModTime: modTime, Size: int64(len(e.content))}
+			if e.link != "" {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, e.link, 0
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if _, err := tw.Write([]byte(e.content)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMetadataFromArchive(t *testing.T) {
+	tests := []struct {
+		name, versionFile      string
+		version, release, arch string
+	}{
+		// The build ID after the version in the name isn't part of the package version.
+		{"go1.24.1-20250101.3.linux-amd64.tar.gz", "go1.24.1\ntime 2025-01-01T00:00:00Z\n", "1.24.1", "2", "amd64"},
+		{"go1.24.1-dev.linux-arm64.tar.gz", "go1.24.1\n", "1.24.1", "2", "arm64"},
+		{"go1.25rc1.linux-armv6l.tar.gz", "go1.25rc1\n", "1.25rc1", "2", "arm"},
+	}
+	for _, tt := range tests {
+		m, err := MetadataFromArchive(writeTestDistributionNamed(t, tt.name, tt.versionFile), "2")
+		if err != nil {
+			t.Errorf("%v: %v", tt.name, err)
+			continue
+		}
+		if m.Version != tt.version || m.Release != tt.release || m.GOARCH != tt.arch {
+			t.Errorf("%v: got %v, %v, %v; want %v, %v, %v", tt.name, m.Version, m.Release, m.GOARCH, tt.version, tt.release, tt.arch)
+		}
+	}
+
+	bad := []struct {
+		name, versionFile, release string
+	}{
+		{"go1.24.1-1.windows-amd64.zip", "go1.24.1\n", "1"},
+		{"go1.24.1-1.linux-mips.tar.gz", "go1.24.1\n", "1"},
+		{"go1.24.1-1.src.tar.gz", "go1.24.1\n", "1"},
+		{"go1.24.1-1.linux-amd64.tar.gz", "", "1"},
+		{"go1.24.1-1.linux-amd64.tar.gz", "devel go1.25-abcde1234\n", "1"},
+		{"go1.24.1-1.linux-amd64.tar.gz", "go1.25-abcde1234\n", "1"},
+		{"go1.24.1-1.linux-amd64.tar.gz", "go1.24.1\n", "1-2"},
+	}
+	for _, tt := range bad {
+		if _, err := MetadataFromArchive(writeTestDistributionNamed(t, tt.name, tt.versionFile), tt.release); err == nil {
+			t.Errorf("%v with VERSION %q and release %q: got no error", tt.name, tt.versionFile, tt.release)
+		}
+	}
+}
+
+func TestWriteDeb(t *testing.T) {
+	archive := writeTestDistribution(t)
+	m, err := MetadataFromArchive(archive, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deb := filepath.Join(t.TempDir(), "go.deb")
+	if err := archiveutil.WithFileCreate(deb, func(f *os.File) error {
+		return WriteDeb(f, archive, m)
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	members, err := ReadDebMembers(deb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, m := range members {
+		names = append(names, m.Name)
+	}
+	if want := []string{"debian-binary", "control.tar.gz", "data.tar.gz"}; !slices.Equal(names, want) {
+		t.Errorf("got members %v, want %v", names, want)
+	}
+
+	// Check the package with dpkg-deb, if it's available.
+	if _, err := exec.LookPath("dpkg-deb"); err != nil {
+		t.Skip("dpkg-deb not found")
+	}
+	out, err := exec.Command("dpkg-deb", "--field", deb, "Package", "Version", "Architecture").CombinedOutput()
+	if err != nil {
+		t.Fatalf("dpkg-deb --field: %v\n%s", err, out)
+	}
+	if want := "Package: msft-golang\nVersion: 1.25~rc1-2\nArchitecture: amd64\n"; string(out) != want {
+		t.Errorf("got fields:\n%s\nwant:\n%s", out, want)
+	}
+	out, err = exec.Command("dpkg-deb", "--contents", deb).CombinedOutput()
+	if err != nil {
+		t.Fatalf("dpkg-deb --contents: %v\n%s", err, out)
+	}
+	for _, want := range []string{"./opt/microsoft/go/bin/go", "./opt/microsoft/go/misc/VERSION -> ../VERSION"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("contents don't include %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteRPM(t *testing.T) {
+	archive := writeTestDistribution(t)
+	m, err := MetadataFromArchive(archive, "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rpms [2][]byte
+	for i := range rpms {
+		var b bytes.Buffer
+		if err := WriteRPM(&b, archive, m); err != nil {
+			t.Fatal(err)
+		}
+		rpms[i] = b.Bytes()
+	}
+	if !bytes.Equal(rpms[0], rpms[1]) {
+		t.Error("packing the same archive twice produced different packages")
+	}
+
+	p := filepath.Join(t.TempDir(), "go.rpm")
+	if err := os.WriteFile(p, rpms[0], 0o666); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadRPM(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Signed() {
+		t.Error("new package is signed")
+	}
+	if !slices.Contains(info.SignatureTags, sigTagSHA256) {
+		t.Errorf("signature header tags %v don't include SHA256", info.SignatureTags)
+	}
+
+	// Read the main header after the lead and the padded signature header.
+	r := bufio.NewReader(bytes.NewReader(rpms[0][96:]))
+	_, n, err := readRPMHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Discard((8 - n%8) % 8)
+	h, _, err := readRPMHeader(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	strs := func(tag uint32) []string {
+		for _, e := range h.entries {
+			if e.tag == tag {
+				return strings.Split(string(e.data), "\x00")[:e.count]
+			}
+		}
+		return nil
+	}
+	if got := strs(tagName); !slices.Equal(got, []string{"msft-golang"}) {
+		t.Errorf("name = %v", got)
+	}
+	if got := strs(tagVersion); !slices.Equal(got, []string{"1.25~rc1"}) {
+		t.Errorf("version = %v", got)
+	}
+	if got, want := strs(tagBaseNames), []string{"go", "VERSION", "bin", "go", "src", "odd.txt", "misc", "VERSION"}; !slices.Equal(got, want) {
+		t.Errorf("base names = %v, want %v", got, want)
+	}
+	if got, want := strs(tagDirNames), []string{"/opt/microsoft/", "/opt/microsoft/go/", "/opt/microsoft/go/bin/", "/opt/microsoft/go/src/", "/opt/microsoft/go/misc/"}; !slices.Equal(got, want) {
+		t.Errorf("dir names = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,580 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package linuxpkg
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// RPM header data types.
+const (
+	rpmInt16       = 3
+	rpmInt32       = 4
+	rpmString      = 6
+	rpmBin         = 7
+	rpmStringArray = 8
+	rpmI18NString  = 9
+)
+
+// RPM header tags. See https://rpm-software-management.github.io/rpm/manual/format_v4.html and
+// rpmtag.h in the rpm source.
+const (
+	tagHeaderSignatures = 62
+	tagHeaderImmutable  = 63
+	tagHeaderI18NTable  = 100
+
+	tagName              = 1000
+	tagVersion           = 1001
+	tagRelease           = 1002
+	tagSummary           = 1004
+	tagDescription       = 1005
+	tagBuildTime         = 1006
+	tagBuildHost         = 1007
+	tagSize              = 1009
+	tagLicense           = 1014
+	tagGroup             = 1016
+	tagURL               = 1020
+	tagOS                = 1021
+	tagArch              = 1022
+	tagFileSizes         = 1028
+	tagFileModes         = 1030
+	tagFileRDevs         = 1033
+	tagFileMTimes        = 1034
+	tagFileDigests       = 1035
+	tagFileLinkTos       = 1036
+	tagFileFlags         = 1037
+	tagFileUserName      = 1039
+	tagFileGroupName     = 1040
+	tagSourceRPM         = 1044
+	tagFileVerifyFlags   = 1045
+	tagProvideName       = 1047
+	tagRequireFlags      = 1048
+	tagRequireName       = 1049
+	tagRequireVersion    = 1050
+	tagFileDevices       = 1095
+	tagFileINodes        = 1096
+	tagFileLangs         = 1097
+	tagProvideFlags      = 1112
+	tagProvideVersion    = 1113
+	tagDirIndexes        = 1116
+	tagBaseNames         = 1117
+	tagDirNames          = 1118
+	tagPayloadFormat     = 1124
+	tagPayloadCompressor = 1125
+	tagPayloadFlags      = 1126
+	tagFileDigestAlgo    = 5011
+	tagPayloadDigest     = 5092
+	tagPayloadDigestAlgo = 5093
+)
+
+// RPM signature header tags.
+const (
+	sigTagDSA         = 267
+	sigTagRSA         = 268
+	sigTagSHA1        = 269
+	sigTagSHA256      = 273
+	sigTagSize        = 1000
+	sigTagPGP         = 1002
+	sigTagMD5         = 1004
+	sigTagGPG         = 1005
+	sigTagPayloadSize = 1007
+)
+
+// Dependency flags.
+const (
+	senseLess   = 0x02
+	senseEqual  = 0x08
+	senseRPMLib = 0x1000000
+)
+
+const pgpHashAlgoSHA256 = 8
+
+var (
+	rpmLeadMagic   = []byte{0xed, 0xab, 0xee, 0xdb}
+	rpmHeaderMagic = []byte{0x8e, 0xad, 0xe8, 0x01, 0, 0, 0, 0}
+)
+
+// WriteRPM writes an RPM package containing the Go distribution tar.gz at archivePath to w.
+func WriteRPM(w io.Writer, archivePath string, m *Metadata) error {
+	files, err := scanDistribution(archivePath, m.Prefix)
+	if err != nil {
+		return err
+	}
+	arch, ok := archs[m.GOARCH]
+	if !ok {
+		return fmt.Errorf("unsupported GOARCH %q", m.GOARCH)
+	}
+	version := m.packageVersion()
+	nvr := m.Name + "-" + version + "-" + m.Release
+
+	// The signature header includes the size and digests of the payload, so write the payload to
+	// a temp file first.
+	payload, err := os.CreateTemp("", "linuxpkg-rpm-payload-*.cpio.gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(payload.Name())
+	defer payload.Close()
+	payloadSHA256 := sha256.New()
+	gw, err := gzip.NewWriterLevel(io.MultiWriter(payload, payloadSHA256), gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	cpio := &cpioWriter{w: bufio.NewWriter(gw)}
+	if err := eachContent(archivePath, files, func(f *file, r io.Reader) error {
+		return cpio.writeFile(f, r)
+	}); err != nil {
+		return err
+	}
+	if err := cpio.close(); err != nil {
+		return err
+	}
+	if err := gw.Close(); err != nil {
+		return err
+	}
+	payloadSize, err := payload.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := payload.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	var h rpmHeader
+	h.addStrings(tagHeaderI18NTable, rpmStringArray, "C")
+	h.addString(tagName, m.Name)
+	h.addString(tagVersion, version)
+	h.addString(tagRelease, m.Release)
+	h.addStrings(tagSummary, rpmI18NString, m.Summary)
+	h.addStrings(tagDescription, rpmI18NString, m.Description)
+	h.addInt32(tagBuildTime, uint32(buildTime(files).Unix()))
+	h.addString(tagBuildHost, "localhost")
+	h.addInt32(tagSize, uint32(installedSize(files)))
+	h.addString(tagLicense, m.License)
+	h.addStrings(tagGroup, rpmI18NString, "Development/Languages")
+	h.addString(tagURL, m.URL)
+	h.addString(tagOS, "linux")
+	h.addString(tagArch, arch.rpm)
+	h.addString(tagSourceRPM, m.Name+"-"+version+"-"+m.Release+".src.rpm")
+	h.addStrings(tagProvideName, rpmStringArray, m.Name)
+	h.addInt32(tagProvideFlags, senseEqual)
+	h.addStrings(tagProvideVersion, rpmStringArray, version+"-"+m.Release)
+
+	// Declare the rpm features the package uses, like rpmbuild does.
+	requires := [][2]string{
+		{"rpmlib(CompressedFileNames)", "3.0.4-1"},
+		{"rpmlib(FileDigests)", "4.6.0-1"},
+		{"rpmlib(PayloadFilesHavePrefix)", "4.0-1"},
+	}
+	if strings.Contains(version, "~") {
+		requires = append(requires, [2]string{"rpmlib(TildeInVersions)", "4.10.0-1"})
+	}
+	var requireNames, requireVersions []string
+	var requireFlags []uint32
+	for _, r := range requires {
+		requireNames = append(requireNames, r[0])
+		requireVersions = append(requireVersions, r[1])
+		requireFlags = append(requireFlags, senseLess|senseEqual|senseRPMLib)
+	}
+	h.addInt32(tagRequireFlags, requireFlags...)
+	h.addStrings(tagRequireName, rpmStringArray, requireNames...)
+	h.addStrings(tagRequireVersion, rpmStringArray, requireVersions...)
+
+	var (
+		sizes, mtimes, flags, verifyFlags, devices, inodes, dirIndexes []uint32
+		modes, rdevs                                                   []uint16
+		digests, linkTos, users, groups, langs, baseNames, dirNames    []string
+	)
+	dirIndex := make(map[string]int)
+	for i, f := range files {
+		sizes = append(sizes, uint32(f.fileSize()))
+		modes = append(modes, uint16(f.unixMode()))
+		rdevs = append(rdevs, 0)
+		mtimes = append(mtimes, uint32(f.modTime.Unix()))
+		digests = append(digests, f.sha256)
+		linkTos = append(linkTos, f.linkname)
+		flags = append(flags, 0)
+		users = append(users, "root")
+		groups = append(groups, "root")
+		verifyFlags = append(verifyFlags, 0xffffffff)
+		devices = append(devices, 1)
+		inodes = append(inodes, uint32(i+1))
+		langs = append(langs, "")
+
+		dir := path.Dir(f.path)
+		if dir != "/" {
+			dir += "/"
+		}
+		di, ok := dirIndex[dir]
+		if !ok {
+			di = len(dirNames)
+			dirIndex[dir] = di
+			dirNames = append(dirNames, dir)
+		}
+		dirIndexes = append(dirIndexes, uint32(di))
+		baseNames = append(baseNames, path.Base(f.path))
+	}
+	h.addInt32(tagFileSizes, sizes...)
+	h.addInt16(tagFileModes, modes...)
+	h.addInt16(tagFileRDevs, rdevs...)
+	h.addInt32(tagFileMTimes, mtimes...)
+	h.addStrings(tagFileDigests, rpmStringArray, digests...)
+	h.addStrings(tagFileLinkTos, rpmStringArray, linkTos...)
+	h.addInt32(tagFileFlags, flags...)
+	h.addStrings(tagFileUserName, rpmStringArray, users...)
+	h.addStrings(tagFileGroupName, rpmStringArray, groups...)
+	h.addInt32(tagFileVerifyFlags, verifyFlags...)
+	h.addInt32(tagFileDevices, devices...)
+	h.addInt32(tagFileINodes, inodes...)
+	h.addStrings(tagFileLangs, rpmStringArray, langs...)
+	h.addInt32(tagDirIndexes, dirIndexes...)
+	h.addStrings(tagBaseNames, rpmStringArray, baseNames...)
+	h.addStrings(tagDirNames, rpmStringArray, dirNames...)
+	h.addString(tagPayloadFormat, "cpio")
+	h.addString(tagPayloadCompressor, "gzip")
+	h.addString(tagPayloadFlags, "9")
+	h.addInt32(tagFileDigestAlgo, pgpHashAlgoSHA256)
+	h.addStrings(tagPayloadDigest, rpmStringArray, hex.EncodeToString(payloadSHA256.Sum(nil)))
+	h.addInt32(tagPayloadDigestAlgo, pgpHashAlgoSHA256)
+	header := h.marshal(tagHeaderImmutable)
+
+	// The MD5 covers the header and the payload.
+	headerAndPayloadMD5 := md5.New()
+	headerAndPayloadMD5.Write(header)
+	if _, err := io.Copy(headerAndPayloadMD5, payload); err != nil {
+		return err
+	}
+	if _, err := payload.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	headerSHA1 := sha1.Sum(header)
+	headerSHA256 := sha256.Sum256(header)
+
+	var sig rpmHeader
+	sig.addString(sigTagSHA1, hex.EncodeToString(headerSHA1[:]))
+	sig.addString(sigTagSHA256, hex.EncodeToString(headerSHA256[:]))
+	sig.addInt32(sigTagSize, uint32(int64(len(header))+payloadSize))
+	sig.addBin(sigTagMD5, headerAndPayloadMD5.Sum(nil))
+	sig.addInt32(sigTagPayloadSize, uint32(cpio.n))
+	sigHeader := sig.marshal(tagHeaderSignatures)
+	// The main header starts at a multiple of 8 bytes after the signature header.
+	sigHeader = append(sigHeader, make([]byte, (8-len(sigHeader)%8)%8)...)
+
+	bw := bufio.NewWriter(w)
+	bw.Write(rpmLead(nvr, arch.rpm))
+	bw.Write(sigHeader)
+	bw.Write(header)
+	if _, err := io.Copy(bw, payload); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// rpmLead returns the legacy 96-byte lead that starts an RPM file. rpm only checks its magic
+// number, but other tools read the name and architecture from it.
+func rpmLead(nvr, arch string) []byte {
+	lead := make([]byte, 96)
+	copy(lead, rpmLeadMagic)
+	// Format version 3.0, and type 0: a binary package.
+	lead[4], lead[5] = 3, 0
+	var archNum uint16
+	switch arch {
+	case "x86_64", "i686":
+		archNum = 1
+	}
+	binary.BigEndian.PutUint16(lead[8:], archNum)
+	// The name is null-terminated, so it can use at most 65 of its 66 bytes.
+	copy(lead[10:75], nvr)
+	// OS 1 is Linux. Signature type 5 is a header-style signature.
+	binary.BigEndian.PutUint16(lead[76:], 1)
+	binary.BigEndian.PutUint16(lead[78:], 5)
+	return lead
+}
+
+// unixMode returns the mode of f in the form of stat's st_mode.
+func (f *file) unixMode() uint32 {
+	m := uint32(f.mode.Perm())
+	switch {
+	case f.mode.IsDir():
+		m |= 0o040000
+	case f.mode&fs.ModeSymlink != 0:
+		m |= 0o120000
+	default:
+		m |= 0o100000
+	}
+	return m
+}
+
+// fileSize returns the size of f as recorded by rpm: the length of the target for a symlink.
+func (f *file) fileSize() int64 {
+	switch {
+	case f.mode.IsDir():
+		return 4096
+	case f.mode&fs.ModeSymlink != 0:
+		return int64(len(f.linkname))
+	}
+	return f.size
+}
+
+type rpmEntry struct {
+	tag, typ, count uint32
+	data            []byte
+}
+
+// rpmHeader is an RPM header structure being built.
+type rpmHeader struct {
+	entries []rpmEntry
+}
+
+func (h *rpmHeader) addString(tag uint32, s string) {
+	h.entries = append(h.entries, rpmEntry{tag, rpmString, 1, append([]byte(s), 0)})
+}
+
+func (h *rpmHeader) addStrings(tag, typ uint32, ss ...string) {
+	var data []byte
+	for _, s := range ss {
+		data = append(append(data, s...), 0)
+	}
+	h.entries = append(h.entries, rpmEntry{tag, typ, uint32(len(ss)), data})
+}
+
+func (h *rpmHeader) addInt32(tag uint32, vs ...uint32) {
+	data := make([]byte, 0, 4*len(vs))
+	for _, v := range vs {
+		data = binary.BigEndian.AppendUint32(data, v)
+	}
+	h.entries = append(h.entries, rpmEntry{tag, rpmInt32, uint32(len(vs)), data})
+}
+
+func (h *rpmHeader) addInt16(tag uint32, vs ...uint16) {
+	data := make([]byte, 0, 2*len(vs))
+	for _, v := range vs {
+		data = binary.BigEndian.AppendUint16(data, v)
+	}
+	h.entries = append(h.entries, rpmEntry{tag, rpmInt16, uint32(len(vs)), data})
+}
+
+func (h *rpmHeader) addBin(tag uint32, b []byte) {
+	h.entries = append(h.entries, rpmEntry{tag, rpmBin, uint32(len(b)), b})
+}
+
+// marshal returns the header structure, with regionTag marking the whole header as one region,
+// like rpmbuild does.
+func (h *rpmHeader) marshal(regionTag uint32) []byte {
+	entries := slices.Clone(h.entries)
+	slices.SortFunc(entries, func(a, b rpmEntry) int { return int(a.tag) - int(b.tag) })
+
+	indexCount := len(entries) + 1
+	var index, store []byte
+	appendIndex := func(tag, typ, offset, count uint32) {
+		index = binary.BigEndian.AppendUint32(index, tag)
+		index = binary.BigEndian.AppendUint32(index, typ)
+		index = binary.BigEndian.AppendUint32(index, offset)
+		index = binary.BigEndian.AppendUint32(index, count)
+	}
+	for _, e := range entries {
+		align := 1
+		switch e.typ {
+		case rpmInt16:
+			align = 2
+		case rpmInt32:
+			align = 4
+		}
+		for len(store)%align != 0 {
+			store = append(store, 0)
+		}
+		appendIndex(e.tag, e.typ, uint32(len(store)), e.count)
+		store = append(store, e.data...)
+	}
+	// The region tag's entry comes first, and points to a trailer at the end of the store. The
+	// trailer's offset is the negative size of the index.
+	regionIndex := index
+	index = nil
+	appendIndex(regionTag, rpmBin, uint32(len(store)), 16)
+	index = append(index, regionIndex...)
+	trailerOffset := -int32(indexCount * 16)
+	store = binary.BigEndian.AppendUint32(store, regionTag)
+	store = binary.BigEndian.AppendUint32(store, rpmBin)
+	store = binary.BigEndian.AppendUint32(store, uint32(trailerOffset))
+	store = binary.BigEndian.AppendUint32(store, 16)
+
+	var b bytes.Buffer
+	b.Write(rpmHeaderMagic)
+	binary.Write(&b, binary.BigEndian, uint32(indexCount))
+	binary.Write(&b, binary.BigEndian, uint32(len(store)))
+	b.Write(index)
+	b.Write(store)
+	return b.Bytes()
+}
+
+// cpioWriter writes a cpio archive in the "newc" format, which rpm uses for the payload.
+type cpioWriter struct {
+	w     *bufio.Writer
+	n     int64
+	inode uint32
+}
+
+func (c *cpioWriter) write(b []byte) {
+	n, _ := c.w.Write(b)
+	c.n += int64(n)
+}
+
+func (c *cpioWriter) pad() {
+	for c.n%4 != 0 {
+		c.write([]byte{0})
+	}
+}
+
+func (c *cpioWriter) writeHeader(name string, mode uint32, nlink uint32, mtime int64, size int64) error {
+	if size > 0xffffffff {
+		return fmt.Errorf("%q is too large for cpio", name)
+	}
+	c.inode++
+	hdr := fmt.Sprintf("070701%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x%08x",
+		c.inode, mode, 0, 0, nlink, mtime, size, 0, 0, 0, 0, len(name)+1, 0)
+	c.write([]byte(hdr))
+	c.write(append([]byte(name), 0))
+	c.pad()
+	return nil
+}
+
+func (c *cpioWriter) writeFile(f *file, r io.Reader) error {
+	var size int64
+	nlink := uint32(1)
+	switch {
+	case f.mode.IsDir():
+		nlink = 2
+	case f.mode&fs.ModeSymlink != 0:
+		size = int64(len(f.linkname))
+	default:
+		size = f.size
+	}
+	if err := c.writeHeader("."+f.path, f.unixMode(), nlink, f.modTime.Unix(), size); err != nil {
+		return err
+	}
+	switch {
+	case f.mode&fs.ModeSymlink != 0:
+		c.write([]byte(f.linkname))
+	case f.mode.IsRegular():
+		n, err := io.Copy(c.w, r)
+		c.n += n
+		if err != nil {
+			return err
+		}
+	}
+	c.pad()
+	return nil
+}
+
+func (c *cpioWriter) close() error {
+	if err := c.writeHeader("TRAILER!!!", 0, 1, 0, 0); err != nil {
+		return err
+	}
+	return c.w.Flush()
+}
+
+// RPMInfo describes an RPM package file.
+type RPMInfo struct {
+	// SignatureTags are the tags in the signature header.
+	SignatureTags []uint32
+	// ContentSHA256 is the SHA256 checksum of the main header and payload: the part of the file
+	// that signing doesn't change.
+	ContentSHA256 string
+}
+
+// Signed returns true if the signature header contains an OpenPGP signature, added by signing the
+// package.
+func (i *RPMInfo) Signed() bool {
+	for _, tag := range i.SignatureTags {
+		switch tag {
+		case sigTagDSA, sigTagRSA, sigTagPGP, sigTagGPG:
+			return true
+		}
+	}
+	return false
+}
+
+// ReadRPM reads the RPM package at path.
+func ReadRPM(path string) (*RPMInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	lead := make([]byte, 96)
+	if _, err := io.ReadFull(r, lead); err != nil || !bytes.Equal(lead[:4], rpmLeadMagic) {
+		return nil, fmt.Errorf("%v is not an RPM package", path)
+	}
+	sig, n, err := readRPMHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%v: reading signature header: %v", path, err)
+	}
+	if _, err := r.Discard((8 - n%8) % 8); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	info := &RPMInfo{}
+	for _, e := range sig.entries {
+		info.SignatureTags = append(info.SignatureTags, e.tag)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	info.ContentSHA256 = hex.EncodeToString(h.Sum(nil))
+	return info, nil
+}
+
+// readRPMHeader reads a header structure from r. Each entry's data is the rest of the store,
+// starting at its offset. Returns the header and its size in bytes.
+func readRPMHeader(r io.Reader) (*rpmHeader, int, error) {
+	preamble := make([]byte, 16)
+	if _, err := io.ReadFull(r, preamble); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(preamble[:8], rpmHeaderMagic) {
+		return nil, 0, fmt.Errorf("invalid header magic %x", preamble[:8])
+	}
+	indexCount := binary.BigEndian.Uint32(preamble[8:])
+	storeSize := binary.BigEndian.Uint32(preamble[12:])
+	if indexCount > 0x10000 || storeSize > 256<<20 {
+		return nil, 0, fmt.Errorf("header too large: %v entries, %v bytes", indexCount, storeSize)
+	}
+	rest := make([]byte, int(indexCount)*16+int(storeSize))
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, 0, err
+	}
+	index, store := rest[:indexCount*16], rest[indexCount*16:]
+	h := &rpmHeader{}
+	for i := 0; i < len(index); i += 16 {
+		e := rpmEntry{
+			tag:   binary.BigEndian.Uint32(index[i:]),
+			typ:   binary.BigEndian.Uint32(index[i+4:]),
+			count: binary.BigEndian.Uint32(index[i+12:]),
+		}
+		offset := binary.BigEndian.Uint32(index[i+8:])
+		if offset > storeSize {
+			return nil, 0, fmt.Errorf("tag %v has offset %v outside the %v-byte store", e.tag, offset, storeSize)
+		}
+		e.data = store[offset:]
+		h.entries = append(h.entries, e)
+	}
+	return h, len(preamble) + len(rest), nil
+}
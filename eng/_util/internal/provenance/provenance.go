@@ -0,0 +1,153 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package provenance creates and verifies unsigned in-toto statements with SLSA provenance
+// predicates. Signing a statement is left to an external step.
+//
+// See https://slsa.dev/spec/v1.0/provenance and https://github.com/in-toto/attestation.
+package provenance
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/checksum"
+)
+
+const (
+	// StatementType is the in-toto statement type this package uses.
+	StatementType = "https://in-toto.io/Statement/v1"
+	// PredicateType is the SLSA provenance predicate type this package uses.
+	PredicateType = "https://slsa.dev/provenance/v1"
+
+	// FileSuffix is appended to the name of an artifact to get the name of its statement.
+	FileSuffix = ".intoto.json"
+)
+
+// Statement is an in-toto statement about a set of subjects.
+type Statement struct {
+	Type          string                `json:"_type"`
+	Subject       []*ResourceDescriptor `json:"subject"`
+	PredicateType string                `json:"predicateType"`
+	Predicate     *Provenance           `json:"predicate"`
+}
+
+// ResourceDescriptor identifies an artifact by name, URI, and/or digest.
+type ResourceDescriptor struct {
+	Name   string            `json:"name,omitempty"`
+	URI    string            `json:"uri,omitempty"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// Provenance is a SLSA provenance v1 predicate.
+type Provenance struct {
+	BuildDefinition *BuildDefinition `json:"buildDefinition"`
+	RunDetails      *RunDetails      `json:"runDetails"`
+}
+
+// BuildDefinition describes the inputs of a build.
+type BuildDefinition struct {
+	BuildType string `json:"buildType"`
+	// ExternalParameters are the options the build was invoked with.
+	ExternalParameters map[string]any `json:"externalParameters"`
+	// InternalParameters are environment inputs such as GOEXPERIMENT.
+	InternalParameters map[string]any `json:"internalParameters,omitempty"`
+	// ResolvedDependencies are the materials of the build, such as source commits and patches.
+	ResolvedDependencies []*ResourceDescriptor `json:"resolvedDependencies,omitempty"`
+}
+
+// RunDetails describes the build run.
+type RunDetails struct {
+	Builder    *Builder              `json:"builder"`
+	Metadata   *BuildMetadata        `json:"metadata,omitempty"`
+	Byproducts []*ResourceDescriptor `json:"byproducts,omitempty"`
+}
+
+// Builder identifies the entity that ran the build.
+type Builder struct {
+	ID string `json:"id"`
+}
+
+// BuildMetadata has information about a build run.
+type BuildMetadata struct {
+	InvocationID string     `json:"invocationId,omitempty"`
+	StartedOn    *time.Time `json:"startedOn,omitempty"`
+	FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+}
+
+// NewStatement returns a statement that p produced subjects.
+func NewStatement(subjects []*ResourceDescriptor, p *Provenance) *Statement {
+	return &Statement{
+		Type:          StatementType,
+		Subject:       subjects,
+		PredicateType: PredicateType,
+		Predicate:     p,
+	}
+}
+
+// FileDescriptor describes the file at path by its base name and SHA256 digest. The file is
+// always hashed: a checksum file next to it may be left over from an earlier build that created
+// a file with the same name.
+func FileDescriptor(path string) (*ResourceDescriptor, error) {
+	sum, err := checksum.FileSHA256(path)
+	if err != nil {
+		return nil, err
+	}
+	return &ResourceDescriptor{
+		Name:   filepath.Base(path),
+		Digest: map[string]string{"sha256": sum},
+	}, nil
+}
+
+// GitCommitDescriptor describes a git repository at a commit.
+func GitCommitDescriptor(name, uri, commit string) *ResourceDescriptor {
+	return &ResourceDescriptor{
+		Name:   name,
+		URI:    "git+" + uri + "@" + commit,
+		Digest: map[string]string{"gitCommit": commit},
+	}
+}
+
+// BuilderID returns an ID for the builder running this process: the Azure DevOps pipeline
+// definition if running in Azure DevOps, otherwise "local" for tool.
+func BuilderID(tool string) string {
+	if uri, project, def := os.Getenv("SYSTEM_COLLECTIONURI"), os.Getenv("SYSTEM_TEAMPROJECT"), os.Getenv("SYSTEM_DEFINITIONID"); uri != "" && def != "" {
+		return fmt.Sprintf("%v%v/_build?definitionId=%v", uri, project, def)
+	}
+	return "https://github.com/microsoft/go/eng/_util/cmd/" + tool + "#local"
+}
+
+// InvocationID returns an ID for the current Azure DevOps build, or "" if not running in Azure
+// DevOps.
+func InvocationID() string {
+	if uri, project, id := os.Getenv("SYSTEM_COLLECTIONURI"), os.Getenv("SYSTEM_TEAMPROJECT"), os.Getenv("BUILD_BUILDID"); uri != "" && id != "" {
+		return fmt.Sprintf("%v%v/_build/results?buildId=%v", uri, project, id)
+	}
+	return ""
+}
+
+// WriteFile writes s to path as indented JSON.
+func (s *Statement) WriteFile(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o666)
+}
+
+// ReadFile reads a statement from path.
+func ReadFile(path string) (*Statement, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Statement
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("failed to parse statement %v: %v", path, err)
+	}
+	return &s, nil
+}
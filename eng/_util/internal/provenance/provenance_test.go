@@ -0,0 +1,115 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package provenance
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/microsoft/go/_util/internal/checksum"
+)
+
+func TestVerify(t *testing.T) {
+	dir := t.TempDir()
+	artifact := filepath.Join(dir, "go1.24.1.linux-amd64.tar.gz")
+	if err := os.WriteFile(artifact, []byte("archive"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "patches"), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	patch := filepath.Join(root, "patches", "0001-Test.patch")
+	if err := os.WriteFile(patch, []byte("patch"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	patchSum, err := checksum.FileSHA256(patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subject, err := FileDescriptor(artifact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStatement([]*ResourceDescriptor{subject}, &Provenance{
+		BuildDefinition: &BuildDefinition{
+			BuildType:          "test",
+			ExternalParameters: map[string]any{"PackBuild": true},
+			ResolvedDependencies: []*ResourceDescriptor{
+				GitCommitDescriptor("go", "https://go.googlesource.com/go", "abc"),
+				{Name: "patches/0001-Test.patch", Digest: map[string]string{"sha256": patchSum}},
+			},
+		},
+		RunDetails: &RunDetails{Builder: &Builder{ID: BuilderID("test")}},
+	})
+
+	// Round trip through a file.
+	statementPath := artifact + FileSuffix
+	if err := s.WriteFile(statementPath); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = ReadFile(statementPath); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := Verify(s, dir); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	if err := VerifyDependencies(s, root); err != nil {
+		t.Errorf("VerifyDependencies: %v", err)
+	}
+
+	// Changing the artifact or a patch must fail verification.
+	if err := os.WriteFile(artifact, []byte("tampered"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(s, dir); err == nil || !strings.Contains(err.Error(), "go1.24.1.linux-amd64.tar.gz") {
+		t.Errorf("Verify of tampered artifact: %v", err)
+	}
+	if err := os.WriteFile(patch, []byte("changed"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyDependencies(s, root); err == nil {
+		t.Error("VerifyDependencies of changed patch succeeded")
+	}
+}
+
+func TestFileDescriptorIgnoresStaleChecksumFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "a.zip")
+	if err := os.WriteFile(path, []byte("zip"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	// A checksum file left over from an earlier build of a file with the same name.
+	if err := os.WriteFile(path+".sha256", []byte(strings.Repeat("0", 64)+"  a.zip\n"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	d, err := FileDescriptor(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := checksum.FileSHA256(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Name != "a.zip" || d.Digest["sha256"] != want {
+		t.Errorf("got %+v, want digest %v", d, want)
+	}
+}
+
+func TestVerifyRejectsWrongType(t *testing.T) {
+	s := &Statement{Type: "x", PredicateType: "y"}
+	err := Verify(s, t.TempDir())
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	for _, want := range []string{"statement type", "predicate type", "no subjects"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q doesn't mention %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package provenance
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/microsoft/go/_util/internal/checksum"
+)
+
+// Verify checks that s is a SLSA provenance statement and that each subject matches the SHA256
+// digest of the file with the same name in dir. Returns all the problems found.
+func Verify(s *Statement, dir string) error {
+	var errs []error
+	if s.Type != StatementType {
+		errs = append(errs, fmt.Errorf("statement type is %q, expected %q", s.Type, StatementType))
+	}
+	if s.PredicateType != PredicateType {
+		errs = append(errs, fmt.Errorf("predicate type is %q, expected %q", s.PredicateType, PredicateType))
+	}
+	if s.Predicate == nil || s.Predicate.BuildDefinition == nil || s.Predicate.RunDetails == nil || s.Predicate.RunDetails.Builder == nil {
+		errs = append(errs, errors.New("predicate is missing build definition or builder"))
+	}
+	if len(s.Subject) == 0 {
+		errs = append(errs, errors.New("statement has no subjects"))
+	}
+	for _, subject := range s.Subject {
+		if err := verifyFile(dir, subject); err != nil {
+			errs = append(errs, fmt.Errorf("subject %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// VerifyDependencies checks that each resolved dependency with a SHA256 digest, such as a patch
+// file, matches the file at the dependency's name relative to root.
+func VerifyDependencies(s *Statement, root string) error {
+	if s.Predicate == nil || s.Predicate.BuildDefinition == nil {
+		return errors.New("predicate is missing build definition")
+	}
+	var errs []error
+	for _, d := range s.Predicate.BuildDefinition.ResolvedDependencies {
+		if _, ok := d.Digest["sha256"]; !ok {
+			continue
+		}
+		if err := verifyFile(root, d); err != nil {
+			errs = append(errs, fmt.Errorf("dependency %v", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func verifyFile(dir string, d *ResourceDescriptor) error {
+	want, ok := d.Digest["sha256"]
+	if !ok {
+		return fmt.Errorf("%q has no sha256 digest", d.Name)
+	}
+	if d.Name == "" || !filepath.IsLocal(filepath.FromSlash(d.Name)) {
+		return fmt.Errorf("%q has an invalid name", d.Name)
+	}
+	got, err := checksum.FileSHA256(filepath.Join(dir, filepath.FromSlash(d.Name)))
+	if err != nil {
+		return fmt.Errorf("%q: %v", d.Name, err)
+	}
+	if got != want {
+		return fmt.Errorf("%q: sha256 is %v, expected %v", d.Name, got, want)
+	}
+	return nil
+}
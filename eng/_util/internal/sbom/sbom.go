@@ -0,0 +1,352 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sbom creates SPDX software bills of materials for Go distribution archives.
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"debug/buildinfo"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+	"github.com/microsoft/go/_util/internal/checksum"
+)
+
+// FileSuffix is appended to the name of an archive to get the name of its SBOM.
+const FileSuffix = ".spdx.json"
+
+// Patch is a patch file applied to the upstream source before building.
+type Patch struct {
+	Name   string
+	SHA1   string
+	SHA256 string
+}
+
+// ReadPatches reads and hashes the patch files in dir, sorted by name.
+func ReadPatches(dir string) ([]*Patch, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "*.patch"))
+	if err != nil {
+		return nil, err
+	}
+	slices.Sort(files)
+	patches := make([]*Patch, 0, len(files))
+	for _, f := range files {
+		data, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		sum1 := sha1.Sum(data)
+		sum256 := sha256.Sum256(data)
+		patches = append(patches, &Patch{
+			Name:   filepath.Base(f),
+			SHA1:   hex.EncodeToString(sum1[:]),
+			SHA256: hex.EncodeToString(sum256[:]),
+		})
+	}
+	return patches, nil
+}
+
+// Input describes the build that produced an archive.
+type Input struct {
+	// ArchivePath is the zip or tar.gz archive to describe.
+	ArchivePath string
+	// Version is the Go version in the archive's VERSION file.
+	Version string
+	// SubmoduleCommit is the upstream Go commit the archive was built from.
+	SubmoduleCommit string
+	// Patches were applied to the upstream source.
+	Patches []*Patch
+	// Created is the creation time recorded in the document.
+	Created time.Time
+}
+
+// Document is an SPDX 2.3 document, limited to the fields this package uses.
+type Document struct {
+	SPDXVersion       string          `json:"spdxVersion"`
+	DataLicense       string          `json:"dataLicense"`
+	SPDXID            string          `json:"SPDXID"`
+	Name              string          `json:"name"`
+	DocumentNamespace string          `json:"documentNamespace"`
+	CreationInfo      CreationInfo    `json:"creationInfo"`
+	Comment           string          `json:"comment,omitempty"`
+	Packages          []*Package      `json:"packages"`
+	Files             []*File         `json:"files,omitempty"`
+	Relationships     []*Relationship `json:"relationships"`
+}
+
+// CreationInfo records when and how a Document was created.
+type CreationInfo struct {
+	Created  string   `json:"created"`
+	Creators []string `json:"creators"`
+}
+
+// Package is an SPDX package: the archive, the upstream source, a module, or a binary.
+type Package struct {
+	SPDXID           string         `json:"SPDXID"`
+	Name             string         `json:"name"`
+	VersionInfo      string         `json:"versionInfo,omitempty"`
+	Supplier         string         `json:"supplier,omitempty"`
+	DownloadLocation string         `json:"downloadLocation"`
+	FilesAnalyzed    bool           `json:"filesAnalyzed"`
+	Checksums        []*Checksum    `json:"checksums,omitempty"`
+	PrimaryPurpose   string         `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs     []*ExternalRef `json:"externalRefs,omitempty"`
+	Comment          string         `json:"comment,omitempty"`
+}
+
+// File is an SPDX file. Patches are recorded as files.
+type File struct {
+	SPDXID    string      `json:"SPDXID"`
+	FileName  string      `json:"fileName"`
+	Checksums []*Checksum `json:"checksums"`
+}
+
+// Checksum is a hash of a package or file. Algorithm is an SPDX name such as "SHA256".
+type Checksum struct {
+	Algorithm     string `json:"algorithm"`
+	ChecksumValue string `json:"checksumValue"`
+}
+
+// ExternalRef refers to a package outside the document, such as by its package URL.
+type ExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+// Relationship relates two SPDX elements, e.g. "A CONTAINS B".
+type Relationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// Module is a Go module listed in a vendor/modules.txt file.
+type Module struct {
+	Path    string
+	Version string
+	// Packages are the vendored packages of the module.
+	Packages []string
+}
+
+// Generate creates an SBOM for the archive described by in. It includes:
+//
+//   - The archive itself.
+//   - The upstream Go source at the submodule commit, and the patches applied to it.
+//   - The modules vendored into the std and cmd modules.
+//   - Each Go binary in the archive, and the modules listed in its embedded build info.
+//
+// Checksums are of the archive and binaries as they were when Generate ran. Signing changes them.
+func Generate(in *Input) (*Document, error) {
+	archiveName := filepath.Base(in.ArchivePath)
+	archiveSHA256, err := checksum.FileSHA256(in.ArchivePath)
+	if err != nil {
+		return nil, err
+	}
+	namespaceHash := sha256.Sum256([]byte(archiveName + "\x00" + archiveSHA256))
+
+	doc := &Document{
+		SPDXVersion:       "SPDX-2.3",
+		DataLicense:       "CC0-1.0",
+		SPDXID:            "SPDXRef-DOCUMENT",
+		Name:              archiveName,
+		DocumentNamespace: "https://github.com/microsoft/go/spdx/" + archiveName + "-" + hex.EncodeToString(namespaceHash[:8]),
+		CreationInfo: CreationInfo{
+			Created:  in.Created.UTC().Format(time.RFC3339),
+			Creators: []string{"Organization: Microsoft Corporation", "Tool: microsoft-go-build"},
+		},
+		Comment: "Checksums are of the build output before signing.",
+	}
+	ids := make(map[string]int)
+	// newID returns a unique SPDX ID based on name. IDs may only contain letters, numbers, ".",
+	// and "-".
+	newID := func(kind, name string) string {
+		id := "SPDXRef-" + kind + "-" + invalidIDChars.ReplaceAllString(name, "-")
+		ids[id]++
+		if n := ids[id]; n > 1 {
+			id = fmt.Sprintf("%v-%v", id, n)
+		}
+		return id
+	}
+	relate := func(a, typ, b string) {
+		doc.Relationships = append(doc.Relationships, &Relationship{a, typ, b})
+	}
+
+	archiveID := newID("Archive", archiveName)
+	doc.Packages = append(doc.Packages, &Package{
+		SPDXID:           archiveID,
+		Name:             "Microsoft build of Go",
+		VersionInfo:      in.Version,
+		Supplier:         "Organization: Microsoft Corporation",
+		DownloadLocation: "NOASSERTION",
+		Checksums:        []*Checksum{{"SHA256", archiveSHA256}},
+		PrimaryPurpose:   "ARCHIVE",
+		Comment:          archiveName,
+	})
+	relate(doc.SPDXID, "DESCRIBES", archiveID)
+
+	upstreamID := newID("Upstream", "golang-go")
+	doc.Packages = append(doc.Packages, &Package{
+		SPDXID:           upstreamID,
+		Name:             "go",
+		VersionInfo:      in.SubmoduleCommit,
+		Supplier:         "Organization: Google LLC",
+		DownloadLocation: "git+https://go.googlesource.com/go@" + in.SubmoduleCommit,
+		PrimaryPurpose:   "SOURCE",
+	})
+	relate(archiveID, "GENERATED_FROM", upstreamID)
+
+	for _, p := range in.Patches {
+		id := newID("Patch", p.Name)
+		doc.Files = append(doc.Files, &File{
+			SPDXID:    id,
+			FileName:  "./patches/" + p.Name,
+			Checksums: []*Checksum{{"SHA1", p.SHA1}, {"SHA256", p.SHA256}},
+		})
+		relate(id, "PATCH_APPLIED", upstreamID)
+	}
+
+	modulePkgs := make(map[string]*Package)
+	addModule := func(modPath, version string) *Package {
+		key := modPath + "@" + version
+		if p, ok := modulePkgs[key]; ok {
+			return p
+		}
+		p := &Package{
+			Name:             modPath,
+			VersionInfo:      version,
+			DownloadLocation: "NOASSERTION",
+			PrimaryPurpose:   "LIBRARY",
+			ExternalRefs: []*ExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  "pkg:golang/" + modPath + "@" + version,
+			}},
+		}
+		p.SPDXID = newID("Module", key)
+		doc.Packages = append(doc.Packages, p)
+		modulePkgs[key] = p
+		return p
+	}
+
+	err = archiveutil.EachArchiveEntry(in.ArchivePath, func(e *archiveutil.Entry, r io.Reader) error {
+		if r == nil {
+			return nil
+		}
+		name := strings.TrimPrefix(e.Name, "go/")
+		switch {
+		case name == "src/vendor/modules.txt" || name == "src/cmd/vendor/modules.txt":
+			mods, err := ParseModulesTxt(r)
+			if err != nil {
+				return fmt.Errorf("failed to parse %v: %v", e.Name, err)
+			}
+			for _, m := range mods {
+				p := addModule(m.Path, m.Version)
+				relate(archiveID, "CONTAINS", p.SPDXID)
+				vendored := "Vendored in " + path.Dir(name)
+				if len(m.Packages) > 0 {
+					vendored += ": " + strings.Join(m.Packages, ", ")
+				}
+				if p.Comment != "" {
+					vendored = p.Comment + "\n" + vendored
+				}
+				p.Comment = vendored
+			}
+		case strings.HasPrefix(name, "bin/") || strings.HasPrefix(name, "pkg/tool/"):
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			info, err := buildinfo.Read(bytes.NewReader(data))
+			if err != nil {
+				// Not a Go binary.
+				return nil
+			}
+			sum1 := sha1.Sum(data)
+			sum256 := sha256.Sum256(data)
+			id := newID("Binary", name)
+			var settings []string
+			for _, s := range info.Settings {
+				settings = append(settings, s.Key+"="+s.Value)
+			}
+			doc.Packages = append(doc.Packages, &Package{
+				SPDXID:           id,
+				Name:             name,
+				VersionInfo:      info.GoVersion,
+				DownloadLocation: "NOASSERTION",
+				Checksums:        []*Checksum{{"SHA1", hex.EncodeToString(sum1[:])}, {"SHA256", hex.EncodeToString(sum256[:])}},
+				PrimaryPurpose:   "APPLICATION",
+				Comment:          "path " + info.Path + "; build settings: " + strings.Join(settings, " "),
+			})
+			relate(archiveID, "CONTAINS", id)
+			for _, dep := range info.Deps {
+				if dep.Replace != nil {
+					dep = dep.Replace
+				}
+				relate(id, "DEPENDS_ON", addModule(dep.Path, dep.Version).SPDXID)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %v: %v", in.ArchivePath, err)
+	}
+	return doc, nil
+}
+
+var invalidIDChars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// WriteFile writes doc to path as indented JSON.
+func (doc *Document) WriteFile(path string) error {
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0o666)
+}
+
+// ParseModulesTxt parses a vendor/modules.txt file.
+func ParseModulesTxt(r io.Reader) ([]*Module, error) {
+	var mods []*Module
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := s.Text()
+		switch {
+		case strings.HasPrefix(line, "## "):
+			// Module metadata, such as "## explicit; go 1.22".
+		case strings.HasPrefix(line, "# "):
+			// "# path version" or "# path version => replacement [version]".
+			fields := strings.Fields(strings.TrimPrefix(line, "# "))
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("unexpected module line %q", line)
+			}
+			m := &Module{Path: fields[0], Version: fields[1]}
+			if i := slices.Index(fields, "=>"); i >= 0 && len(fields) >= i+3 {
+				m.Path, m.Version = fields[i+1], fields[i+2]
+			}
+			mods = append(mods, m)
+		case line != "":
+			if len(mods) == 0 {
+				return nil, fmt.Errorf("package %q listed before any module", line)
+			}
+			m := mods[len(mods)-1]
+			m.Packages = append(m.Packages, line)
+		}
+	}
+	return mods, s.Err()
+}
@@ -0,0 +1,144 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package sbom
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+const testModulesTxt = `# github.com/golang-fips/openssl/v2 v2.0.4-0.20250115103809-bf655f6d08d6
+## explicit; go 1.22
+github.com/golang-fips/openssl/v2
+github.com/golang-fips/openssl/v2/bbig
+# golang.org/x/crypto v0.30.0
+## explicit; go 1.20
+golang.org/x/crypto/chacha20
+# example.com/old v1.0.0 => example.com/new v1.1.0
+`
+
+func TestParseModulesTxt(t *testing.T) {
+	got, err := ParseModulesTxt(strings.NewReader(testModulesTxt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*Module{
+		{"github.com/golang-fips/openssl/v2", "v2.0.4-0.20250115103809-bf655f6d08d6", []string{"github.com/golang-fips/openssl/v2", "github.com/golang-fips/openssl/v2/bbig"}},
+		{"golang.org/x/crypto", "v0.30.0", []string{"golang.org/x/crypto/chacha20"}},
+		{"example.com/new", "v1.1.0", nil},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestGenerate(t *testing.T) {
+	// The test binary is a Go binary with build info.
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe, err := os.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "go1.24.1-1.linux-amd64.tar.gz")
+	err = archiveutil.WithTarGzCreate(archive, func(tw *tar.Writer) error {
+		for _, f := range []struct {
+			name    string
+			content []byte
+		}{
+			{"go/VERSION", []byte("go1.24.1")},
+			{"go/src/vendor/modules.txt", []byte(testModulesTxt)},
+			{"go/bin/go", exe},
+			{"go/bin/notgo", []byte("#!/bin/sh\n")},
+		} {
+			if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o755, Size: int64(len(f.content)), Typeflag: tar.TypeReg}); err != nil {
+				return err
+			}
+			if _, err := tw.Write(f.content); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	patchDir := filepath.Join(dir, "patches")
+	if err := os.Mkdir(patchDir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(patchDir, "0001-Test.patch"), []byte("patch"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	patches, err := ReadPatches(patchDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc, err := Generate(&Input{
+		ArchivePath:     archive,
+		Version:         "go1.24.1",
+		SubmoduleCommit: "0123456789abcdef",
+		Patches:         patches,
+		Created:         time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]*Package)
+	for _, p := range doc.Packages {
+		names[p.Name] = p
+	}
+	for _, want := range []string{"Microsoft build of Go", "go", "github.com/golang-fips/openssl/v2", "golang.org/x/crypto", "example.com/new", "bin/go"} {
+		if names[want] == nil {
+			t.Errorf("missing package %q", want)
+		}
+	}
+	if names["bin/notgo"] != nil {
+		t.Error("non-Go binary listed as a package")
+	}
+	if len(doc.Files) != 1 || doc.Files[0].FileName != "./patches/0001-Test.patch" {
+		t.Errorf("Files = %+v", doc.Files)
+	}
+
+	relationships := make(map[string]bool)
+	for _, r := range doc.Relationships {
+		relationships[r.SPDXElementID+" "+r.RelationshipType+" "+r.RelatedSPDXElement] = true
+	}
+	archiveID := names["Microsoft build of Go"].SPDXID
+	for _, want := range []string{
+		"SPDXRef-DOCUMENT DESCRIBES " + archiveID,
+		archiveID + " GENERATED_FROM " + names["go"].SPDXID,
+		doc.Files[0].SPDXID + " PATCH_APPLIED " + names["go"].SPDXID,
+		archiveID + " CONTAINS " + names["github.com/golang-fips/openssl/v2"].SPDXID,
+		archiveID + " CONTAINS " + names["bin/go"].SPDXID,
+	} {
+		if !relationships[want] {
+			t.Errorf("missing relationship %q", want)
+		}
+	}
+
+	// Every ID must be unique and valid.
+	seen := make(map[string]bool)
+	for _, p := range doc.Packages {
+		if seen[p.SPDXID] || invalidIDChars.MatchString(strings.TrimPrefix(p.SPDXID, "SPDXRef-")) {
+			t.Errorf("invalid or duplicate ID %q", p.SPDXID)
+		}
+		seen[p.SPDXID] = true
+	}
+}
@@ -0,0 +1,295 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wininstaller
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"unicode/utf16"
+)
+
+// An MSI file is an OLE compound file: a small file system of storages (dirs) and streams
+// (files). See https://learn.microsoft.com/openspecs/windows_protocols/ms-cfb.
+
+var cfbSignature = []byte{0xd0, 0xcf, 0x11, 0xe0, 0xa1, 0xb1, 0x1a, 0xe1}
+
+// Special sector numbers.
+const (
+	cfbMaxRegSect  = 0xfffffffa
+	cfbEndOfChain  = 0xfffffffe
+	cfbNoStream    = 0xffffffff
+	cfbHeaderDIFAT = 109
+)
+
+// Directory entry object types.
+const (
+	cfbStorage = 1
+	cfbStream  = 2
+	cfbRoot    = 5
+)
+
+// Authenticode signature streams. Signing an MSI adds these streams to the root storage and
+// doesn't change anything else.
+var msiSignatureStreams = []string{"\x05DigitalSignature", "\x05MsiDigitalSignatureEx"}
+
+// MSIInfo describes an MSI file.
+type MSIInfo struct {
+	// Streams are the paths of the streams in the file, sorted. A stream in a storage is named
+	// "storage/stream".
+	Streams []string
+	// ContentSHA256 is a hash of the names and content of all the streams other than the
+	// Authenticode signature. Signing doesn't change it.
+	ContentSHA256 string
+}
+
+// Signed returns true if the MSI file contains an Authenticode signature.
+func (i *MSIInfo) Signed() bool {
+	return slices.Contains(i.Streams, msiSignatureStreams[0])
+}
+
+// ReadMSI reads the MSI file at path.
+func ReadMSI(path string) (*MSIInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	info, err := readCFB(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read MSI %q: %v", path, err)
+	}
+	return info, nil
+}
+
+type cfbEntry struct {
+	name       string
+	objectType byte
+	left       uint32
+	right      uint32
+	child      uint32
+	start      uint32
+	size       uint64
+}
+
+type cfbReader struct {
+	r          io.ReaderAt
+	sectorSize int64
+	fat        []uint32
+	miniFAT    []uint32
+	miniStream []byte
+	entries    []cfbEntry
+}
+
+func readCFB(r io.ReaderAt) (*MSIInfo, error) {
+	header := make([]byte, 512)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(header[:8], cfbSignature) {
+		return nil, errors.New("not a compound file")
+	}
+	le := binary.LittleEndian
+	c := &cfbReader{r: r}
+	switch shift := le.Uint16(header[30:]); shift {
+	case 9, 12:
+		c.sectorSize = 1 << shift
+	default:
+		return nil, fmt.Errorf("unsupported sector shift %v", shift)
+	}
+	miniCutoff := uint64(le.Uint32(header[56:]))
+
+	// The DIFAT lists the sectors that hold the FAT. The first entries are in the header, and
+	// the rest are in a chain of DIFAT sectors, each ending with the next DIFAT sector number.
+	var fatSectors []uint32
+	for i := range cfbHeaderDIFAT {
+		fatSectors = append(fatSectors, le.Uint32(header[76+4*i:]))
+	}
+	perSector := int(c.sectorSize / 4)
+	for s, n := le.Uint32(header[68:]), le.Uint32(header[72:]); n > 0 && s <= cfbMaxRegSect; n-- {
+		b, err := c.readSector(s)
+		if err != nil {
+			return nil, err
+		}
+		for i := range perSector - 1 {
+			fatSectors = append(fatSectors, le.Uint32(b[4*i:]))
+		}
+		s = le.Uint32(b[c.sectorSize-4:])
+	}
+	fatCount := int(le.Uint32(header[44:]))
+	if fatCount > len(fatSectors) {
+		return nil, fmt.Errorf("FAT has %v sectors, but the DIFAT lists %v", fatCount, len(fatSectors))
+	}
+	for _, s := range fatSectors[:fatCount] {
+		b, err := c.readSector(s)
+		if err != nil {
+			return nil, err
+		}
+		for i := range perSector {
+			c.fat = append(c.fat, le.Uint32(b[4*i:]))
+		}
+	}
+
+	dir, err := c.readChain(le.Uint32(header[48:]), c.fat, c.readSector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %v", err)
+	}
+	for i := 0; i+128 <= len(dir); i += 128 {
+		c.entries = append(c.entries, parseCFBEntry(dir[i:i+128]))
+	}
+	if len(c.entries) == 0 || c.entries[0].objectType != cfbRoot {
+		return nil, errors.New("missing root entry")
+	}
+
+	// The mini stream holds the streams smaller than the cutoff in 64-byte sectors. It's stored
+	// as the root entry's content.
+	miniFAT, err := c.readChain(le.Uint32(header[60:]), c.fat, c.readSector)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mini FAT: %v", err)
+	}
+	for i := 0; i+4 <= len(miniFAT); i += 4 {
+		c.miniFAT = append(c.miniFAT, le.Uint32(miniFAT[i:]))
+	}
+	if c.miniStream, err = c.readStream(&c.entries[0], 0); err != nil {
+		return nil, fmt.Errorf("failed to read mini stream: %v", err)
+	}
+
+	streams := make(map[string]*cfbEntry)
+	var walk func(id uint32, prefix string, depth int) error
+	walk = func(id uint32, prefix string, depth int) error {
+		if id == cfbNoStream {
+			return nil
+		}
+		// Storages are stored as a tree of siblings. A malformed file could contain a cycle.
+		if int(id) >= len(c.entries) || depth > len(c.entries) {
+			return errors.New("invalid directory tree")
+		}
+		e := &c.entries[id]
+		switch e.objectType {
+		case cfbStorage:
+			if err := walk(e.child, prefix+e.name+"/", depth+1); err != nil {
+				return err
+			}
+		case cfbStream:
+			streams[prefix+e.name] = e
+		}
+		if err := walk(e.left, prefix, depth+1); err != nil {
+			return err
+		}
+		return walk(e.right, prefix, depth+1)
+	}
+	if err := walk(c.entries[0].child, "", 0); err != nil {
+		return nil, err
+	}
+	paths := slices.Sorted(maps.Keys(streams))
+
+	// Hash the streams in sorted order. Each stream's name and length are included so the
+	// boundaries between streams are unambiguous.
+	h := sha256.New()
+	for _, p := range paths {
+		if slices.Contains(msiSignatureStreams, p) {
+			continue
+		}
+		content, err := c.readStream(streams[p], miniCutoff)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stream %q: %v", p, err)
+		}
+		fmt.Fprintf(h, "%q %v\n", p, len(content))
+		h.Write(content)
+	}
+	return &MSIInfo{
+		Streams:       paths,
+		ContentSHA256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+func parseCFBEntry(b []byte) cfbEntry {
+	le := binary.LittleEndian
+	nameLen := min(int(le.Uint16(b[64:])), 64)
+	// The length includes the terminating null character.
+	name := make([]uint16, max(nameLen/2-1, 0))
+	for i := range name {
+		name[i] = le.Uint16(b[2*i:])
+	}
+	return cfbEntry{
+		name:       string(utf16.Decode(name)),
+		objectType: b[66],
+		left:       le.Uint32(b[68:]),
+		right:      le.Uint32(b[72:]),
+		child:      le.Uint32(b[76:]),
+		start:      le.Uint32(b[116:]),
+		size:       le.Uint64(b[120:]),
+	}
+}
+
+func (c *cfbReader) readSector(s uint32) ([]byte, error) {
+	if s > cfbMaxRegSect {
+		return nil, fmt.Errorf("invalid sector number %#x", s)
+	}
+	b := make([]byte, c.sectorSize)
+	if _, err := c.r.ReadAt(b, (int64(s)+1)*c.sectorSize); err != nil {
+		return nil, fmt.Errorf("failed to read sector %v: %v", s, err)
+	}
+	return b, nil
+}
+
+func (c *cfbReader) readMiniSector(s uint32) ([]byte, error) {
+	off := int(s) * 64
+	if off+64 > len(c.miniStream) {
+		return nil, fmt.Errorf("invalid mini sector number %v", s)
+	}
+	return c.miniStream[off : off+64], nil
+}
+
+// readChain reads the sectors in the chain starting at start, following the allocation table.
+func (c *cfbReader) readChain(start uint32, table []uint32, read func(uint32) ([]byte, error)) ([]byte, error) {
+	var content []byte
+	for s, n := start, 0; s != cfbEndOfChain; n++ {
+		if int(s) >= len(table) || n > len(table) {
+			return nil, fmt.Errorf("invalid sector chain at sector %#x", s)
+		}
+		b, err := read(s)
+		if err != nil {
+			return nil, err
+		}
+		content = append(content, b...)
+		s = table[s]
+	}
+	return content, nil
+}
+
+// readStream returns the content of the stream e. Streams smaller than miniCutoff are stored in
+// the mini stream.
+func (c *cfbReader) readStream(e *cfbEntry, miniCutoff uint64) ([]byte, error) {
+	if e.size == 0 {
+		return nil, nil
+	}
+	// Version 3 files only use the low 32 bits of the size.
+	size := e.size
+	if c.sectorSize == 512 {
+		size &= 0xffffffff
+	}
+	var content []byte
+	var err error
+	if size < miniCutoff {
+		content, err = c.readChain(e.start, c.miniFAT, c.readMiniSector)
+	} else {
+		content, err = c.readChain(e.start, c.fat, c.readSector)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(content)) < size {
+		return nil, fmt.Errorf("stream is %v bytes, but its sectors only hold %v", size, len(content))
+	}
+	return content[:size], nil
+}
@@ -0,0 +1,384 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package wininstaller creates a Windows Installer package (.msi) from a Go distribution zip. The
+// installer's WiX source and payload layout are generated in Go, then the WiX Toolset "wix"
+// command builds the MSI.
+package wininstaller
+
+import (
+	"archive/zip"
+	"cmp"
+	"context"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/microsoft/go/_util/internal/archiveutil"
+)
+
+// Metadata describes an installer.
+type Metadata struct {
+	// Version is the upstream Go version, such as "1.24.1", "1.25rc1", or "1.25-abcde1234" for a
+	// development build.
+	Version string
+	// Revision is the Microsoft revision of the build, such as "1".
+	Revision string
+	// GOARCH is the architecture of the Go distribution.
+	GOARCH string
+
+	Manufacturer string
+	// InstallDir is the dir in Program Files the distribution's "go" dir is installed to, such as
+	// `Microsoft\go`.
+	InstallDir string
+}
+
+// DefaultInstallDir is the dir in Program Files the installers install the Go distribution to.
+const DefaultInstallDir = `Microsoft\go`
+
+var archiveNameRegexp = regexp.MustCompile(`^go.*\.windows-([0-9a-z]+)\.zip$`)
+
+// MetadataFromArchive returns the default metadata for an installer of the Go distribution zip
+// at archivePath, with the given Microsoft revision, such as "1". The version comes from the
+// go/VERSION file in the zip. Only the architecture comes from the file name, such as
+// "go1.24.1-20241016.3.windows-amd64.zip": the part after the version is the ID of the build that
+// created the archive, like a CI build number or "dev", and isn't part of the installer version.
+func MetadataFromArchive(archivePath, revision string) (*Metadata, error) {
+	name := filepath.Base(archivePath)
+	m := archiveNameRegexp.FindStringSubmatch(name)
+	if m == nil {
+		return nil, fmt.Errorf("file name %q isn't a Windows Go distribution archive name like go1.24.1-20241016.3.windows-amd64.zip", name)
+	}
+	arch := m[1]
+	if _, ok := wixArchs[arch]; !ok {
+		return nil, fmt.Errorf("unsupported architecture %q in %q", arch, name)
+	}
+	version, err := readVersion(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	return &Metadata{
+		Version:      version,
+		Revision:     revision,
+		GOARCH:       arch,
+		Manufacturer: "Microsoft",
+		InstallDir:   DefaultInstallDir,
+	}, nil
+}
+
+// readVersion returns the Go version in the first line of the go/VERSION file in the zip at
+// archivePath, without the "go" prefix.
+func readVersion(archivePath string) (string, error) {
+	var version string
+	err := archiveutil.WithZipOpen(archivePath, func(zr *zip.ReadCloser) error {
+		f, err := zr.Open("go/VERSION")
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(f)
+		if err := cmp.Or(err, f.Close()); err != nil {
+			return err
+		}
+		line, _, _ := strings.Cut(string(data), "\n")
+		v, ok := strings.CutPrefix(strings.TrimSpace(line), "go")
+		if !ok || v == "" {
+			return fmt.Errorf("go/VERSION starts with %q, not a version like go1.24.1", line)
+		}
+		version = v
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read the Go version of %q: %v", archivePath, err)
+	}
+	return version, nil
+}
+
+// wixArchs maps each supported GOARCH to the WiX platform name.
+var wixArchs = map[string]string{
+	"386":   "x86",
+	"amd64": "x64",
+	"arm64": "arm64",
+}
+
+// productName returns the name shown in the list of installed programs.
+func (m *Metadata) productName() string {
+	return "Microsoft build of Go " + m.Version + "-" + m.Revision + " " + m.GOARCH
+}
+
+var versionRegexp = regexp.MustCompile(`^([0-9]+)\.([0-9]+)(?:\.([0-9]+))?(?:(?:rc|beta)[0-9]+)?(?:-[0-9A-Za-z.]+)?$`)
+
+// productVersion returns the version in the "major.minor.build.revision" form Windows Installer
+// requires. A prerelease or a development version, like "1.25-abcde1234", has build 0. Windows
+// Installer ignores the fourth field when it compares versions, so the installer allows upgrades
+// to the same version: a new revision or the release after a prerelease replaces the installed
+// one.
+func (m *Metadata) productVersion() (string, error) {
+	v := versionRegexp.FindStringSubmatch(m.Version)
+	if v == nil {
+		return "", fmt.Errorf("version %q can't be represented as a Windows Installer version", m.Version)
+	}
+	fields := [...]string{v[1], v[2], cmp.Or(v[3], "0")}
+	limits := [...]uint64{255, 255, 65535}
+	for i, f := range fields {
+		n, err := strconv.ParseUint(f, 10, 32)
+		if err != nil || n > limits[i] {
+			return "", fmt.Errorf("version %q can't be represented as a Windows Installer version", m.Version)
+		}
+	}
+	if _, err := strconv.ParseUint(m.Revision, 10, 16); err != nil {
+		return "", fmt.Errorf("revision %q can't be represented as a Windows Installer version", m.Revision)
+	}
+	return strings.Join(fields[:], ".") + "." + m.Revision, nil
+}
+
+// guid returns a GUID that is always the same for the given name, so it can identify the same
+// thing in the installers of different Go versions. It's a name-based UUID (RFC 9562 version 5).
+func guid(name string) string {
+	// A namespace UUID for the Microsoft build of Go installers.
+	namespace := [16]byte{0x5d, 0x0e, 0x1b, 0x7c, 0x3a, 0x64, 0x4e, 0x2f, 0x9b, 0x51, 0x2c, 0x8e, 0x61, 0x0d, 0x7a, 0x43}
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+	u := h.Sum(nil)[:16]
+	u[6] = u[6]&0x0f | 0x50
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("{%X-%X-%X-%X-%X}", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// upgradeCode returns the code shared by all the installers for m's architecture, so installing
+// a new version replaces the old one.
+func (m *Metadata) upgradeCode() string {
+	return guid("UpgradeCode windows-" + m.GOARCH)
+}
+
+// payloadDir is the dir in the work dir that contains the extracted distribution.
+const payloadDir = "payload"
+
+// sourceName is the name of the WiX source file in the work dir.
+const sourceName = "installer.wxs"
+
+// ExtractPayload extracts the regular files in the Go distribution zip at archivePath into dir,
+// and returns their slash-separated paths relative to dir in the same order as the zip. Every
+// entry must be in the top-level "go" dir.
+func ExtractPayload(archivePath, dir string) ([]string, error) {
+	var names []string
+	err := archiveutil.WithZipOpen(archivePath, func(zr *zip.ReadCloser) error {
+		return archiveutil.EachZipEntry(zr, func(f *zip.File) error {
+			if f.Name != "go/" && !strings.HasPrefix(f.Name, "go/") {
+				return fmt.Errorf("entry %q isn't in the top-level go dir", f.Name)
+			}
+			if f.FileInfo().IsDir() {
+				return nil
+			}
+			r, err := f.Open()
+			if err != nil {
+				return err
+			}
+			if err := cmp.Or(archiveutil.CopyToFile(filepath.Join(dir, filepath.FromSlash(f.Name)), r), r.Close()); err != nil {
+				return err
+			}
+			names = append(names, f.Name)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to extract %q: %v", archivePath, err)
+	}
+	return names, nil
+}
+
+// The WiX v4 source schema. Only the parts used by WriteSource are included.
+type (
+	wix struct {
+		XMLName xml.Name   `xml:"http://wixtoolset.org/schemas/v4/wxs Wix"`
+		Package wixPackage `xml:"Package"`
+	}
+	wixPackage struct {
+		Name           string `xml:"Name,attr"`
+		Manufacturer   string `xml:"Manufacturer,attr"`
+		Version        string `xml:"Version,attr"`
+		UpgradeCode    string `xml:"UpgradeCode,attr"`
+		Scope          string `xml:"Scope,attr"`
+		MajorUpgrade   wixMajorUpgrade
+		MediaTemplate  wixMediaTemplate
+		StandardDir    wixStandardDirectory
+		ComponentGroup wixComponentGroup
+		Feature        wixFeature
+	}
+	wixMajorUpgrade struct {
+		XMLName                  xml.Name `xml:"MajorUpgrade"`
+		AllowSameVersionUpgrades string   `xml:"AllowSameVersionUpgrades,attr"`
+		DowngradeErrorMessage    string   `xml:"DowngradeErrorMessage,attr"`
+	}
+	wixMediaTemplate struct {
+		XMLName  xml.Name `xml:"MediaTemplate"`
+		EmbedCab string   `xml:"EmbedCab,attr"`
+	}
+	wixStandardDirectory struct {
+		XMLName   xml.Name `xml:"StandardDirectory"`
+		ID        string   `xml:"Id,attr"`
+		Directory wixDirectory
+	}
+	wixDirectory struct {
+		XMLName   xml.Name `xml:"Directory"`
+		ID        string   `xml:"Id,attr"`
+		Name      string   `xml:"Name,attr"`
+		Directory []wixDirectory
+	}
+	wixComponentGroup struct {
+		XMLName    xml.Name       `xml:"ComponentGroup"`
+		ID         string         `xml:"Id,attr"`
+		Directory  string         `xml:"Directory,attr"`
+		Components []wixComponent `xml:"Component"`
+	}
+	wixComponent struct {
+		ID           string          `xml:"Id,attr,omitempty"`
+		Guid         string          `xml:"Guid,attr,omitempty"`
+		Subdirectory string          `xml:"Subdirectory,attr,omitempty"`
+		KeyPath      string          `xml:"KeyPath,attr,omitempty"`
+		File         *wixFile        `xml:"File"`
+		Environment  *wixEnvironment `xml:"Environment"`
+	}
+	wixFile struct {
+		Source string `xml:"Source,attr"`
+	}
+	wixEnvironment struct {
+		ID        string `xml:"Id,attr"`
+		Name      string `xml:"Name,attr"`
+		Value     string `xml:"Value,attr"`
+		Part      string `xml:"Part,attr"`
+		Action    string `xml:"Action,attr"`
+		System    string `xml:"System,attr"`
+		Permanent string `xml:"Permanent,attr"`
+	}
+	wixFeature struct {
+		XMLName           xml.Name `xml:"Feature"`
+		ID                string   `xml:"Id,attr"`
+		ComponentGroupRef struct {
+			ID string `xml:"Id,attr"`
+		}
+	}
+)
+
+// WriteSource writes the WiX source of an installer that installs the files in the payload dir
+// to w. names are the paths of the files relative to the payload dir, as returned by
+// ExtractPayload. The installer adds the "bin" dir of the installation to the system PATH.
+//
+// The files are listed in the same order as names and the only GUIDs in the source are derived
+// from m, so the same input always produces the same source. WiX generates a GUID for each file's
+// component based on its install path.
+func WriteSource(w io.Writer, names []string, m *Metadata) error {
+	version, err := m.productVersion()
+	if err != nil {
+		return err
+	}
+	// Build the Directory tree for the InstallDir path. The last dir is INSTALLDIR, which
+	// contains the "go" dir's content.
+	dirs := strings.Split(m.InstallDir, `\`)
+	installDir := wixDirectory{ID: "INSTALLDIR", Name: dirs[len(dirs)-1]}
+	for i := len(dirs) - 2; i >= 0; i-- {
+		installDir = wixDirectory{
+			ID:        "InstallDir" + strconv.Itoa(i),
+			Name:      dirs[i],
+			Directory: []wixDirectory{installDir},
+		}
+	}
+
+	p := wixPackage{
+		Name:         m.productName(),
+		Manufacturer: m.Manufacturer,
+		Version:      version,
+		UpgradeCode:  m.upgradeCode(),
+		Scope:        "perMachine",
+		MajorUpgrade: wixMajorUpgrade{
+			AllowSameVersionUpgrades: "yes",
+			DowngradeErrorMessage:    "A newer version of the Microsoft build of Go is already installed.",
+		},
+		MediaTemplate: wixMediaTemplate{EmbedCab: "yes"},
+		StandardDir: wixStandardDirectory{
+			ID:        "ProgramFiles6432Folder",
+			Directory: installDir,
+		},
+		ComponentGroup: wixComponentGroup{ID: "Go", Directory: "INSTALLDIR"},
+		Feature:        wixFeature{ID: "Go"},
+	}
+	p.Feature.ComponentGroupRef.ID = p.ComponentGroup.ID
+	for _, name := range names {
+		rel, ok := strings.CutPrefix(name, "go/")
+		if !ok {
+			return fmt.Errorf("file %q isn't in the top-level go dir", name)
+		}
+		c := wixComponent{File: &wixFile{Source: path.Join(payloadDir, name)}}
+		if dir := path.Dir(rel); dir != "." {
+			c.Subdirectory = strings.ReplaceAll(dir, "/", `\`)
+		}
+		p.ComponentGroup.Components = append(p.ComponentGroup.Components, c)
+	}
+	p.ComponentGroup.Components = append(p.ComponentGroup.Components, wixComponent{
+		ID:      "PathEnvironment",
+		Guid:    guid("PathEnvironment windows-" + m.GOARCH),
+		KeyPath: "yes",
+		Environment: &wixEnvironment{
+			ID:        "PATH",
+			Name:      "PATH",
+			Value:     "[INSTALLDIR]bin",
+			Part:      "last",
+			Action:    "set",
+			System:    "yes",
+			Permanent: "no",
+		},
+	})
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(wix{Package: p}); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// Build creates the installer at msiPath from the Go distribution zip at archivePath. It lays out
+// the payload and WiX source in workDir, then runs the WiX Toolset command at wixPath. The WiX
+// Toolset must be version 4 or later.
+//
+// WiX embeds the build time and a random package code in the installer, so building the same
+// archive twice doesn't produce the same file.
+func Build(ctx context.Context, wixPath, archivePath, workDir, msiPath string, m *Metadata) error {
+	arch, ok := wixArchs[m.GOARCH]
+	if !ok {
+		return fmt.Errorf("unsupported architecture %q", m.GOARCH)
+	}
+	names, err := ExtractPayload(archivePath, filepath.Join(workDir, payloadDir))
+	if err != nil {
+		return err
+	}
+	if err := archiveutil.WithFileCreate(filepath.Join(workDir, sourceName), func(f *os.File) error {
+		return WriteSource(f, names, m)
+	}); err != nil {
+		return err
+	}
+	absMSIPath, err := filepath.Abs(msiPath)
+	if err != nil {
+		return err
+	}
+	cmd := exec.CommandContext(ctx, wixPath, "build", "-arch", arch, "-o", absMSIPath, sourceName)
+	cmd.Dir = workDir
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run %v: %v\n%s", cmd, err, out)
+	}
+	return nil
+}
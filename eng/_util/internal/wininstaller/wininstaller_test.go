@@ -0,0 +1,400 @@
+// Copyright (c) Microsoft Corporation.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package wininstaller
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/xml"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+// writeTestZip writes a zip with the given entries to path, in name order. Names ending in "/"
+// are dirs.
+func writeTestZip(t *testing.T, path string, entries map[string]string) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range slices.Sorted(maps.Keys(entries)) {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(name, "/") {
+			w.Write([]byte(entries[name]))
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetadataFromArchive(t *testing.T) {
+	// The names are like the ones gobuild creates: the version, then the build ID, which is a CI
+	// build number or "dev".
+	tests := []struct {
+		name, versionFile         string
+		version, revision, goarch string
+		productVersion            string
+	}{
+		{"go1.24.1-20241016.3.windows-amd64.zip", "go1.24.1\ntime 2025-03-04T17:18:19Z\n", "1.24.1", "1", "amd64", "1.24.1.1"},
+		{"go1.24.1-dev.windows-arm64.zip", "go1.24.1", "1.24.1", "12", "arm64", "1.24.1.12"},
+		{"go1.25rc1-20250611.1.windows-386.zip", "go1.25rc1\n", "1.25rc1", "1", "386", "1.25.0.1"},
+		{"go1.25-abcde1234-dev.windows-amd64.zip", "go1.25-abcde1234", "1.25-abcde1234", "1", "amd64", "1.25.0.1"},
+		{"go1.24.1-1.windows-amd64.zip", "go1.24.1\n", "1.24.1", "1", "amd64", "1.24.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), tt.name)
+			writeTestZip(t, p, map[string]string{"go/VERSION": tt.versionFile, "go/bin/go.exe": "go"})
+			m, err := MetadataFromArchive(p, tt.revision)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m.Version != tt.version || m.Revision != tt.revision || m.GOARCH != tt.goarch {
+				t.Errorf("got %+v", m)
+			}
+			v, err := m.productVersion()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != tt.productVersion {
+				t.Errorf("productVersion = %q, want %q", v, tt.productVersion)
+			}
+		})
+	}
+
+	bad := []struct {
+		name     string
+		entries  map[string]string
+		revision string
+	}{
+		{"go1.24.1-20241016.3.linux-amd64.tar.gz", map[string]string{"go/VERSION": "go1.24.1"}, "1"},
+		{"go1.24.1-20241016.3.windows-mips.zip", map[string]string{"go/VERSION": "go1.24.1"}, "1"},
+		{"go1.24.1-20241016.3.windows-amd64.msi", map[string]string{"go/VERSION": "go1.24.1"}, "1"},
+		{"go1.24.1-20241016.3.windows-amd64.zip", map[string]string{"go/bin/go.exe": "go"}, "1"},
+		{"go1.24.1-20241016.3.windows-amd64.zip", map[string]string{"go/VERSION": "devel"}, "1"},
+	}
+	for _, tt := range bad {
+		p := filepath.Join(t.TempDir(), tt.name)
+		writeTestZip(t, p, tt.entries)
+		if _, err := MetadataFromArchive(p, tt.revision); err == nil {
+			t.Errorf("MetadataFromArchive(%q) with %v succeeded", tt.name, tt.entries)
+		}
+	}
+	// The revision is the last field of the product version, which is at most 65535.
+	m := &Metadata{Version: "1.24.1", Revision: "20241016"}
+	if _, err := m.productVersion(); err == nil {
+		t.Errorf("productVersion with revision %q succeeded", m.Revision)
+	}
+}
+
+func TestWriteSource(t *testing.T) {
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "go1.24.1-20241016.3.windows-amd64.zip")
+	entries := make(map[string]string)
+	for _, name := range []string{"go/", "go/VERSION", "go/bin/", "go/bin/go.exe", "go/pkg/tool/windows_amd64/vet.exe"} {
+		entries[name] = name
+	}
+	entries["go/VERSION"] = "go1.24.1"
+	writeTestZip(t, archivePath, entries)
+
+	names, err := ExtractPayload(archivePath, filepath.Join(dir, payloadDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"go/VERSION", "go/bin/go.exe", "go/pkg/tool/windows_amd64/vet.exe"}; !slices.Equal(names, want) {
+		t.Errorf("ExtractPayload = %q, want %q", names, want)
+	}
+	if b, err := os.ReadFile(filepath.Join(dir, payloadDir, "go", "bin", "go.exe")); err != nil || string(b) != "go/bin/go.exe" {
+		t.Errorf("extracted go.exe: %q, %v", b, err)
+	}
+
+	m, err := MetadataFromArchive(archivePath, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var source, again bytes.Buffer
+	if err := WriteSource(&source, names, m); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSource(&again, names, m); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(source.Bytes(), again.Bytes()) {
+		t.Error("WriteSource isn't deterministic")
+	}
+
+	var w wix
+	if err := xml.Unmarshal(source.Bytes(), &w); err != nil {
+		t.Fatalf("failed to parse source: %v\n%s", err, source.Bytes())
+	}
+	p := &w.Package
+	if p.Version != "1.24.1.1" || p.UpgradeCode != m.upgradeCode() {
+		t.Errorf("got version %q, upgrade code %q", p.Version, p.UpgradeCode)
+	}
+	if d := p.StandardDir.Directory; d.Name != "Microsoft" || len(d.Directory) != 1 || d.Directory[0].ID != "INSTALLDIR" || d.Directory[0].Name != "go" {
+		t.Errorf("got install dir %+v", d)
+	}
+	var got []string
+	for _, c := range p.ComponentGroup.Components {
+		if c.File != nil {
+			got = append(got, c.Subdirectory+" "+c.File.Source)
+		} else if c.Environment == nil || c.Environment.Value != "[INSTALLDIR]bin" || c.Guid == "" {
+			t.Errorf("unexpected component %+v", c)
+		}
+	}
+	want := []string{
+		" payload/go/VERSION",
+		"bin payload/go/bin/go.exe",
+		`pkg\tool\windows_amd64 payload/go/pkg/tool/windows_amd64/vet.exe`,
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("got files %q, want %q", got, want)
+	}
+
+	// The upgrade code identifies the product across versions, but not across architectures.
+	m386 := &Metadata{Version: "1.25.0", Revision: "2", GOARCH: "386"}
+	m2 := &Metadata{Version: "1.25.0", Revision: "2", GOARCH: "amd64"}
+	if m.upgradeCode() != m2.upgradeCode() || m.upgradeCode() == m386.upgradeCode() {
+		t.Errorf("unexpected upgrade codes %v, %v, %v", m.upgradeCode(), m2.upgradeCode(), m386.upgradeCode())
+	}
+}
+
+type testStream struct {
+	name    string
+	storage string
+	content []byte
+}
+
+// writeTestCFB returns a version 3 compound file containing the given streams. Streams smaller
+// than 4096 bytes are stored in the mini stream, like a real MSI's tables.
+func writeTestCFB(streams []testStream) []byte {
+	const (
+		fatSect   = 0xfffffffd
+		endChain  = 0xfffffffe
+		freeSect  = 0xffffffff
+		noStream  = 0xffffffff
+		sectorLen = 512
+	)
+	le := binary.LittleEndian
+	// Sector 0 holds the FAT. The rest are allocated in order.
+	fat := []uint32{fatSect}
+	var sectors [][]byte
+	sectors = append(sectors, nil)
+	alloc := func(b []byte) uint32 {
+		if len(b) == 0 {
+			return endChain
+		}
+		start := uint32(len(sectors))
+		for i := 0; i < len(b); i += sectorLen {
+			s := make([]byte, sectorLen)
+			copy(s, b[i:])
+			sectors = append(sectors, s)
+			fat = append(fat, uint32(len(sectors)))
+		}
+		fat[len(fat)-1] = endChain
+		return start
+	}
+
+	var miniStream []byte
+	var miniFAT []uint32
+	type entry struct {
+		name       string
+		objectType byte
+		child      uint32
+		right      uint32
+		start      uint32
+		size       int
+	}
+	entries := []entry{{name: "Root Entry", objectType: 5, child: noStream, right: noStream}}
+	storages := map[string]int{"": 0}
+	// Link each new entry as the first child of its storage. A real file balances the siblings
+	// in a red-black tree, but the reader doesn't depend on it.
+	link := func(parent int, e entry) int {
+		e.right = entries[parent].child
+		entries = append(entries, e)
+		entries[parent].child = uint32(len(entries) - 1)
+		return len(entries) - 1
+	}
+	var big [][]byte
+	var bigEntries []int
+	for _, s := range streams {
+		parent, ok := storages[s.storage]
+		if !ok {
+			parent = link(0, entry{name: s.storage, objectType: 1, child: noStream})
+			storages[s.storage] = parent
+		}
+		e := entry{name: s.name, objectType: 2, child: noStream, start: endChain, size: len(s.content)}
+		if len(s.content) >= 4096 {
+			i := link(parent, e)
+			big = append(big, s.content)
+			bigEntries = append(bigEntries, i)
+			continue
+		}
+		if len(s.content) > 0 {
+			e.start = uint32(len(miniFAT))
+			for i := 0; i < len(s.content); i += 64 {
+				chunk := make([]byte, 64)
+				copy(chunk, s.content[i:])
+				miniStream = append(miniStream, chunk...)
+				miniFAT = append(miniFAT, uint32(len(miniFAT)+1))
+			}
+			miniFAT[len(miniFAT)-1] = endChain
+		}
+		link(parent, e)
+	}
+	for i, b := range big {
+		entries[bigEntries[i]].start = alloc(b)
+	}
+	entries[0].start = alloc(miniStream)
+	entries[0].size = len(miniStream)
+	miniFATBytes := make([]byte, 4*len(miniFAT))
+	for i, s := range miniFAT {
+		le.PutUint32(miniFATBytes[4*i:], s)
+	}
+	miniFATStart := alloc(miniFATBytes)
+
+	dir := make([]byte, 128*len(entries))
+	for i, e := range entries {
+		b := dir[128*i:]
+		name := utf16.Encode([]rune(e.name))
+		for j, c := range name {
+			le.PutUint16(b[2*j:], c)
+		}
+		le.PutUint16(b[64:], uint16(2*len(name)+2))
+		b[66] = e.objectType
+		le.PutUint32(b[68:], noStream)
+		le.PutUint32(b[72:], e.right)
+		le.PutUint32(b[76:], e.child)
+		le.PutUint32(b[116:], e.start)
+		le.PutUint64(b[120:], uint64(e.size))
+	}
+	dirStart := alloc(dir)
+
+	if len(fat) > sectorLen/4 {
+		panic("test compound file too large")
+	}
+	sectors[0] = make([]byte, sectorLen)
+	for i := range sectorLen / 4 {
+		s := uint32(freeSect)
+		if i < len(fat) {
+			s = fat[i]
+		}
+		le.PutUint32(sectors[0][4*i:], s)
+	}
+
+	header := make([]byte, 512)
+	copy(header, cfbSignature)
+	le.PutUint16(header[24:], 0x3e)
+	le.PutUint16(header[26:], 3)
+	le.PutUint16(header[28:], 0xfffe)
+	le.PutUint16(header[30:], 9)
+	le.PutUint16(header[32:], 6)
+	le.PutUint32(header[44:], 1)
+	le.PutUint32(header[48:], dirStart)
+	le.PutUint32(header[56:], 4096)
+	le.PutUint32(header[60:], miniFATStart)
+	le.PutUint32(header[64:], uint32((len(miniFATBytes)+sectorLen-1)/sectorLen))
+	le.PutUint32(header[68:], endChain)
+	for i := range cfbHeaderDIFAT {
+		le.PutUint32(header[76+4*i:], freeSect)
+	}
+	le.PutUint32(header[76:], 0)
+	return slices.Concat(append([][]byte{header}, sectors...)...)
+}
+
+func TestReadMSI(t *testing.T) {
+	streams := []testStream{
+		{name: "\x05SummaryInformation", content: []byte("summary")},
+		{name: "Table", content: bytes.Repeat([]byte("row "), 100)},
+		{name: "Empty"},
+		{name: "payload.cab", content: bytes.Repeat([]byte("cabinet "), 1000)},
+		{name: "Transform", storage: "Sub", content: []byte("transform")},
+	}
+	dir := t.TempDir()
+	read := func(name string, streams []testStream) *MSIInfo {
+		t.Helper()
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, writeTestCFB(streams), 0o666); err != nil {
+			t.Fatal(err)
+		}
+		info, err := ReadMSI(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info
+	}
+
+	original := read("original.msi", streams)
+	want := []string{"\x05SummaryInformation", "Empty", "Sub/Transform", "Table", "payload.cab"}
+	if !slices.Equal(original.Streams, want) {
+		t.Errorf("Streams = %q, want %q", original.Streams, want)
+	}
+	if original.Signed() {
+		t.Error("unsigned MSI is signed")
+	}
+
+	signed := read("signed.msi", append(slices.Clone(streams),
+		testStream{name: "\x05DigitalSignature", content: []byte("signature")}))
+	if !signed.Signed() {
+		t.Error("signed MSI isn't signed")
+	}
+	if signed.ContentSHA256 != original.ContentSHA256 {
+		t.Error("adding a signature changed the content hash")
+	}
+
+	for i := range streams {
+		changed := slices.Clone(streams)
+		changed[i].content = append(slices.Clone(changed[i].content), '!')
+		if info := read("changed.msi", changed); info.ContentSHA256 == original.ContentSHA256 {
+			t.Errorf("changing stream %q didn't change the content hash", streams[i].name)
+		}
+	}
+
+	p := filepath.Join(dir, "not.msi")
+	if err := os.WriteFile(p, make([]byte, 1024), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadMSI(p); err == nil {
+		t.Error("ReadMSI of a file that isn't a compound file succeeded")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	wixPath, err := exec.LookPath("wix")
+	if err != nil {
+		t.Skip("wix not found")
+	}
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "go1.24.1-20241016.3.windows-amd64.zip")
+	writeTestZip(t, archivePath, map[string]string{"go/VERSION": "go1.24.1", "go/bin/go.exe": "go"})
+	m, err := MetadataFromArchive(archivePath, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msiPath := filepath.Join(dir, "go1.24.1-1.windows-amd64.msi")
+	if err := Build(context.Background(), wixPath, archivePath, filepath.Join(dir, "work"), msiPath, m); err != nil {
+		t.Fatal(err)
+	}
+	info, err := ReadMSI(msiPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Signed() {
+		t.Error("new MSI is signed")
+	}
+}